@@ -0,0 +1,646 @@
+package udf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Appender adds a session to a sequential volume on write-once media, the
+// way packet writing does. Entries are added as with Writer: WriteHeader,
+// then Write for the data of regular files. Close records the changed
+// directories and the file entries after the last recorded block, followed
+// by an updated virtual allocation table and its VAT ICB.
+//
+// Nothing recorded is overwritten, so the earlier sessions stay readable
+// through their own VAT. Adding an existing regular file replaces it: its
+// new file entry takes the virtual address of the old one.
+type Appender struct {
+	w   io.WriterAt
+	udf *Udf
+	// uw records the file entries and identifiers
+	uw  *Writer
+	vat *VirtualAllocationTable
+	// virtual is the virtual partition, recorded in physical
+	virtual  uint16
+	physical uint16
+	// start is the sector of the first block of the physical partition,
+	// next the next block to record and limit the length of the partition
+	start uint64
+	next  uint32
+	limit uint32
+
+	dirs     map[string]*appendDir
+	nodes    []*writerNode
+	links    map[*writerNode]uint16
+	uniqueID uint64
+	files    uint32
+	newDirs  uint32
+
+	cur       *writerNode
+	remaining int64
+	pos       int64
+	embedded  bool
+
+	err    error
+	closed bool
+}
+
+// appendDir is a directory the session may change
+type appendDir struct {
+	// node addresses the directory; its children are the entries added
+	node *writerNode
+	// fe is the file entry of an existing directory, data its identifiers
+	fe   FileEntryInterface
+	data []byte
+	// hdr changes the attributes of an existing directory
+	hdr *Header
+}
+
+// NewAppender returns an Appender reading the volume from r and recording
+// the new session to w, which must write to the same image
+func NewAppender(r io.ReaderAt, w io.WriterAt) (ua *Appender, err error) {
+	ua = &Appender{
+		w:     w,
+		dirs:  make(map[string]*appendDir),
+		links: make(map[*writerNode]uint16),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ua, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	ua.udf, err = NewUdfFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	udf := ua.udf
+	info := udf.Info()
+	if info.HardWriteProtect || info.SoftWriteProtect {
+		return nil, errors.New("udf: the volume is write-protected")
+	}
+	found := false
+	for i, pMap := range udf.lvd.PartitionMaps {
+		if pMap.isVirtual() {
+			ua.virtual, found = uint16(i), true
+		}
+	}
+	if !found {
+		return nil, errors.New("udf: the volume has no virtual partition")
+	}
+	ua.physical = udf.physicalPartition(ua.virtual)
+	ua.start = udf.LogicalPartitionStart(ua.physical)
+	pd, _ := udf.mapDescriptor(&udf.lvd.PartitionMaps[ua.physical])
+	ua.limit = pd.PartitionLength
+
+	revision := info.UDFRevision
+	if revision == 0 {
+		revision = UDF_REVISION_201
+	}
+	ua.uw = &Writer{opts: WriterOptions{
+		Revision:      revision,
+		BlockSize:     uint32(udf.SECTOR_SIZE),
+		RecordingTime: time.Now(),
+	}}
+
+	// The new session starts after the last recorded block, and its VAT
+	// links back to the current one
+	current := udf.vat[ua.virtual]
+	ua.vat = &VirtualAllocationTable{}
+	*ua.vat = *current
+	ua.vat.Entries = append([]uint32(nil), current.Entries...)
+	ua.vat.PreviousVATICBLocation = uint32(udf.vatSector - ua.start)
+	if current.data == nil {
+		ua.vat.MinimumUDFReadRevision = revision
+		ua.vat.MinimumUDFWriteRevision = revision
+		ua.vat.MaximumUDFWriteRevision = revision
+		ua.vat.LogicalVolumeIdentifier = udf.lvd.LogicalVolumeIdentifier
+	}
+	ua.next = uint32(uint64(readerSize(r))/udf.SECTOR_SIZE - ua.start)
+	if ua.next >= ua.limit {
+		return nil, errors.New("udf: the partition has no room for another session")
+	}
+
+	// Unique IDs go on from the largest one of the file entries, all of
+	// which live in the virtual partition
+	ua.uniqueID = 16
+	if lvid := udf.LogicalVolumeIntegrity(); lvid != nil {
+		ua.uniqueID = maxUint64(ua.uniqueID, lvid.UniqueID)
+	}
+	for block, entry := range ua.vat.Entries {
+		if entry == VAT_ENTRY_UNUSED {
+			continue
+		}
+		desc := NewDescriptor(udf.ReadSector(udf.sectorOf(ua.virtual, uint64(block))))
+		if (desc.TagIdentifier == DESCRIPTOR_FILE_ENTRY || desc.TagIdentifier == DESCRIPTOR_EXTENDED_FILE_ENTRY) && desc.Valid() {
+			fe := NewFileEntry(ua.virtual, udf.ReadSector(udf.sectorOf(ua.virtual, uint64(block))))
+			ua.uniqueID = maxUint64(ua.uniqueID, fe.GetUniqueID()+1)
+		}
+	}
+	if uint32(ua.uniqueID) < 16 {
+		ua.uniqueID = ua.uniqueID&^0xFFFFFFFF | 16
+	}
+
+	root := udf.readICBHierarchy(udf.fsd.RootDirectoryICB)
+	ua.dirs["/"] = ua.existingDir("/", root[len(root)-1])
+	return ua, nil
+}
+
+func (ua *Appender) existingDir(name string, entry icbEntry) *appendDir {
+	node := &writerNode{
+		hdr:      Header{Name: name, Mode: os.ModeDir},
+		byName:   make(map[string]*writerNode),
+		location: entry.location,
+		uniqueID: entry.fe.GetUniqueID(),
+	}
+	data, _ := readAllData(ua.udf, entry.fe)
+	return &appendDir{node: node, fe: entry.fe, data: data}
+}
+
+// readAllData returns the data of a file entry, cut to its length
+func readAllData(udf *Udf, fe FileEntryInterface) ([]byte, error) {
+	buf := make([]byte, fe.GetInformationLength())
+	n, err := io.ReadFull(udf.NewFileEntryReader(fe), buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// identifier returns the identifier naming an entry in an existing
+// directory, nil if there is none
+func (dir *appendDir) identifier(name string) *FileIdentifierDescriptor {
+	data := dir.data
+	for off := 0; off+38 <= len(data); {
+		if off+38+int(rl_u16(data[off+36:]))+int(data[off+19]) > len(data) {
+			break
+		}
+		fid := NewFileIdentifierDescriptor(data[off:])
+		if fid.Descriptor.TagIdentifier != DESCRIPTOR_IDENTIFIER {
+			break
+		}
+		if fid.FileCharacteristics&(FILE_CHARACTERISTIC_DELETED|FILE_CHARACTERISTIC_PARENT) == 0 && fid.FileIdentifier == name {
+			return fid
+		}
+		off += int(fid.Len())
+	}
+	return nil
+}
+
+// lookupDir returns the directory at the given clean path, creating it and
+// its parents if needed
+func (ua *Appender) lookupDir(name string) (*appendDir, error) {
+	if dir, ok := ua.dirs[name]; ok {
+		return dir, nil
+	}
+	parent, err := ua.lookupDir(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(name)
+	if _, ok := parent.node.byName[base]; ok {
+		// Directories added by the session are known
+		return nil, fmt.Errorf("udf: %s is not a directory", name)
+	}
+	if fid := parent.identifier(base); fid != nil {
+		if fid.FileCharacteristics&FILE_CHARACTERISTIC_DIRECTORY == 0 {
+			return nil, fmt.Errorf("udf: %s is not a directory", name)
+		}
+		entries := ua.udf.readICBHierarchy(fid.ICB)
+		ua.dirs[name] = ua.existingDir(name, entries[len(entries)-1])
+		return ua.dirs[name], nil
+	}
+	ua.addNode(parent, base, Header{
+		Name:    name,
+		Mode:    os.ModeDir | 0755,
+		ModTime: ua.uw.opts.RecordingTime,
+	})
+	return ua.dirs[name], nil
+}
+
+// allocateVirtual adds blocks to the virtual partition, returning the
+// first one; they are mapped once recorded
+func (ua *Appender) allocateVirtual(blocks int) uint32 {
+	first := uint32(len(ua.vat.Entries))
+	for i := 0; i < blocks; i++ {
+		ua.vat.Entries = append(ua.vat.Entries, VAT_ENTRY_UNUSED)
+	}
+	return first
+}
+
+// allocate takes blocks of the physical partition after the ones recorded
+func (ua *Appender) allocate(blocks uint32) (uint32, error) {
+	if ua.next+blocks > ua.limit {
+		return 0, errors.New("udf: not enough free space on the volume")
+	}
+	block := ua.next
+	ua.next += blocks
+	return block, nil
+}
+
+func (ua *Appender) writeBlocks(block uint32, b []byte) error {
+	_, err := ua.w.WriteAt(b, int64(ua.start+uint64(block))*int64(ua.udf.SECTOR_SIZE))
+	return err
+}
+
+// record writes blocks of the virtual partition after the ones recorded,
+// mapping them to where they are recorded
+func (ua *Appender) record(first uint32, b []byte) error {
+	bs := int(ua.udf.SECTOR_SIZE)
+	blocks := (len(b) + bs - 1) / bs
+	block, err := ua.allocate(uint32(blocks))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, blocks*bs)
+	copy(buf, b)
+	for i := 0; i < blocks; i++ {
+		ua.vat.Entries[first+uint32(i)] = block + uint32(i)
+	}
+	return ua.writeBlocks(block, buf)
+}
+
+func (ua *Appender) addNode(parent *appendDir, name string, hdr Header) *writerNode {
+	node := &writerNode{
+		hdr:      hdr,
+		parent:   parent.node,
+		location: LbAddr{ua.allocateVirtual(1), ua.virtual},
+		uniqueID: ua.uniqueID,
+	}
+	ua.uniqueID++
+	if uint32(ua.uniqueID) < 16 {
+		ua.uniqueID |= 16
+	}
+	parent.node.children = append(parent.node.children, node)
+	parent.node.byName[name] = node
+	ua.nodes = append(ua.nodes, node)
+	if node.isDir() {
+		node.byName = make(map[string]*writerNode)
+		ua.dirs[hdr.Name] = &appendDir{node: node}
+		ua.newDirs++
+	} else {
+		ua.files++
+	}
+	return node
+}
+
+func (ua *Appender) finishEntry() error {
+	if ua.remaining > 0 {
+		return fmt.Errorf("udf: missed writing %d bytes of %s", ua.remaining, ua.cur.hdr.Name)
+	}
+	ua.cur = nil
+	return nil
+}
+
+// WriteHeader adds an entry to the session. For regular files, hdr.Size
+// bytes of data must then be written with Write. A header naming an
+// existing directory changes its attributes.
+func (ua *Appender) WriteHeader(hdr *Header) error {
+	if ua.closed {
+		return ErrWriteAfterClose
+	}
+	if ua.err != nil {
+		return ua.err
+	}
+	if err := ua.finishEntry(); err != nil {
+		return err
+	}
+	name := path.Clean("/" + hdr.Name)
+	isDir := hdr.Mode&os.ModeType == os.ModeDir
+	if name == "/" && !isDir {
+		return errors.New("udf: the root entry must be a directory")
+	}
+	if dir, ok := ua.dirs[name]; ok {
+		if !isDir {
+			return fmt.Errorf("udf: %s: %w", name, os.ErrExist)
+		}
+		if dir.fe == nil {
+			dir.node.hdr = *hdr
+			dir.node.hdr.Name = name
+		} else {
+			dir.hdr = hdr
+		}
+		return nil
+	}
+	parent, err := ua.lookupDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if len(w_dcharacters(base)) > 255 {
+		return fmt.Errorf("udf: name too long: %s", base)
+	}
+	if _, ok := parent.node.byName[base]; ok {
+		return fmt.Errorf("udf: duplicate entry %s", name)
+	}
+
+	var node *writerNode
+	if fid := parent.identifier(base); fid != nil {
+		if isDir {
+			dir, err := ua.lookupDir(name)
+			if err != nil {
+				return fmt.Errorf("udf: %s: %w", name, os.ErrExist)
+			}
+			dir.hdr = hdr
+			return nil
+		}
+		if fid.FileCharacteristics&FILE_CHARACTERISTIC_DIRECTORY != 0 || fid.ICB.Location.PartitionReferenceNumber != ua.virtual {
+			return fmt.Errorf("udf: %s: %w", name, os.ErrExist)
+		}
+		// The new file entry replaces the old one at its virtual address
+		old := ua.udf.readFileEntry(fid.ICB)
+		node = &writerNode{
+			hdr:      *hdr,
+			parent:   parent.node,
+			location: fid.ICB.Location,
+			uniqueID: old.GetUniqueID(),
+		}
+		parent.node.byName[base] = node
+		ua.nodes = append(ua.nodes, node)
+		ua.links[node] = old.GetFileLinkCount()
+	} else {
+		node = ua.addNode(parent, base, *hdr)
+	}
+	node.hdr.Name = name
+
+	switch {
+	case hdr.Mode&os.ModeSymlink != 0:
+		node.data = w_pathComponents(hdr.Linkname)
+	case hdr.Mode&os.ModeType == 0:
+		if hdr.Size < 0 {
+			return fmt.Errorf("udf: negative size for %s", name)
+		}
+		ua.cur = node
+		ua.remaining = hdr.Size
+		ua.embedded = hdr.Size <= int64(ua.uw.embeddedLimit())
+		if ua.embedded {
+			node.data = make([]byte, 0, hdr.Size)
+			break
+		}
+		bs := uint64(ua.udf.SECTOR_SIZE)
+		block, err := ua.allocate(uint32((uint64(hdr.Size) + bs - 1) / bs))
+		if err != nil {
+			ua.err = err
+			return err
+		}
+		ua.pos = int64(ua.start+uint64(block)) * int64(bs)
+		for length := uint64(hdr.Size); length > 0; {
+			extentLength := uint32(minUint64(length, uint64(ua.uw.maxExtentLength())))
+			node.extents = append(node.extents, ExtentLong{extentLength, LbAddr{block, ua.physical}})
+			block += (extentLength + uint32(bs) - 1) / uint32(bs)
+			length -= uint64(extentLength)
+		}
+		if len(node.extents) > ua.uw.embeddedLimit()/16 {
+			ua.err = fmt.Errorf("udf: %s is too large for a single file entry", name)
+			return ua.err
+		}
+	}
+	return nil
+}
+
+// Write writes data of the current regular file
+func (ua *Appender) Write(p []byte) (n int, err error) {
+	if ua.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if ua.err != nil {
+		return 0, ua.err
+	}
+	if ua.cur == nil || int64(len(p)) > ua.remaining {
+		err = ErrWriteTooLong
+		if ua.cur == nil {
+			return 0, err
+		}
+		p = p[:ua.remaining]
+	}
+	if ua.embedded {
+		ua.cur.data = append(ua.cur.data, p...)
+		n = len(p)
+	} else {
+		n, ua.err = ua.w.WriteAt(p, ua.pos)
+		if ua.err != nil {
+			return n, ua.err
+		}
+		ua.pos += int64(n)
+	}
+	ua.remaining -= int64(n)
+	return n, err
+}
+
+// Close records the session. It does not close the underlying writer.
+func (ua *Appender) Close() error {
+	if ua.closed {
+		return ErrWriteAfterClose
+	}
+	if ua.err != nil {
+		return ua.err
+	}
+	if err := ua.finishEntry(); err != nil {
+		return err
+	}
+	ua.closed = true
+	defer func() {
+		if r := recover(); r != nil {
+			ua.err = fmt.Errorf("udf: %v", r)
+		}
+	}()
+	ua.err = ua.close()
+	return ua.err
+}
+
+func (ua *Appender) close() error {
+	names := make([]string, 0, len(ua.dirs))
+	for name := range ua.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ua.recordDir(ua.dirs[name]); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range ua.nodes {
+		if node.isDir() {
+			continue
+		}
+		if len(node.data) > ua.uw.embeddedLimit() {
+			block, err := ua.allocate(uint32((len(node.data) + int(ua.udf.SECTOR_SIZE) - 1) / int(ua.udf.SECTOR_SIZE)))
+			if err != nil {
+				return err
+			}
+			if err := ua.writeBlocks(block, node.data); err != nil {
+				return err
+			}
+			node.extents = []ExtentLong{{uint32(len(node.data)), LbAddr{block, ua.physical}}}
+			node.data = nil
+		}
+		fe, err := ua.uw.fileEntry(node)
+		if err != nil {
+			return err
+		}
+		if links := ua.links[node]; links > 1 {
+			entry := NewFileEntry(ua.virtual, fe)
+			entryFields(entry).FileLinkCount = links
+			fe = marshalFileEntry(entry)
+		}
+		if err := ua.record(node.location.LogicalBlockNumber, fe); err != nil {
+			return err
+		}
+	}
+
+	ua.vat.NumberOfFiles += ua.files
+	ua.vat.NumberOfDirectories += ua.newDirs
+	data, icb, err := ua.uw.vatFile(ua.next, ua.vat, ua.uniqueID)
+	if err != nil {
+		return err
+	}
+	block, err := ua.allocate(uint32(uint64(len(data)+len(icb)) / ua.udf.SECTOR_SIZE))
+	if err != nil {
+		return err
+	}
+	return ua.writeBlocks(block, append(data, icb...))
+}
+
+func marshalFileEntry(fe FileEntryInterface) (b []byte) {
+	switch fe := fe.(type) {
+	case *ExtendedFileEntry:
+		b, _ = fe.MarshalBinary()
+	case *FileEntry:
+		b, _ = fe.MarshalBinary()
+	}
+	return
+}
+
+// recordDir records the identifiers and the file entry of a directory the
+// session changed, its data going to new virtual blocks
+func (ua *Appender) recordDir(dir *appendDir) error {
+	node := dir.node
+	if dir.fe != nil && len(node.children) == 0 && dir.hdr == nil {
+		return nil
+	}
+	uw := ua.uw
+	bs := ua.udf.SECTOR_SIZE
+	data := dir.data
+	if dir.fe == nil {
+		parent := node.parent
+		if parent == nil {
+			parent = node
+		}
+		data = uw.fileIdentifier(parent, "", FILE_CHARACTERISTIC_PARENT|FILE_CHARACTERISTIC_DIRECTORY)
+	}
+	var subdirs uint16
+	for _, child := range node.children {
+		var characteristics uint8
+		if child.isDir() {
+			characteristics = FILE_CHARACTERISTIC_DIRECTORY
+			subdirs++
+		}
+		data = append(data, uw.fileIdentifier(child, path.Base(child.hdr.Name), characteristics)...)
+	}
+
+	headerLength := uw.fileEntryHeaderLength()
+	if dir.fe != nil {
+		headerLength = entryHeaderLength(dir.fe) + len(entryFields(dir.fe).ExtendedAttributes)
+	}
+	first := node.location.LogicalBlockNumber
+	embedded := uint64(headerLength+len(data)) <= bs
+	if !embedded {
+		first = ua.allocateVirtual(int((uint64(len(data)) + bs - 1) / bs))
+	}
+	// Each identifier records the block holding its tag
+	for off := uint64(0); off+38 <= uint64(len(data)); {
+		fid := NewFileIdentifierDescriptor(data[off:])
+		end := minUint64(off+fid.Len(), uint64(len(data)))
+		if embedded {
+			wl_u32(data[off+12:], first)
+		} else {
+			wl_u32(data[off+12:], first+uint32(off/bs))
+		}
+		setDescriptorTag(data[off:end])
+		off = end
+	}
+	if !embedded {
+		if err := ua.record(first, data); err != nil {
+			return err
+		}
+	}
+
+	var fe []byte
+	if dir.fe == nil {
+		if embedded {
+			node.data = data
+		} else {
+			node.extents = []ExtentLong{{uint32(len(data)), LbAddr{first, ua.virtual}}}
+		}
+		var err error
+		if fe, err = uw.fileEntry(node); err != nil {
+			return err
+		}
+	} else {
+		fe = ua.changeDirectoryEntry(dir, data, embedded, first, subdirs)
+		if uint64(len(fe)) > bs {
+			return fmt.Errorf("udf: file entry of %s does not fit in a block", node.hdr.Name)
+		}
+	}
+	return ua.record(node.location.LogicalBlockNumber, fe)
+}
+
+// changeDirectoryEntry returns the file entry of an existing directory
+// updated for its new identifiers; the virtual blocks of its previous
+// identifiers are no longer mapped
+func (ua *Appender) changeDirectoryEntry(dir *appendDir, data []byte, embedded bool, first uint32, subdirs uint16) []byte {
+	now := ua.uw.opts.RecordingTime
+	f := entryFields(dir.fe)
+	if f.ICBTag.AllocationType != Embedded {
+		ua.udf.walkAllocationDescriptors(dir.fe, dir.fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+			if partition != ua.virtual || desc.IsNotRecorded() {
+				return
+			}
+			length := uint64(ExtentLength(desc))
+			if aed {
+				length = ua.udf.SECTOR_SIZE
+			}
+			for block := desc.GetLocation(); block < desc.GetLocation()+(length+ua.udf.SECTOR_SIZE-1)/ua.udf.SECTOR_SIZE; block++ {
+				ua.vat.Entries[block] = VAT_ENTRY_UNUSED
+			}
+		})
+	}
+	if embedded {
+		f.ICBTag.AllocationType = Embedded
+		f.AllocationDescriptors = data
+		f.LogicalBlocksRecorded = 0
+	} else {
+		f.ICBTag.AllocationType = LongDescriptors
+		f.AllocationDescriptors, _ = ExtentLong{uint32(len(data)), LbAddr{first, ua.virtual}}.MarshalBinary()
+		f.LogicalBlocksRecorded = (uint64(len(data)) + ua.udf.SECTOR_SIZE - 1) / ua.udf.SECTOR_SIZE
+	}
+	f.LengthOfAllocationDescriptors = uint32(len(f.AllocationDescriptors))
+	if efe, ok := dir.fe.(*ExtendedFileEntry); ok {
+		efe.ObjectSize = efe.ObjectSize - f.InformationLength + uint64(len(data))
+	}
+	f.InformationLength = uint64(len(data))
+	f.FileLinkCount += subdirs
+	if len(dir.node.children) > 0 {
+		f.ModificationTime = now
+	}
+	f.AttributeTime = now
+	if hdr := dir.hdr; hdr != nil {
+		applyMode(f, hdr.Mode)
+		f.Uid, f.Gid = hdr.Uid, hdr.Gid
+		if !hdr.ModTime.IsZero() {
+			f.ModificationTime = hdr.ModTime
+		}
+		if !hdr.AccessTime.IsZero() {
+			f.AccessTime = hdr.AccessTime
+		}
+		if !hdr.ChangeTime.IsZero() {
+			f.AttributeTime = hdr.ChangeTime
+		}
+	}
+	return marshalFileEntry(dir.fe)
+}
@@ -0,0 +1,73 @@
+package udf
+
+import (
+	"testing"
+)
+
+func TestAppenderGenerations(t *testing.T) {
+	img := writeTestImage(t, WriterOptions{Revision: UDF_REVISION_201, WriteOnce: true})
+	sessions := []map[string]string{
+		{"one.txt": "first session", "dir/small.txt": "changed once"},
+		{"two.txt": "second session"},
+		{"dir/small.txt": "changed twice", "new/dir/three.txt": "third session"},
+	}
+	for i, files := range sessions {
+		ua, err := NewAppender(img, img)
+		if err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+		for name, contents := range files {
+			if err := ua.WriteHeader(&Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+				t.Fatalf("session %d: %s: %v", i+1, name, err)
+			}
+			if _, err := ua.Write([]byte(contents)); err != nil {
+				t.Fatalf("session %d: %s: %v", i+1, name, err)
+			}
+		}
+		if err := ua.Close(); err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+	}
+
+	u := checkVolume(t, img)
+	generations := u.Generations()
+	if len(generations) != len(sessions)+1 {
+		t.Fatalf("found %d generations, want %d", len(generations), len(sessions)+1)
+	}
+	// Each generation reads the files of its session over the earlier ones
+	want := map[string]string{"dir/small.txt": "hello"}
+	for i, g := range generations {
+		if i > 0 {
+			for name, contents := range sessions[i-1] {
+				want[name] = contents
+			}
+		}
+		if g.Current != (i == len(sessions)) {
+			t.Errorf("generation %d is current: %v", i, g.Current)
+		}
+		gen, err := u.OpenGeneration(g)
+		if err != nil {
+			t.Fatalf("generation %d: %v", i, err)
+		}
+		for _, problem := range gen.Fsck() {
+			t.Errorf("generation %d: fsck: %s %s: %s", i, problem.Check, problem.Path, problem.Message)
+		}
+		for name, contents := range want {
+			if s := readTestFile(t, gen, name); s != contents {
+				t.Errorf("generation %d: %s reads %q, want %q", i, name, s, contents)
+			}
+		}
+		for _, session := range sessions[i:] {
+			for name := range session {
+				if _, ok := want[name]; !ok {
+					if _, ok := findFile(gen, name); ok {
+						t.Errorf("generation %d: %s is recorded by a later session", i, name)
+					}
+				}
+			}
+		}
+		if s := readTestFile(t, gen, "big.bin"); s != string(testData) {
+			t.Errorf("generation %d: big.bin reads %d bytes", i, len(s))
+		}
+	}
+}
@@ -60,11 +60,33 @@ func rb_i16(b []byte) int16 {
 	return int16(rb_u16(b))
 }
 
+// crc_itu computes the CRC-ITU-T (CCITT) checksum used by descriptor tags
+func crc_itu(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// r_dstring decodes a fixed-length dstring field, whose last byte records
+// the length of the compressed d-characters it holds
 func r_dstring(b []byte, fieldlen int) string {
 	if fieldlen == 0 {
 		return ""
 	}
-	return string(b[:b[fieldlen-1]])
+	length := int(b[fieldlen-1])
+	if length > fieldlen-1 {
+		length = fieldlen - 1
+	}
+	return r_dcharacters(b[:length])
 }
 
 func r_dcharacters(b []byte) string {
@@ -89,11 +111,95 @@ func r_dcharacters(b []byte) string {
 	}
 }
 
+// r_timestamp decodes an ECMA-167 timestamp (1/7.3); times without a
+// timezone are returned in UTC
 func r_timestamp(b []byte) time.Time {
-	var t time.Time
-	t = t.AddDate(int(rl_u16(b[2:])), int(b[4]), int(b[5]))
-	t.Add(time.Duration(b[6])*time.Hour +
-		time.Duration(b[7])*time.Minute +
-		time.Duration(b[8])*time.Second)
-	return t
+	year := int(rl_i16(b[2:]))
+	if year == 0 && b[4] == 0 && b[5] == 0 {
+		return time.Time{}
+	}
+	loc := time.UTC
+	typeAndTimezone := rl_u16(b[0:])
+	if typeAndTimezone>>12 == 1 {
+		// Sign-extend the 12-bit offset in minutes; -2047 means unspecified
+		if tz := int(int16(typeAndTimezone<<4) >> 4); tz != -2047 {
+			loc = time.FixedZone("", tz*60)
+		}
+	}
+	nsec := (int(b[9])*10000 + int(b[10])*100 + int(b[11])) * 1000
+	return time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), nsec, loc)
+}
+
+var wl_u64 = binary.LittleEndian.PutUint64
+var wl_u32 = binary.LittleEndian.PutUint32
+var wl_u16 = binary.LittleEndian.PutUint16
+
+func wl_u48(b []byte, v uint64) {
+	var buf [8]byte
+	wl_u64(buf[:], v)
+	copy(b[:6], buf[:6])
+}
+
+// w_dcharacters encodes d-characters with the narrowest compression that
+// holds them: 8 for Windows-1252, 16 for UTF-16
+func w_dcharacters(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	if b, _, err := transform.Bytes(charmap.Windows1252.NewEncoder(), []byte(s)); err == nil {
+		return append([]byte{8}, b...)
+	}
+	b, _, err := transform.Bytes(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewEncoder(), []byte(s))
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{16}, b...)
+}
+
+// w_dstring encodes a fixed-length dstring field, truncating s to fit. A
+// field already holding s is left as recorded.
+func w_dstring(b []byte, s string, fieldlen int) {
+	if r_dstring(b, fieldlen) == s {
+		return
+	}
+	for i := 0; i < fieldlen; i++ {
+		b[i] = 0
+	}
+	chars := w_dcharacters(s)
+	if len(chars) > fieldlen-1 {
+		chars = chars[:fieldlen-1]
+		if chars[0] == 16 && len(chars)%2 == 0 {
+			chars = chars[:len(chars)-1]
+		}
+	}
+	copy(b, chars)
+	b[fieldlen-1] = uint8(len(chars))
+}
+
+// w_timestamp encodes an ECMA-167 timestamp in the time's own zone. A field
+// already holding the same time in the same zone is left as recorded.
+func w_timestamp(b []byte, t time.Time) {
+	recorded := r_timestamp(b)
+	_, recordedOffset := recorded.Zone()
+	_, offset := t.Zone()
+	if recorded.Equal(t) && recordedOffset == offset {
+		return
+	}
+	for i := 0; i < 12; i++ {
+		b[i] = 0
+	}
+	if t.IsZero() {
+		return
+	}
+	wl_u16(b[0:], 1<<12|uint16(offset/60)&0xFFF)
+	wl_u16(b[2:], uint16(t.Year()))
+	b[4] = uint8(t.Month())
+	b[5] = uint8(t.Day())
+	b[6] = uint8(t.Hour())
+	b[7] = uint8(t.Minute())
+	b[8] = uint8(t.Second())
+	usec := t.Nanosecond() / 1000
+	b[9] = uint8(usec / 10000)
+	b[10] = uint8(usec / 100 % 100)
+	b[11] = uint8(usec % 100)
 }
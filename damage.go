@@ -0,0 +1,254 @@
+package udf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrDamagedFileEntry is returned by reads of a file whose file entry is
+// recorded in a bad range of a damaged image
+var ErrDamagedFileEntry = errors.New("udf: damaged file entry")
+
+// ByteRange is a range of bytes of an image or of a file
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// DamageFunc returns the parts of the given byte range of an image that
+// could not be recovered
+type DamageFunc func(offset int64, length int64) []ByteRange
+
+// RangeDamage returns a DamageFunc telling the given ranges are bad
+func RangeDamage(bad []ByteRange) DamageFunc {
+	bad = mergeRanges(bad)
+	return func(offset int64, length int64) (parts []ByteRange) {
+		i := sort.Search(len(bad), func(i int) bool { return bad[i].Offset+bad[i].Length > offset })
+		for ; i < len(bad) && bad[i].Offset < offset+length; i++ {
+			if part, ok := intersectRange(bad[i], ByteRange{offset, length}); ok {
+				parts = append(parts, part)
+			}
+		}
+		return
+	}
+}
+
+// ReadDdrescueMapfile reads a GNU ddrescue mapfile, returning the ranges
+// not recovered yet (any status but '+') and the size of the rescue domain
+func ReadDdrescueMapfile(r io.Reader) (bad []ByteRange, size int64, err error) {
+	scanner := bufio.NewScanner(r)
+	statusLine := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// The first line is the current position and status of ddrescue
+		if statusLine {
+			statusLine = false
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, 0, fmt.Errorf("udf: bad mapfile line: %s", line)
+		}
+		pos, err := strconv.ParseInt(fields[0], 0, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("udf: bad mapfile line: %s", line)
+		}
+		length, err := strconv.ParseInt(fields[1], 0, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("udf: bad mapfile line: %s", line)
+		}
+		if fields[2] != "+" {
+			bad = append(bad, ByteRange{pos, length})
+		}
+		if pos+length > size {
+			size = pos + length
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return mergeRanges(bad), size, nil
+}
+
+func intersectRange(a ByteRange, b ByteRange) (ByteRange, bool) {
+	start, end := a.Offset, a.Offset+a.Length
+	if b.Offset > start {
+		start = b.Offset
+	}
+	if b.Offset+b.Length < end {
+		end = b.Offset + b.Length
+	}
+	return ByteRange{start, end - start}, end > start
+}
+
+// mergeRanges sorts ranges and merges those overlapping or adjacent
+func mergeRanges(ranges []ByteRange) (merged []ByteRange) {
+	sorted := append([]ByteRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for _, r := range sorted {
+		if r.Length <= 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && merged[n-1].Offset+merged[n-1].Length >= r.Offset {
+			if end := r.Offset + r.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return
+}
+
+// damagedReader reads a damaged image, returning zeros in place of the bad
+// ranges and of what cannot be read, which it remembers
+type damagedReader struct {
+	r      io.ReaderAt
+	size   int64
+	damage DamageFunc
+	mutex  sync.Mutex
+	failed []ByteRange
+}
+
+func (dr *damagedReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := dr.r.ReadAt(p, off)
+	if n < len(p) {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		if (err != nil && err != io.EOF) || off+int64(n) < dr.size {
+			dr.mutex.Lock()
+			dr.failed = append(dr.failed, ByteRange{off + int64(n), int64(len(p) - n)})
+			dr.mutex.Unlock()
+		}
+	}
+	// A DamageFunc may return whole bad ranges rather than their parts
+	// within the read
+	for _, bad := range dr.damage(off, int64(len(p))) {
+		part, ok := intersectRange(bad, ByteRange{off, int64(len(p))})
+		if !ok {
+			continue
+		}
+		for i := part.Offset - off; i < part.Offset-off+part.Length; i++ {
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func (dr *damagedReader) Size() int64 {
+	return dr.size
+}
+
+// badRanges returns the bad ranges of the image and those that could not
+// be read so far
+func (dr *damagedReader) badRanges() []ByteRange {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	return mergeRanges(append(dr.damage(0, dr.size), dr.failed...))
+}
+
+// NewUdfFromDamagedReader returns an Udf reader reading from a damaged
+// image, whose bad ranges are told by damage. Reads of bad ranges, or past
+// the end of a truncated image, return zeros instead of failing, and
+// DamageReport tells which files they affect.
+func NewUdfFromDamagedReader(r io.ReaderAt, damage DamageFunc) (*Udf, error) {
+	return newDamagedUdf(r, damage, readerSize(r))
+}
+
+// NewUdfFromDdrescueMap returns an Udf reader reading from a partially
+// recovered image, along with the GNU ddrescue mapfile of its recovery
+func NewUdfFromDdrescueMap(r io.ReaderAt, mapfile io.Reader) (*Udf, error) {
+	bad, size, err := ReadDdrescueMapfile(mapfile)
+	if err != nil {
+		return nil, err
+	}
+	if imageSize := readerSize(r); imageSize > size {
+		size = imageSize
+	}
+	return newDamagedUdf(r, RangeDamage(bad), size)
+}
+
+func newDamagedUdf(r io.ReaderAt, damage DamageFunc, size int64) (udf *Udf, err error) {
+	dr := &damagedReader{r: r, size: size, damage: damage}
+	udf = &Udf{
+		r:      dr,
+		pd:     make(map[uint16]*PartitionDescriptor),
+		damage: dr,
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			udf, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	if err = udf.init(); err != nil {
+		return nil, err
+	}
+	return udf, nil
+}
+
+// FileDamage tells how a file, or the volume structures if Path is empty,
+// is affected by the bad ranges of a damaged image
+type FileDamage struct {
+	Path string
+	// Kinds lists the damaged structures, as SECTOR_* constants
+	Kinds []string
+	// Ranges are the damaged byte ranges of the file data. The data of a
+	// file whose file entry or allocation extent descriptors are damaged
+	// may be lost altogether.
+	Ranges []ByteRange
+}
+
+// DamageReport lists the files and structures recorded in the bad ranges
+// of an image opened by NewUdfFromDamagedReader or NewUdfFromDdrescueMap.
+// Files below a damaged directory cannot be found, and are not listed.
+func (udf *Udf) DamageReport() (report []FileDamage) {
+	if udf.damage == nil {
+		return nil
+	}
+	udf.init()
+	index := udf.sectorOwners()
+	byPath := make(map[string]int)
+	for _, bad := range udf.damage.badRanges() {
+		start := uint64(bad.Offset) / udf.SECTOR_SIZE
+		end := (uint64(bad.Offset+bad.Length) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+		for _, owner := range index.overlapping(start, end) {
+			i, ok := byPath[owner.Path]
+			if !ok {
+				i = len(report)
+				byPath[owner.Path] = i
+				report = append(report, FileDamage{Path: owner.Path})
+			}
+			damage := &report[i]
+			found := false
+			for _, kind := range damage.Kinds {
+				found = found || kind == owner.Kind
+			}
+			if !found {
+				damage.Kinds = append(damage.Kinds, owner.Kind)
+			}
+			if owner.Kind != SECTOR_FILE_DATA && owner.Kind != SECTOR_DIRECTORY_DATA {
+				continue
+			}
+			ownerStart := int64(owner.Start * udf.SECTOR_SIZE)
+			recorded := ByteRange{ownerStart, int64((owner.End - owner.Start) * udf.SECTOR_SIZE)}
+			if part, ok := intersectRange(bad, recorded); ok {
+				damage.Ranges = append(damage.Ranges, ByteRange{owner.Offset + part.Offset - ownerStart, part.Length})
+			}
+		}
+	}
+	for i := range report {
+		report[i].Ranges = mergeRanges(report[i].Ranges)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Path < report[j].Path })
+	return
+}
@@ -1,6 +1,7 @@
 package udf
 
 import (
+	"encoding/binary"
 	"time"
 )
 
@@ -13,12 +14,17 @@ const (
 	DESCRIPTOR_LOGICAL_VOLUME            = 0x6
 	DESCRIPTOR_UNALLOCATED               = 0x7
 	DESCRIPTOR_TERMINATING               = 0x8
+	DESCRIPTOR_LOGICAL_VOLUME_INTEGRITY  = 0x9
 	DESCRIPTOR_FILE_SET                  = 0x100
 	DESCRIPTOR_IDENTIFIER                = 0x101
 	DESCRIPTOR_ALLOCATION_EXTENT         = 0x102
 	DESCRIPTOR_INDIRECT_ENTRY            = 0x103
 	DESCRIPTOR_TERMINAL_ENTRY            = 0x104
 	DESCRIPTOR_FILE_ENTRY                = 0x105
+	DESCRIPTOR_EXTENDED_ATTRIBUTE_HEADER = 0x106
+	DESCRIPTOR_UNALLOCATED_SPACE_ENTRY   = 0x107
+	DESCRIPTOR_SPACE_BITMAP              = 0x108
+	DESCRIPTOR_EXTENDED_FILE_ENTRY       = 0x10A
 	UDF_EXTENT_FLAG_MASK                 = 0xC0000000
 	EXT_NOT_RECORDED_ALLOCATED           = 0x40000000
 	EXT_NOT_RECORDED_NOT_ALLOCATED       = 0x80000000
@@ -50,6 +56,42 @@ func (d *Descriptor) Checksum() (checksum uint8) {
 	return
 }
 
+// CRC computes the CRC of the DescriptorCRCLength bytes following the tag
+func (d *Descriptor) CRC() uint16 {
+	return crc_itu(d.data[16 : 16+int(d.DescriptorCRCLength)])
+}
+
+// Valid returns true if both the tag checksum and the descriptor CRC match
+func (d *Descriptor) Valid() bool {
+	return d.TagChecksum == d.Checksum() && d.ValidCRC()
+}
+
+// ValidCRC returns true if the recorded descriptor CRC matches its contents
+func (d *Descriptor) ValidCRC() bool {
+	if 16+int(d.DescriptorCRCLength) > len(d.data) {
+		return false
+	}
+	return d.DescriptorCRC == d.CRC()
+}
+
+// setDescriptorTag recomputes the CRC and checksum of the tag at the start of
+// b, over the CRC length it records
+func setDescriptorTag(b []byte) {
+	crcLength := int(rl_u16(b[10:]))
+	if 16+crcLength > len(b) {
+		crcLength = len(b) - 16
+		binary.LittleEndian.PutUint16(b[10:], uint16(crcLength))
+	}
+	binary.LittleEndian.PutUint16(b[8:], crc_itu(b[16:16+crcLength]))
+	var checksum uint8
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			checksum += b[i]
+		}
+	}
+	b[4] = checksum
+}
+
 func (d *Descriptor) FromBytes(b []byte) *Descriptor {
 	d.TagIdentifier = rl_u16(b[0:])
 	d.DescriptorVersion = rl_u16(b[2:])
@@ -177,12 +219,128 @@ func (d *Descriptor) PartitionDescriptor() *PartitionDescriptor {
 	return NewPartitionDescriptor(d.data)
 }
 
+// PartitionHeaderDescriptor is recorded in the contents use field of
+// partitions holding a file system (ECMA-167 4/14.3)
+type PartitionHeaderDescriptor struct {
+	UnallocatedSpaceTable  Extent
+	UnallocatedSpaceBitmap Extent
+	PartitionIntegrity     Extent
+	FreedSpaceTable        Extent
+	FreedSpaceBitmap       Extent
+}
+
+func (phd *PartitionHeaderDescriptor) FromBytes(b []byte) *PartitionHeaderDescriptor {
+	phd.UnallocatedSpaceTable = NewExtent(b[0:])
+	phd.UnallocatedSpaceBitmap = NewExtent(b[8:])
+	phd.PartitionIntegrity = NewExtent(b[16:])
+	phd.FreedSpaceTable = NewExtent(b[24:])
+	phd.FreedSpaceBitmap = NewExtent(b[32:])
+	return phd
+}
+
+func NewPartitionHeaderDescriptor(b []byte) *PartitionHeaderDescriptor {
+	return new(PartitionHeaderDescriptor).FromBytes(b)
+}
+
+func (pd *PartitionDescriptor) PartitionHeaderDescriptor() *PartitionHeaderDescriptor {
+	return NewPartitionHeaderDescriptor(pd.PartitionContentsUse)
+}
+
+// SpaceBitmapDescriptor records one bit per block of a partition, set when
+// the block is available for allocation (ECMA-167 4/14.12)
+type SpaceBitmapDescriptor struct {
+	Descriptor    Descriptor
+	NumberOfBits  uint32
+	NumberOfBytes uint32
+	Bitmap        []byte
+}
+
+func (sbd *SpaceBitmapDescriptor) FromBytes(b []byte) *SpaceBitmapDescriptor {
+	sbd.Descriptor.FromBytes(b)
+	sbd.NumberOfBits = rl_u32(b[16:])
+	sbd.NumberOfBytes = rl_u32(b[20:])
+	end := 24 + uint64(sbd.NumberOfBytes)
+	if end > uint64(len(b)) {
+		end = uint64(len(b))
+	}
+	sbd.Bitmap = b[24:end]
+	return sbd
+}
+
+func NewSpaceBitmapDescriptor(b []byte) *SpaceBitmapDescriptor {
+	return new(SpaceBitmapDescriptor).FromBytes(b)
+}
+
+// IsFree returns true if the given partition block is available for allocation
+func (sbd *SpaceBitmapDescriptor) IsFree(block uint32) bool {
+	if block >= sbd.NumberOfBits || block/8 >= uint32(len(sbd.Bitmap)) {
+		return false
+	}
+	return sbd.Bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+// UnallocatedSpaceDescriptor lists the volume space recorded in no
+// partition (ECMA-167 3/10.8)
+type UnallocatedSpaceDescriptor struct {
+	Descriptor                     Descriptor
+	VolumeDescriptorSequenceNumber uint32
+	AllocationDescriptors          []Extent
+}
+
+func (usd *UnallocatedSpaceDescriptor) FromBytes(b []byte) *UnallocatedSpaceDescriptor {
+	usd.Descriptor.FromBytes(b)
+	usd.VolumeDescriptorSequenceNumber = rl_u32(b[16:])
+	count := uint64(rl_u32(b[20:]))
+	if count > uint64(len(b)-24)/8 {
+		count = uint64(len(b)-24) / 8
+	}
+	usd.AllocationDescriptors = make([]Extent, count)
+	for i := range usd.AllocationDescriptors {
+		usd.AllocationDescriptors[i] = NewExtent(b[24+8*i:])
+	}
+	return usd
+}
+
+func NewUnallocatedSpaceDescriptor(b []byte) *UnallocatedSpaceDescriptor {
+	return new(UnallocatedSpaceDescriptor).FromBytes(b)
+}
+
+func (d *Descriptor) UnallocatedSpaceDescriptor() *UnallocatedSpaceDescriptor {
+	return NewUnallocatedSpaceDescriptor(d.data)
+}
+
+// UnallocatedSpaceEntry lists the free extents of a partition recording its
+// free space in a table rather than a bitmap (ECMA-167 4/14.11)
+type UnallocatedSpaceEntry struct {
+	Descriptor            Descriptor
+	ICBTag                *ICBTag
+	AllocationDescriptors []ExtentInterface
+}
+
+func (use *UnallocatedSpaceEntry) FromBytes(b []byte) *UnallocatedSpaceEntry {
+	use.Descriptor.FromBytes(b)
+	use.ICBTag = NewICBTag(b[16:])
+	length := rl_u32(b[36:])
+	if uint64(length) > uint64(len(b)-40) {
+		length = uint32(len(b) - 40)
+	}
+	use.AllocationDescriptors = GetAllocationDescriptors(use.ICBTag.AllocationType, b[40:], length)
+	return use
+}
+
+func NewUnallocatedSpaceEntry(b []byte) *UnallocatedSpaceEntry {
+	return new(UnallocatedSpaceEntry).FromBytes(b)
+}
+
 type PartitionMap struct {
 	PartitionMapType     uint8
 	PartitionMapLength   uint8
 	VolumeSequenceNumber uint16
 	PartitionNumber      uint16
 	PartitionStart       uint32
+	// PartitionTypeIdentifier identifies the kind of a type 2 map
+	PartitionTypeIdentifier EntityID
+	data                    []byte
 }
 
 func (pm *PartitionMap) FromBytes(b []byte) *PartitionMap {
@@ -194,15 +352,32 @@ func (pm *PartitionMap) FromBytes(b []byte) *PartitionMap {
 		offset = 2
 	case 2:
 		offset = 36
+		pm.PartitionTypeIdentifier = NewEntityID(b[4:])
 	}
-	pm.VolumeSequenceNumber = rb_u16(b[offset:])
+	pm.VolumeSequenceNumber = rl_u16(b[offset:])
 	// XXX - For whatever reason, the Microsoft ISOs have a little endian partition
 	// number here???
 	pm.PartitionNumber = rl_u16(b[offset+2:])
 	pm.PartitionStart = uint32(pm.VolumeSequenceNumber)
+	pm.data = b[:pm.PartitionMapLength]
 	return pm
 }
 
+// metadataFileLocations returns the blocks recording the file entries of the
+// metadata file, its mirror and its bitmap, for a metadata partition map
+// (UDF 2.2.10)
+func (pm *PartitionMap) metadataFileLocations() (locations []uint32) {
+	if len(pm.data) < 52 {
+		return []uint32{0}
+	}
+	for _, off := range []int{40, 44, 48} {
+		if location := rl_u32(pm.data[off:]); location != 0xFFFFFFFF && (off == 40 || location != rl_u32(pm.data[40:])) {
+			locations = append(locations, location)
+		}
+	}
+	return
+}
+
 type LogicalVolumeDescriptor struct {
 	Descriptor                     Descriptor
 	VolumeDescriptorSequenceNumber uint32
@@ -231,8 +406,15 @@ func (lvd *LogicalVolumeDescriptor) FromBytes(b []byte) *LogicalVolumeDescriptor
 	lvd.ImplementationUse = b[304:432]
 	lvd.IntegritySequenceExtent = NewExtent(b[432:])
 	lvd.PartitionMaps = make([]PartitionMap, lvd.NumberOfPartitionMaps)
-	for i := uint32(0); i < lvd.NumberOfPartitionMaps; i++ {
-		lvd.PartitionMaps[i].FromBytes(b[440+i*6:])
+	// Maps have different lengths, each records its own
+	offset := 440
+	for i := uint32(0); i < lvd.NumberOfPartitionMaps && offset+2 <= len(b); i++ {
+		length := int(b[offset+1])
+		if length < 6 || (b[offset] == 2 && length < 40) || offset+length > len(b) {
+			break
+		}
+		lvd.PartitionMaps[i].FromBytes(b[offset:])
+		offset += length
 	}
 	return lvd
 }
@@ -245,22 +427,121 @@ func (d *Descriptor) LogicalVolumeDescriptor() *LogicalVolumeDescriptor {
 	return NewLogicalVolumeDescriptor(d.data)
 }
 
+type ImplementationUseVolumeDescriptor struct {
+	Descriptor                     Descriptor
+	VolumeDescriptorSequenceNumber uint32
+	ImplementationIdentifier       EntityID
+	LogicalVolumeIdentifier        string
+	LVInfo1                        string
+	LVInfo2                        string
+	LVInfo3                        string
+	LVInfoImplementationIdentifier EntityID
+	ImplementationUse              []byte
+}
+
+func (iuvd *ImplementationUseVolumeDescriptor) FromBytes(b []byte) *ImplementationUseVolumeDescriptor {
+	iuvd.Descriptor.FromBytes(b)
+	iuvd.VolumeDescriptorSequenceNumber = rl_u32(b[16:])
+	iuvd.ImplementationIdentifier = NewEntityID(b[20:])
+	// UDF 2.2.7.2 LVInformation, recorded in the implementation use area
+	iuvd.LogicalVolumeIdentifier = r_dstring(b[116:], 128)
+	iuvd.LVInfo1 = r_dstring(b[244:], 36)
+	iuvd.LVInfo2 = r_dstring(b[280:], 36)
+	iuvd.LVInfo3 = r_dstring(b[316:], 36)
+	iuvd.LVInfoImplementationIdentifier = NewEntityID(b[352:])
+	iuvd.ImplementationUse = b[384:512]
+	return iuvd
+}
+
+func NewImplementationUseVolumeDescriptor(b []byte) *ImplementationUseVolumeDescriptor {
+	return new(ImplementationUseVolumeDescriptor).FromBytes(b)
+}
+
+func (d *Descriptor) ImplementationUseVolumeDescriptor() *ImplementationUseVolumeDescriptor {
+	return NewImplementationUseVolumeDescriptor(d.data)
+}
+
+// Integrity types of the Logical Volume Integrity Descriptor
+const (
+	INTEGRITY_TYPE_OPEN  = 0
+	INTEGRITY_TYPE_CLOSE = 1
+)
+
+type LogicalVolumeIntegrityDescriptor struct {
+	Descriptor                Descriptor
+	RecordingDateTime         time.Time
+	IntegrityType             uint32
+	NextIntegrityExtent       Extent
+	UniqueID                  uint64
+	NumberOfPartitions        uint32
+	LengthOfImplementationUse uint32
+	FreeSpaceTable            []uint32
+	SizeTable                 []uint32
+	ImplementationIdentifier  EntityID
+	NumberOfFiles             uint32
+	NumberOfDirectories       uint32
+	MinimumUDFReadRevision    uint16
+	MinimumUDFWriteRevision   uint16
+	MaximumUDFWriteRevision   uint16
+	ImplementationUse         []byte
+}
+
+func (lvid *LogicalVolumeIntegrityDescriptor) FromBytes(b []byte) *LogicalVolumeIntegrityDescriptor {
+	lvid.Descriptor.FromBytes(b)
+	lvid.RecordingDateTime = r_timestamp(b[16:])
+	lvid.IntegrityType = rl_u32(b[28:])
+	lvid.NextIntegrityExtent = NewExtent(b[32:])
+	lvid.UniqueID = rl_u64(b[40:])
+	lvid.NumberOfPartitions = rl_u32(b[72:])
+	// Both tables must fit in the descriptor
+	if limit := (len(b) - 80) / 8; uint64(lvid.NumberOfPartitions) > uint64(limit) {
+		lvid.NumberOfPartitions = uint32(limit)
+	}
+	lvid.LengthOfImplementationUse = rl_u32(b[76:])
+	lvid.FreeSpaceTable = make([]uint32, lvid.NumberOfPartitions)
+	lvid.SizeTable = make([]uint32, lvid.NumberOfPartitions)
+	for i := uint32(0); i < lvid.NumberOfPartitions; i++ {
+		lvid.FreeSpaceTable[i] = rl_u32(b[80+4*i:])
+		lvid.SizeTable[i] = rl_u32(b[80+4*(lvid.NumberOfPartitions+i):])
+	}
+	implUse := b[80+8*lvid.NumberOfPartitions:]
+	if lvid.LengthOfImplementationUse >= 46 && lvid.LengthOfImplementationUse <= uint32(len(implUse)) {
+		lvid.ImplementationIdentifier = NewEntityID(implUse[0:])
+		lvid.NumberOfFiles = rl_u32(implUse[32:])
+		lvid.NumberOfDirectories = rl_u32(implUse[36:])
+		lvid.MinimumUDFReadRevision = rl_u16(implUse[40:])
+		lvid.MinimumUDFWriteRevision = rl_u16(implUse[42:])
+		lvid.MaximumUDFWriteRevision = rl_u16(implUse[44:])
+		lvid.ImplementationUse = implUse[46:lvid.LengthOfImplementationUse]
+	}
+	return lvid
+}
+
+func NewLogicalVolumeIntegrityDescriptor(b []byte) *LogicalVolumeIntegrityDescriptor {
+	return new(LogicalVolumeIntegrityDescriptor).FromBytes(b)
+}
+
+func (d *Descriptor) LogicalVolumeIntegrityDescriptor() *LogicalVolumeIntegrityDescriptor {
+	return NewLogicalVolumeIntegrityDescriptor(d.data)
+}
+
 type FileSetDescriptor struct {
-	Descriptor              Descriptor
-	RecordingDateTime       time.Time
-	InterchangeLevel        uint16
-	MaximumInterchangeLevel uint16
-	CharacterSetList        uint32
-	MaximumCharacterSetList uint32
-	FileSetNumber           uint32
-	FileSetDescriptorNumber uint32
-	LogicalVolumeIdentifier string
-	FileSetIdentifier       string
-	CopyrightFileIdentifier string
-	AbstractFileIdentifier  string
-	RootDirectoryICB        ExtentLong
-	DomainIdentifier        EntityID
-	NexExtent               ExtentLong
+	Descriptor               Descriptor
+	RecordingDateTime        time.Time
+	InterchangeLevel         uint16
+	MaximumInterchangeLevel  uint16
+	CharacterSetList         uint32
+	MaximumCharacterSetList  uint32
+	FileSetNumber            uint32
+	FileSetDescriptorNumber  uint32
+	LogicalVolumeIdentifier  string
+	FileSetIdentifier        string
+	CopyrightFileIdentifier  string
+	AbstractFileIdentifier   string
+	RootDirectoryICB         ExtentLong
+	DomainIdentifier         EntityID
+	NexExtent                ExtentLong
+	SystemStreamDirectoryICB ExtentLong
 }
 
 func (fsd *FileSetDescriptor) FromBytes(b []byte) *FileSetDescriptor {
@@ -279,6 +560,7 @@ func (fsd *FileSetDescriptor) FromBytes(b []byte) *FileSetDescriptor {
 	fsd.RootDirectoryICB = NewExtentLong(b[400:])
 	fsd.DomainIdentifier = NewEntityID(b[416:])
 	fsd.NexExtent = NewExtentLong(b[448:])
+	fsd.SystemStreamDirectoryICB = NewExtentLong(b[464:])
 	return fsd
 }
 
@@ -290,6 +572,15 @@ func (d *Descriptor) FileSetDescriptor() *FileSetDescriptor {
 	return NewFileSetDescriptor(d.data)
 }
 
+// File characteristics of the File Identifier Descriptor (ECMA-167 4/14.4.3)
+const (
+	FILE_CHARACTERISTIC_HIDDEN    = 1 << 0
+	FILE_CHARACTERISTIC_DIRECTORY = 1 << 1
+	FILE_CHARACTERISTIC_DELETED   = 1 << 2
+	FILE_CHARACTERISTIC_PARENT    = 1 << 3
+	FILE_CHARACTERISTIC_METADATA  = 1 << 4
+)
+
 type FileIdentifierDescriptor struct {
 	Descriptor                Descriptor
 	FileVersionNumber         uint16
@@ -313,9 +604,11 @@ func (fid *FileIdentifierDescriptor) FromBytes(b []byte) *FileIdentifierDescript
 	fid.LengthOfFileIdentifier = r_u8(b[19:])
 	fid.ICB = NewExtentLong(b[20:])
 	fid.LengthOfImplementationUse = rl_u16(b[36:])
-	fid.ImplementationUse = NewEntityID(b[38:])
-	identStart := 38 + fid.LengthOfImplementationUse
-	fid.FileIdentifier = r_dcharacters(b[identStart : fid.LengthOfFileIdentifier+uint8(identStart)])
+	if fid.LengthOfImplementationUse >= 32 {
+		fid.ImplementationUse = NewEntityID(b[38:])
+	}
+	identStart := 38 + int(fid.LengthOfImplementationUse)
+	fid.FileIdentifier = r_dcharacters(b[identStart : identStart+int(fid.LengthOfFileIdentifier)])
 	return fid
 }
 
@@ -333,6 +626,15 @@ type FileEntryInterface interface {
 	GetInformationLength() uint64
 	GetModificationTime() time.Time
 	GetICBTag() *ICBTag
+	GetExtendedAttributes() []byte
+	GetExtendedAttributeICB() ExtentLong
+	GetEmbeddedData() []byte
+	GetStreamDirectoryICB() ExtentLong
+	GetImplementationIdentifier() EntityID
+	GetDescriptor() *Descriptor
+	GetFileLinkCount() uint16
+	GetUniqueID() uint64
+	GetLogicalBlocksRecorded() uint64
 	GetPartition() uint16
 }
 
@@ -391,18 +693,24 @@ func (fe *FileEntry) FromBytes(b []byte) *FileEntry {
 	fe.UniqueId = rl_u64(b[160:])
 	fe.LengthOfExtendedAttributes = rl_u32(b[168:])
 	fe.LengthOfAllocationDescriptors = rl_u32(b[172:])
-	allocDescStart := 176 + fe.LengthOfExtendedAttributes
-	if allocDescStart > uint32(len(b)) {
+	// Reused blocks may record any length, which must not wrap around
+	allocDescStart := 176 + uint64(fe.LengthOfExtendedAttributes)
+	if allocDescStart > uint64(len(b)) {
 		return nil
 	}
 	fe.ExtendedAttributes = b[176:allocDescStart]
-	fe.AllocationDescriptors = b[allocDescStart : allocDescStart+fe.LengthOfAllocationDescriptors]
+	allocDescEnd := allocDescStart + uint64(fe.LengthOfAllocationDescriptors)
+	if allocDescEnd > uint64(len(b)) {
+		// Damaged or deleted entry, keep what the block holds
+		allocDescEnd = uint64(len(b))
+	}
+	fe.AllocationDescriptors = b[allocDescStart:allocDescEnd]
 	return fe
 }
 
 func (fe *FileEntry) GetPartition() uint16 {
-	if fe.ICBTag.AllocationType == LongDescriptors {
-		return fe.GetAllocationDescriptors()[0].GetPartition()
+	if ads := fe.GetAllocationDescriptors(); fe.ICBTag.AllocationType == LongDescriptors && len(ads) > 0 {
+		return ads[0].GetPartition()
 	}
 	return fe.Partition
 }
@@ -431,6 +739,10 @@ func GetAllocationDescriptors(t AllocationType, b []byte, len uint32) (list []Ex
 	default:
 		return
 	}
+	if len > uint32(cap(b)) {
+		// Damaged entries record more than their block holds
+		len = uint32(cap(b))
+	}
 	list = make([]ExtentInterface, len/descLen)
 	for i := range list {
 		list[i] = GetAllocationDescriptor(t, b[uint32(i)*descLen:])
@@ -459,16 +771,68 @@ func (fe *FileEntry) GetICBTag() *ICBTag {
 	return fe.ICBTag
 }
 
-func NewFileEntry(partition uint16, b []byte) (fe FileEntryInterface) {
-	if e := new(FileEntry).FromBytes(b); e == nil {
-		ee := new(ExtendedFileEntry).FromBytes(b)
-		ee.Partition = partition
-		fe = ee
-	} else {
-		e.Partition = partition
-		fe = e
+func (fe *FileEntry) GetExtendedAttributes() []byte {
+	return fe.ExtendedAttributes
+}
+
+func (fe *FileEntry) GetFileLinkCount() uint16 {
+	return fe.FileLinkCount
+}
+
+func (fe *FileEntry) GetUniqueID() uint64 {
+	return fe.UniqueId
+}
+
+func (fe *FileEntry) GetLogicalBlocksRecorded() uint64 {
+	return fe.LogicalBlocksRecorded
+}
+
+func (fe *FileEntry) GetDescriptor() *Descriptor {
+	return &fe.Descriptor
+}
+
+func (fe *FileEntry) GetImplementationIdentifier() EntityID {
+	return fe.ImplementationIdentifier
+}
+
+func (fe *FileEntry) GetExtendedAttributeICB() ExtentLong {
+	return fe.ExtendedAttributeICB
+}
+
+// GetStreamDirectoryICB returns an empty extent, as only extended file entries
+// have a stream directory
+func (fe *FileEntry) GetStreamDirectoryICB() ExtentLong {
+	return ExtentLong{}
+}
+
+// GetEmbeddedData returns the file data recorded in place of the allocation
+// descriptors, if the entry uses embedded allocation
+func (fe *FileEntry) GetEmbeddedData() []byte {
+	if fe.ICBTag.AllocationType != Embedded {
+		return nil
 	}
-	return
+	return fe.AllocationDescriptors
+}
+
+// NewFileEntry decodes a file entry or an extended file entry. A block
+// whose extended attributes overrun it, such as a reused one, decodes with
+// its fixed fields only.
+func NewFileEntry(partition uint16, b []byte) FileEntryInterface {
+	ee := new(ExtendedFileEntry)
+	ee.Partition = partition
+	if rl_u16(b[0:]) == DESCRIPTOR_EXTENDED_FILE_ENTRY {
+		ee.FromBytes(b)
+		return ee
+	}
+	e := new(FileEntry)
+	e.Partition = partition
+	if e.FromBytes(b) != nil {
+		return e
+	}
+	if ee.FromBytes(b) != nil {
+		return ee
+	}
+	return e
 }
 
 func (fe *ExtendedFileEntry) FromBytes(b []byte) *ExtendedFileEntry {
@@ -495,15 +859,25 @@ func (fe *ExtendedFileEntry) FromBytes(b []byte) *ExtendedFileEntry {
 	fe.UniqueId = rl_u64(b[200:])
 	fe.LengthOfExtendedAttributes = rl_u32(b[208:])
 	fe.LengthOfAllocationDescriptors = rl_u32(b[212:])
-	allocDescStart := 216 + fe.LengthOfExtendedAttributes
-	if allocDescStart > uint32(len(b)) {
+	// Reused blocks may record any length, which must not wrap around
+	allocDescStart := 216 + uint64(fe.LengthOfExtendedAttributes)
+	if allocDescStart > uint64(len(b)) {
 		return nil
 	}
 	fe.ExtendedAttributes = b[216:allocDescStart]
-	fe.AllocationDescriptors = b[allocDescStart : allocDescStart+fe.LengthOfAllocationDescriptors]
+	allocDescEnd := allocDescStart + uint64(fe.LengthOfAllocationDescriptors)
+	if allocDescEnd > uint64(len(b)) {
+		// Damaged or deleted entry, keep what the block holds
+		allocDescEnd = uint64(len(b))
+	}
+	fe.AllocationDescriptors = b[allocDescStart:allocDescEnd]
 	return fe
 }
 
+func (fe *ExtendedFileEntry) GetStreamDirectoryICB() ExtentLong {
+	return fe.StreamDirectoryIcb
+}
+
 func (d *Descriptor) FileEntry() FileEntryInterface {
 	return NewFileEntry(0, d.data)
 }
@@ -0,0 +1,60 @@
+package udf
+
+import (
+	"fmt"
+	"io"
+)
+
+// UsedExtents returns the byte ranges of the image recording the volume:
+// its recognition sequence, anchors, volume descriptor and integrity
+// sequences, file sets, space bitmaps, metadata files, file entries and
+// directories, and the file data if withData is set. Imaging a failing disc
+// over these ranges first saves the structures needed to find the files.
+func (udf *Udf) UsedExtents(withData bool) []ByteRange {
+	udf.init()
+	var used []ByteRange
+	for _, owner := range udf.sectorOwners().owners {
+		if owner.Kind == SECTOR_FILE_DATA && !withData {
+			continue
+		}
+		used = append(used, ByteRange{int64(owner.Start * udf.SECTOR_SIZE), int64((owner.End - owner.Start) * udf.SECTOR_SIZE)})
+	}
+	return mergeRanges(used)
+}
+
+// WriteDdrescueMapfile writes a GNU ddrescue mapfile marking the given
+// ranges of an image of the given size as finished, and the rest as not
+// tried, for use as the domain mapfile of ddrescue
+func WriteDdrescueMapfile(w io.Writer, used []ByteRange, size int64) error {
+	used = mergeRanges(used)
+	if n := len(used); n > 0 && used[n-1].Offset+used[n-1].Length > size {
+		size = used[n-1].Offset + used[n-1].Length
+	}
+	if _, err := fmt.Fprintf(w, "# Rescue domain of the UDF volume\n# current_pos  current_status  current_pass\n0x%08X     ?               1\n#      pos        size  status\n", 0); err != nil {
+		return err
+	}
+	line := func(pos int64, length int64, status string) error {
+		if length <= 0 {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "0x%08X  0x%08X  %s\n", pos, length, status)
+		return err
+	}
+	var pos int64
+	for _, r := range used {
+		if err := line(pos, r.Offset-pos, "?"); err != nil {
+			return err
+		}
+		if err := line(r.Offset, r.Length, "+"); err != nil {
+			return err
+		}
+		pos = r.Offset + r.Length
+	}
+	return line(pos, size-pos, "?")
+}
+
+// WriteDdrescueDomain writes the GNU ddrescue domain mapfile of the ranges
+// of the image recording the volume, as returned by UsedExtents
+func (udf *Udf) WriteDdrescueDomain(w io.Writer, withData bool) error {
+	return WriteDdrescueMapfile(w, udf.UsedExtents(withData), readerSize(udf.r))
+}
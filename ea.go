@@ -0,0 +1,344 @@
+package udf
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Extended attribute types (ECMA-167 4/14.10)
+const (
+	EA_TYPE_CHARACTER_SET_INFORMATION = 1
+	EA_TYPE_ALTERNATE_PERMISSIONS     = 3
+	EA_TYPE_FILE_TIMES                = 5
+	EA_TYPE_INFORMATION_TIMES         = 6
+	EA_TYPE_DEVICE_SPECIFICATION      = 12
+	EA_TYPE_IMPLEMENTATION_USE        = 2048
+	EA_TYPE_APPLICATION_USE           = 65536
+)
+
+// Bits of the FileTimeExistence field of the File Times extended attribute
+const (
+	FILE_TIME_CREATION    = 1 << 0
+	FILE_TIME_DELETION    = 1 << 1
+	FILE_TIME_EFFECTIVE   = 1 << 2
+	FILE_TIME_LAST_BACKUP = 1 << 3
+)
+
+// Bits of the InformationTimeExistence field of the Information Times extended attribute
+const (
+	INFORMATION_TIME_CREATION          = 1 << 0
+	INFORMATION_TIME_LAST_MODIFICATION = 1 << 1
+	INFORMATION_TIME_EXPIRATION        = 1 << 2
+	INFORMATION_TIME_EFFECTIVE         = 1 << 3
+)
+
+type ExtendedAttributeHeaderDescriptor struct {
+	Descriptor                       Descriptor
+	ImplementationAttributesLocation uint32
+	ApplicationAttributesLocation    uint32
+}
+
+func (eahd *ExtendedAttributeHeaderDescriptor) FromBytes(b []byte) *ExtendedAttributeHeaderDescriptor {
+	eahd.Descriptor.FromBytes(b)
+	eahd.ImplementationAttributesLocation = rl_u32(b[16:])
+	eahd.ApplicationAttributesLocation = rl_u32(b[20:])
+	return eahd
+}
+
+func NewExtendedAttributeHeaderDescriptor(b []byte) *ExtendedAttributeHeaderDescriptor {
+	return new(ExtendedAttributeHeaderDescriptor).FromBytes(b)
+}
+
+// ExtendedAttribute is a generic extended attribute, convertible to its typed form
+type ExtendedAttribute struct {
+	AttributeType    uint32
+	AttributeSubtype uint8
+	AttributeLength  uint32
+	data             []byte
+}
+
+func (ea *ExtendedAttribute) FromBytes(b []byte) *ExtendedAttribute {
+	ea.AttributeType = rl_u32(b[0:])
+	ea.AttributeSubtype = r_u8(b[4:])
+	ea.AttributeLength = rl_u32(b[8:])
+	ea.data = b[:ea.AttributeLength]
+	return ea
+}
+
+func NewExtendedAttribute(b []byte) *ExtendedAttribute {
+	return new(ExtendedAttribute).FromBytes(b)
+}
+
+// Data returns the attribute-specific bytes following the common header
+func (ea *ExtendedAttribute) Data() []byte {
+	buf := make([]byte, len(ea.data)-12)
+	copy(buf, ea.data[12:])
+	return buf
+}
+
+type CharacterSetInformation struct {
+	CharacterSetType uint8
+	EscapeSequences  []byte
+}
+
+func (csi *CharacterSetInformation) FromBytes(b []byte) *CharacterSetInformation {
+	escLen := rl_u32(b[12:])
+	csi.CharacterSetType = r_u8(b[16:])
+	csi.EscapeSequences = b[17 : 17+escLen]
+	return csi
+}
+
+func (ea *ExtendedAttribute) CharacterSetInformation() *CharacterSetInformation {
+	return new(CharacterSetInformation).FromBytes(ea.data)
+}
+
+type AlternatePermissions struct {
+	OwnerIdentification uint16
+	GroupIdentification uint16
+	Permission          uint16
+}
+
+func (ap *AlternatePermissions) FromBytes(b []byte) *AlternatePermissions {
+	ap.OwnerIdentification = rl_u16(b[12:])
+	ap.GroupIdentification = rl_u16(b[14:])
+	ap.Permission = rl_u16(b[16:])
+	return ap
+}
+
+func (ea *ExtendedAttribute) AlternatePermissions() *AlternatePermissions {
+	return new(AlternatePermissions).FromBytes(ea.data)
+}
+
+// TimesAttribute holds either a File Times or an Information Times extended
+// attribute, the recorded times being indexed by their existence bit
+type TimesAttribute struct {
+	Existence uint32
+	Times     map[uint32]time.Time
+}
+
+func (ta *TimesAttribute) FromBytes(b []byte) *TimesAttribute {
+	dataLen := rl_u32(b[12:])
+	ta.Existence = rl_u32(b[16:])
+	ta.Times = make(map[uint32]time.Time)
+	off := uint32(20)
+	for bit := uint32(0); bit < 32 && off+12 <= 20+dataLen; bit++ {
+		if ta.Existence&(1<<bit) != 0 {
+			ta.Times[1<<bit] = r_timestamp(b[off:])
+			off += 12
+		}
+	}
+	return ta
+}
+
+func (ea *ExtendedAttribute) FileTimes() *TimesAttribute {
+	return new(TimesAttribute).FromBytes(ea.data)
+}
+
+func (ea *ExtendedAttribute) InformationTimes() *TimesAttribute {
+	return new(TimesAttribute).FromBytes(ea.data)
+}
+
+type DeviceSpecification struct {
+	MajorDeviceIdentification uint32
+	MinorDeviceIdentification uint32
+	ImplementationUse         []byte
+}
+
+func (ds *DeviceSpecification) FromBytes(b []byte) *DeviceSpecification {
+	implUseLen := rl_u32(b[12:])
+	ds.MajorDeviceIdentification = rl_u32(b[16:])
+	ds.MinorDeviceIdentification = rl_u32(b[20:])
+	if 24+uint64(implUseLen) <= uint64(len(b)) {
+		ds.ImplementationUse = b[24 : 24+implUseLen]
+	}
+	return ds
+}
+
+func NewDeviceSpecification(b []byte) *DeviceSpecification {
+	return new(DeviceSpecification).FromBytes(b)
+}
+
+func (ea *ExtendedAttribute) DeviceSpecification() *DeviceSpecification {
+	return NewDeviceSpecification(ea.data)
+}
+
+// ImplementationUseAttribute holds an Implementation Use or an Application
+// Use extended attribute, which share the same layout
+type ImplementationUseAttribute struct {
+	Identifier        EntityID
+	ImplementationUse []byte
+	headerChecksum    uint16
+}
+
+func (iu *ImplementationUseAttribute) FromBytes(b []byte) *ImplementationUseAttribute {
+	useLen := rl_u32(b[12:])
+	iu.Identifier = NewEntityID(b[16:])
+	iu.ImplementationUse = b[48 : 48+useLen]
+	for i := 0; i < 48; i++ {
+		iu.headerChecksum += uint16(b[i])
+	}
+	return iu
+}
+
+// HasHeaderChecksum returns true for the UDF-defined attributes, whose first
+// two bytes of implementation use hold a checksum of the attribute header
+func (iu *ImplementationUseAttribute) HasHeaderChecksum() bool {
+	return strings.HasPrefix(iu.Identifier.IdentifierString(), "*UDF")
+}
+
+// ValidHeaderChecksum verifies the header checksum, if the attribute has one
+func (iu *ImplementationUseAttribute) ValidHeaderChecksum() bool {
+	if !iu.HasHeaderChecksum() {
+		return true
+	}
+	return len(iu.ImplementationUse) >= 2 && rl_u16(iu.ImplementationUse) == iu.headerChecksum
+}
+
+func (ea *ExtendedAttribute) ImplementationUse() *ImplementationUseAttribute {
+	return new(ImplementationUseAttribute).FromBytes(ea.data)
+}
+
+func (ea *ExtendedAttribute) ApplicationUse() *ImplementationUseAttribute {
+	return new(ImplementationUseAttribute).FromBytes(ea.data)
+}
+
+// ExtendedAttributes is the list of attributes of an extended attribute space
+type ExtendedAttributes []ExtendedAttribute
+
+// NewExtendedAttributes parses an extended attribute space, starting with its
+// Extended Attribute Header Descriptor, and verifies its checksums
+func NewExtendedAttributes(b []byte) (ExtendedAttributes, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if len(b) < 24 {
+		return nil, errors.New("extended attribute space too short")
+	}
+	eahd := NewExtendedAttributeHeaderDescriptor(b)
+	if eahd.Descriptor.TagIdentifier != DESCRIPTOR_EXTENDED_ATTRIBUTE_HEADER {
+		return nil, errors.New("missing extended attribute header descriptor")
+	}
+	if eahd.Descriptor.TagChecksum != eahd.Descriptor.Checksum() {
+		return nil, errors.New("bad extended attribute header checksum")
+	}
+	if !eahd.Descriptor.ValidCRC() {
+		return nil, errors.New("bad extended attribute header CRC")
+	}
+
+	var attrs ExtendedAttributes
+	for off := uint64(24); off+12 <= uint64(len(b)); {
+		attrLen := uint64(rl_u32(b[off+8:]))
+		if attrLen < 12 || off+attrLen > uint64(len(b)) {
+			return attrs, errors.New("invalid extended attribute length")
+		}
+		attr := NewExtendedAttribute(b[off : off+attrLen])
+		minLen, ok := attr.minLength()
+		if !ok {
+			return attrs, errors.New("invalid extended attribute length")
+		}
+		if attrLen < minLen {
+			return attrs, errors.New("truncated extended attribute")
+		}
+		if attr.AttributeType == EA_TYPE_IMPLEMENTATION_USE || attr.AttributeType == EA_TYPE_APPLICATION_USE {
+			if !attr.ImplementationUse().ValidHeaderChecksum() {
+				return attrs, errors.New("bad extended attribute header checksum")
+			}
+		}
+		attrs = append(attrs, *attr)
+		off += attrLen
+	}
+	return attrs, nil
+}
+
+// minLength returns the smallest length that holds the attribute's
+// type-specific fields, and false if the attribute is too short to record
+// the length of its variable part
+func (ea *ExtendedAttribute) minLength() (uint64, bool) {
+	var fixed uint64
+	switch ea.AttributeType {
+	case EA_TYPE_CHARACTER_SET_INFORMATION:
+		fixed = 17
+	case EA_TYPE_ALTERNATE_PERMISSIONS:
+		return 18, true
+	case EA_TYPE_FILE_TIMES, EA_TYPE_INFORMATION_TIMES:
+		fixed = 20
+	case EA_TYPE_DEVICE_SPECIFICATION:
+		fixed = 24
+	case EA_TYPE_IMPLEMENTATION_USE, EA_TYPE_APPLICATION_USE:
+		fixed = 48
+	default:
+		return 12, true
+	}
+	if len(ea.data) < 16 {
+		return 0, false
+	}
+	return fixed + uint64(rl_u32(ea.data[12:])), true
+}
+
+func (eas ExtendedAttributes) find(attrType uint32) *ExtendedAttribute {
+	for i := range eas {
+		if eas[i].AttributeType == attrType {
+			return &eas[i]
+		}
+	}
+	return nil
+}
+
+func (eas ExtendedAttributes) CharacterSetInformation() *CharacterSetInformation {
+	if ea := eas.find(EA_TYPE_CHARACTER_SET_INFORMATION); ea != nil {
+		return ea.CharacterSetInformation()
+	}
+	return nil
+}
+
+func (eas ExtendedAttributes) AlternatePermissions() *AlternatePermissions {
+	if ea := eas.find(EA_TYPE_ALTERNATE_PERMISSIONS); ea != nil {
+		return ea.AlternatePermissions()
+	}
+	return nil
+}
+
+func (eas ExtendedAttributes) FileTimes() *TimesAttribute {
+	if ea := eas.find(EA_TYPE_FILE_TIMES); ea != nil {
+		return ea.FileTimes()
+	}
+	return nil
+}
+
+func (eas ExtendedAttributes) InformationTimes() *TimesAttribute {
+	if ea := eas.find(EA_TYPE_INFORMATION_TIMES); ea != nil {
+		return ea.InformationTimes()
+	}
+	return nil
+}
+
+func (eas ExtendedAttributes) DeviceSpecification() *DeviceSpecification {
+	if ea := eas.find(EA_TYPE_DEVICE_SPECIFICATION); ea != nil {
+		return ea.DeviceSpecification()
+	}
+	return nil
+}
+
+// ImplementationUse returns the Implementation Use attribute with the given
+// identifier, e.g. "*UDF FreeEASpace"
+func (eas ExtendedAttributes) ImplementationUse(identifier string) *ImplementationUseAttribute {
+	return eas.findUse(EA_TYPE_IMPLEMENTATION_USE, identifier)
+}
+
+// ApplicationUse returns the Application Use attribute with the given identifier
+func (eas ExtendedAttributes) ApplicationUse(identifier string) *ImplementationUseAttribute {
+	return eas.findUse(EA_TYPE_APPLICATION_USE, identifier)
+}
+
+func (eas ExtendedAttributes) findUse(attrType uint32, identifier string) *ImplementationUseAttribute {
+	for i := range eas {
+		if eas[i].AttributeType != attrType {
+			continue
+		}
+		if iu := eas[i].ImplementationUse(); iu.Identifier.IdentifierString() == identifier {
+			return iu
+		}
+	}
+	return nil
+}
@@ -0,0 +1,992 @@
+package udf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrEditorClosed = errors.New("udf: editor closed")
+
+// Editor modifies a UDF image in place: it renames, removes and adds
+// entries, changes their metadata and contents, and changes the volume
+// label, keeping the descriptor tags, the space bitmaps and the logical
+// volume integrity descriptor consistent.
+//
+// Changes are kept in memory and recorded by Close, with the integrity
+// descriptor marked open while the image is written. An operation that
+// fails leaves the image as it was before it.
+type Editor struct {
+	overlay *sectorOverlay
+	udf     *Udf
+	w       io.WriterAt
+
+	revision uint16
+	bitmaps  map[uint16]*editBitmap
+	// mirrors map the blocks of metadata partitions to their copy in the
+	// metadata mirror file
+	mirrors map[uint16]Partition
+
+	files    int
+	dirs     int
+	uniqueID uint64
+	closed   bool
+}
+
+// editBitmap is the unallocated space bitmap of a partition, along with the
+// sectors recording it
+type editBitmap struct {
+	sbd     *SpaceBitmapDescriptor
+	sectors []uint64
+	dirty   bool
+}
+
+// editEntry is an entry found by path, along with the directory naming it
+type editEntry struct {
+	path string
+	fe   FileEntryInterface
+	loc  LbAddr
+	// dir is nil for the root directory, else fidOffset is the offset of
+	// the entry's identifier in the directory data
+	dir       *editEntry
+	fidOffset int
+	fid       *FileIdentifierDescriptor
+}
+
+// NewEditor returns an Editor reading the image from r and recording the
+// changes to w, which must write to the same image
+func NewEditor(r io.ReaderAt, w io.WriterAt) (ed *Editor, err error) {
+	ed = &Editor{
+		overlay: &sectorOverlay{r: r, sectors: make(map[uint64][]byte)},
+		w:       w,
+		bitmaps: make(map[uint16]*editBitmap),
+		mirrors: make(map[uint16]Partition),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ed, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	ed.udf, err = NewUdfFromReader(ed.overlay)
+	if err != nil {
+		return nil, err
+	}
+	udf := ed.udf
+	ed.overlay.sectorSize = udf.SECTOR_SIZE
+
+	info := udf.Info()
+	if info.HardWriteProtect || info.SoftWriteProtect {
+		return nil, errors.New("udf: the volume is write-protected")
+	}
+	ed.revision = info.UDFRevision
+	for _, pd := range udf.partitionDescriptors() {
+		if pd.AccessType == PARTITION_ACCESS_READ_ONLY || pd.AccessType == PARTITION_ACCESS_WRITE_ONCE {
+			return nil, fmt.Errorf("udf: partition %d is %s", pd.PartitionNumber, PartitionAccessType(pd.AccessType))
+		}
+	}
+	for i, pMap := range udf.lvd.PartitionMaps {
+		if pMap.PartitionMapType != 2 {
+			continue
+		}
+		if ident := pMap.PartitionTypeIdentifier.IdentifierString(); ident != "*UDF Metadata Partition" {
+			return nil, fmt.Errorf("udf: %s partitions are not supported", ident)
+		}
+		if fe := udf.metadataFile(uint16(i), FILE_TYPE_METADATA_MIRROR); fe != nil {
+			ed.mirrors[uint16(i)] = udf.newMetadataBlocks(uint16(i), fe)
+		}
+	}
+
+	lvid := udf.LogicalVolumeIntegrity()
+	if lvid == nil {
+		return nil, errors.New("udf: no logical volume integrity descriptor")
+	}
+	if lvid.IntegrityType != INTEGRITY_TYPE_CLOSE {
+		return nil, errors.New("udf: the volume was not closed cleanly, repair it first")
+	}
+	ed.uniqueID = maxUint64(lvid.UniqueID, 16)
+	return ed, nil
+}
+
+// Udf returns a reader of the image with the changes made so far
+func (ed *Editor) Udf() (*Udf, error) {
+	return NewUdfFromReader(ed.overlay)
+}
+
+// edit runs an operation, undoing its changes if it fails
+func (ed *Editor) edit(fn func() error) (err error) {
+	if ed.closed {
+		return ErrEditorClosed
+	}
+	sectors := make(map[uint64][]byte, len(ed.overlay.sectors))
+	for sector, b := range ed.overlay.sectors {
+		sectors[sector] = b
+	}
+	bitmaps := make(map[uint16]editBitmap, len(ed.bitmaps))
+	for partition, bm := range ed.bitmaps {
+		if bm == nil {
+			continue
+		}
+		saved := *bm
+		saved.sbd = &SpaceBitmapDescriptor{}
+		*saved.sbd = *bm.sbd
+		saved.sbd.Bitmap = append([]byte(nil), bm.sbd.Bitmap...)
+		bitmaps[partition] = saved
+	}
+	files, dirs, uniqueID := ed.files, ed.dirs, ed.uniqueID
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("udf: %v", r)
+		}
+		if err == nil {
+			return
+		}
+		ed.overlay.sectors = sectors
+		for partition, bm := range ed.bitmaps {
+			if saved, ok := bitmaps[partition]; ok {
+				*bm = saved
+			} else if bm != nil {
+				delete(ed.bitmaps, partition)
+			}
+		}
+		ed.files, ed.dirs, ed.uniqueID = files, dirs, uniqueID
+	}()
+	return fn()
+}
+
+// entryFields returns the fields shared by file entries and extended file
+// entries
+func entryFields(fe FileEntryInterface) *FileEntry {
+	switch e := fe.(type) {
+	case *ExtendedFileEntry:
+		return &e.FileEntry
+	case *FileEntry:
+		return e
+	}
+	return nil
+}
+
+func entryHeaderLength(fe FileEntryInterface) int {
+	if _, ok := fe.(*ExtendedFileEntry); ok {
+		return 216
+	}
+	return 176
+}
+
+// writeBlock records a logical block, and its copy in the metadata mirror
+// file for metadata partitions
+func (ed *Editor) writeBlock(loc LbAddr, b []byte) {
+	sectorSize := ed.udf.SECTOR_SIZE
+	buf := make([]byte, sectorSize)
+	copy(buf, b)
+	ed.overlay.sectors[ed.udf.sectorOf(loc.PartitionReferenceNumber, uint64(loc.LogicalBlockNumber))] = buf
+	if mirror, ok := ed.mirrors[loc.PartitionReferenceNumber]; ok {
+		if sector, ok := mirror.Sector(uint64(loc.LogicalBlockNumber)); ok {
+			ed.overlay.sectors[sector] = buf
+		}
+	}
+}
+
+func (ed *Editor) writeEntry(e *editEntry) error {
+	b := marshalFileEntry(e.fe)
+	if uint64(len(b)) > ed.udf.SECTOR_SIZE {
+		return fmt.Errorf("udf: file entry of %s does not fit in a block", e.path)
+	}
+	ed.writeBlock(e.loc, b)
+	return nil
+}
+
+// readData returns the data of an entry
+func (ed *Editor) readData(fe FileEntryInterface) []byte {
+	data, _ := ioutil.ReadAll(ed.udf.NewFileEntryReader(fe))
+	if uint64(len(data)) > fe.GetInformationLength() {
+		data = data[:fe.GetInformationLength()]
+	}
+	return data
+}
+
+func (ed *Editor) rootEntry() *editEntry {
+	entries := ed.udf.readICBHierarchy(ed.udf.fsd.RootDirectoryICB)
+	current := entries[len(entries)-1]
+	return &editEntry{path: "/", fe: current.fe, loc: current.location}
+}
+
+// lookup returns the entry at the given path
+func (ed *Editor) lookup(name string) (*editEntry, error) {
+	name = path.Clean("/" + name)
+	e := ed.rootEntry()
+	if name == "/" {
+		return e, nil
+	}
+	for _, part := range strings.Split(name[1:], "/") {
+		if !isDirectoryEntry(e.fe) {
+			return nil, fmt.Errorf("udf: %s is not a directory", e.path)
+		}
+		child := ed.child(e, part)
+		if child == nil {
+			return nil, fmt.Errorf("udf: %s: %w", path.Join(e.path, part), os.ErrNotExist)
+		}
+		e = child
+	}
+	return e, nil
+}
+
+// child returns the entry a directory names, nil if there is none
+func (ed *Editor) child(dir *editEntry, name string) *editEntry {
+	data := ed.readData(dir.fe)
+	for off := 0; off+38 <= len(data); {
+		if off+38+int(rl_u16(data[off+36:]))+int(data[off+19]) > len(data) {
+			break
+		}
+		fid := NewFileIdentifierDescriptor(data[off:])
+		if fid.Descriptor.TagIdentifier != DESCRIPTOR_IDENTIFIER {
+			break
+		}
+		if fid.FileCharacteristics&(FILE_CHARACTERISTIC_DELETED|FILE_CHARACTERISTIC_PARENT) == 0 && fid.FileIdentifier == name {
+			entries := ed.udf.readICBHierarchy(fid.ICB)
+			current := entries[len(entries)-1]
+			return &editEntry{
+				path:      path.Join(dir.path, name),
+				fe:        current.fe,
+				loc:       current.location,
+				dir:       dir,
+				fidOffset: off,
+				fid:       fid,
+			}
+		}
+		off += int(fid.Len())
+	}
+	return nil
+}
+
+// lookupDir returns the directory at the given path
+func (ed *Editor) lookupDir(name string) (*editEntry, error) {
+	dir, err := ed.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isDirectoryEntry(dir.fe) {
+		return nil, fmt.Errorf("udf: %s is not a directory", dir.path)
+	}
+	return dir, nil
+}
+
+// bitmap returns the unallocated space bitmap of a partition, nil if it has
+// none
+func (ed *Editor) bitmap(partition uint16) *editBitmap {
+	if bm, ok := ed.bitmaps[partition]; ok {
+		return bm
+	}
+	var bm *editBitmap
+	sectors := ed.udf.spaceBitmapSectors(partition)
+	if sbd := ed.udf.readSpaceBitmap(sectors); sbd != nil {
+		bm = &editBitmap{sbd: sbd, sectors: sectors}
+	}
+	ed.bitmaps[partition] = bm
+	return bm
+}
+
+func (bm *editBitmap) set(block uint32, free bool) {
+	if free {
+		bm.sbd.Bitmap[block/8] |= 1 << (block % 8)
+	} else {
+		bm.sbd.Bitmap[block/8] &^= 1 << (block % 8)
+	}
+	bm.dirty = true
+}
+
+// allocate takes blocks marked free in the bitmap of a partition, in a
+// single extent if there is a long enough run of free blocks. The extents
+// returned record whole blocks.
+func (ed *Editor) allocate(partition uint16, blocks uint32) (extents []ExtentLong, err error) {
+	bm := ed.bitmap(partition)
+	if bm == nil {
+		return nil, fmt.Errorf("udf: partition %d has no space bitmap to allocate from", partition)
+	}
+	bs := uint32(ed.udf.SECTOR_SIZE)
+	maxBlocks := (1<<30 - bs) / bs
+	var runStart, runLength uint32
+	for block := uint32(0); block < bm.sbd.NumberOfBits && runLength < blocks; block++ {
+		if !bm.sbd.IsFree(block) {
+			runLength = 0
+			continue
+		}
+		if runLength == 0 {
+			runStart = block
+		}
+		runLength++
+	}
+	take := func(start uint32) {
+		bm.set(start, false)
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if last.Location.LogicalBlockNumber+last.Length/bs == start && last.Length/bs < maxBlocks {
+				last.Length += bs
+				return
+			}
+		}
+		extents = append(extents, ExtentLong{bs, LbAddr{start, partition}})
+	}
+	if runLength == blocks {
+		for block := runStart; block < runStart+blocks; block++ {
+			take(block)
+		}
+		return extents, nil
+	}
+	// Otherwise the first free blocks
+	taken := uint32(0)
+	for block := uint32(0); block < bm.sbd.NumberOfBits && taken < blocks; block++ {
+		if bm.sbd.IsFree(block) {
+			take(block)
+			taken++
+		}
+	}
+	if taken < blocks {
+		return nil, fmt.Errorf("udf: not enough free space in partition %d", partition)
+	}
+	return extents, nil
+}
+
+// free marks the blocks of an extent free, if the partition has a bitmap
+func (ed *Editor) free(partition uint16, block uint32, blocks uint32) {
+	bm := ed.bitmap(partition)
+	if bm == nil {
+		return
+	}
+	for i := block; i < block+blocks && i < bm.sbd.NumberOfBits; i++ {
+		bm.set(i, true)
+	}
+}
+
+// extents returns the extents recording the data of an entry
+func (ed *Editor) extents(e *editEntry) (extents []ExtentLong, err error) {
+	ed.udf.walkAllocationDescriptors(e.fe, e.fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		if aed || desc.IsNotRecorded() {
+			err = fmt.Errorf("udf: %s: sparse files and allocation extent descriptors are not supported", e.path)
+			return
+		}
+		extents = append(extents, ExtentLong{ExtentLength(desc), LbAddr{uint32(desc.GetLocation()), partition}})
+	})
+	return
+}
+
+// resize sets the length of an entry's data, allocating or freeing blocks
+// as needed. The data must then be recorded with writeData.
+func (ed *Editor) resize(e *editEntry, length uint64) error {
+	f := entryFields(e.fe)
+	bs := ed.udf.SECTOR_SIZE
+	var extents []ExtentLong
+	partition := e.loc.PartitionReferenceNumber
+	if f.ICBTag.AllocationType == Embedded {
+		if uint64(entryHeaderLength(e.fe)+len(f.ExtendedAttributes))+length <= bs {
+			ed.setLength(e.fe, length)
+			return nil
+		}
+		f.ICBTag.AllocationType = LongDescriptors
+	} else {
+		var err error
+		if extents, err = ed.extents(e); err != nil {
+			return err
+		}
+	}
+	if len(extents) > 0 {
+		partition = extents[len(extents)-1].Location.PartitionReferenceNumber
+	} else if !isDirectoryEntry(e.fe) {
+		// File data is recorded in the physical partition
+		partition = ed.udf.physicalPartition(partition)
+	}
+	if f.ICBTag.AllocationType == ShortDescriptors && partition != e.fe.GetPartition() {
+		f.ICBTag.AllocationType = LongDescriptors
+	}
+
+	blocksOf := func(extent ExtentLong) uint64 {
+		return (uint64(extent.Length) + bs - 1) / bs
+	}
+	var have uint64
+	for i, extent := range extents {
+		have += blocksOf(extent)
+		// Only the last extent may end within a block
+		extents[i].Length = uint32(blocksOf(extent) * bs)
+	}
+	need := (length + bs - 1) / bs
+	for have > need {
+		last := &extents[len(extents)-1]
+		drop := minUint64(blocksOf(*last), have-need)
+		ed.free(last.Location.PartitionReferenceNumber, last.Location.LogicalBlockNumber+uint32(blocksOf(*last)-drop), uint32(drop))
+		last.Length -= uint32(drop * bs)
+		if last.Length == 0 {
+			extents = extents[:len(extents)-1]
+		}
+		have -= drop
+	}
+	if have < need {
+		more, err := ed.allocate(partition, uint32(need-have))
+		if err != nil {
+			return err
+		}
+		extents = append(extents, more...)
+	}
+
+	f.AllocationDescriptors = nil
+	f.LogicalBlocksRecorded = 0
+	remaining := length
+	for _, extent := range extents {
+		extent.Length = uint32(minUint64(uint64(extent.Length), remaining))
+		remaining -= uint64(extent.Length)
+		f.LogicalBlocksRecorded += blocksOf(extent)
+		var ad []byte
+		if f.ICBTag.AllocationType == ShortDescriptors {
+			ad, _ = Extent{extent.Length, extent.Location.LogicalBlockNumber}.MarshalBinary()
+		} else {
+			ad, _ = extent.MarshalBinary()
+		}
+		f.AllocationDescriptors = append(f.AllocationDescriptors, ad...)
+	}
+	f.LengthOfAllocationDescriptors = uint32(len(f.AllocationDescriptors))
+	if uint64(entryHeaderLength(e.fe)+len(f.ExtendedAttributes)+len(f.AllocationDescriptors)) > bs {
+		return fmt.Errorf("udf: allocation descriptors of %s do not fit in its file entry", e.path)
+	}
+	ed.setLength(e.fe, length)
+	return nil
+}
+
+func (ed *Editor) setLength(fe FileEntryInterface, length uint64) {
+	f := entryFields(fe)
+	if efe, ok := fe.(*ExtendedFileEntry); ok {
+		efe.ObjectSize = efe.ObjectSize - f.InformationLength + length
+	}
+	f.InformationLength = length
+}
+
+// writeData records the data of an entry, resized to its length, and its
+// file entry
+func (ed *Editor) writeData(e *editEntry, data []byte) error {
+	f := entryFields(e.fe)
+	if f.ICBTag.AllocationType == Embedded {
+		f.AllocationDescriptors = append([]byte(nil), data...)
+		f.LengthOfAllocationDescriptors = uint32(len(data))
+		return ed.writeEntry(e)
+	}
+	bs := ed.udf.SECTOR_SIZE
+	off := uint64(0)
+	for _, desc := range e.fe.GetAllocationDescriptors() {
+		loc := LbAddr{uint32(desc.GetLocation()), adPartition(e.fe, desc)}
+		for i := uint64(0); i < (uint64(ExtentLength(desc))+bs-1)/bs; i++ {
+			ed.writeBlock(LbAddr{loc.LogicalBlockNumber + uint32(i), loc.PartitionReferenceNumber}, data[minUint64(off, uint64(len(data))):minUint64(off+bs, uint64(len(data)))])
+			off += bs
+		}
+	}
+	return ed.writeEntry(e)
+}
+
+// blockOf returns the logical block recording the given byte of an entry's
+// data
+func (ed *Editor) blockOf(e *editEntry, off uint64) uint32 {
+	if e.fe.GetICBTag().AllocationType == Embedded {
+		return e.loc.LogicalBlockNumber
+	}
+	start := uint64(0)
+	for _, desc := range e.fe.GetAllocationDescriptors() {
+		length := uint64(ExtentLength(desc))
+		if off < start+length {
+			return uint32(desc.GetLocation() + (off-start)/ed.udf.SECTOR_SIZE)
+		}
+		start += length
+	}
+	return 0
+}
+
+// setDirectory records the identifiers of a directory, with their tags
+// updated to their new locations
+func (ed *Editor) setDirectory(dir *editEntry, data []byte) error {
+	if err := ed.resize(dir, uint64(len(data))); err != nil {
+		return err
+	}
+	for off := uint64(0); off+38 <= uint64(len(data)); {
+		fid := NewFileIdentifierDescriptor(data[off:])
+		end := minUint64(off+fid.Len(), uint64(len(data)))
+		wl_u32(data[off+12:], ed.blockOf(dir, off))
+		setDescriptorTag(data[off:end])
+		off = end
+	}
+	f := entryFields(dir.fe)
+	f.ModificationTime = time.Now()
+	f.AttributeTime = f.ModificationTime
+	return ed.writeData(dir, data)
+}
+
+// removeIdentifier marks the identifier of an entry deleted in its
+// directory; the identifier of an entry that lives on under another name
+// no longer references it
+func (ed *Editor) removeIdentifier(e *editEntry, keepICB bool, linkDelta int) error {
+	dir, err := ed.lookupDir(e.dir.path)
+	if err != nil {
+		return err
+	}
+	data := ed.readData(dir.fe)
+	data[e.fidOffset+18] |= FILE_CHARACTERISTIC_DELETED
+	if !keepICB {
+		for i := e.fidOffset + 20; i < e.fidOffset+36; i++ {
+			data[i] = 0
+		}
+	}
+	entryFields(dir.fe).FileLinkCount = uint16(int(dir.fe.GetFileLinkCount()) + linkDelta)
+	return ed.setDirectory(dir, data)
+}
+
+// nextUniqueID returns a new unique ID; those whose lower 32 bits are 0 to
+// 15 are reserved
+func (ed *Editor) nextUniqueID() uint64 {
+	if uint32(ed.uniqueID) < 16 {
+		ed.uniqueID = ed.uniqueID&^0xFFFFFFFF | 16
+	}
+	id := ed.uniqueID
+	ed.uniqueID++
+	return id
+}
+
+// entryWriter returns a Writer recording file entries and identifiers for
+// the volume's revision
+func (ed *Editor) entryWriter() *Writer {
+	revision := ed.revision
+	if revision == 0 {
+		revision = UDF_REVISION_201
+	}
+	return &Writer{opts: WriterOptions{
+		Revision:      revision,
+		BlockSize:     uint32(ed.udf.SECTOR_SIZE),
+		RecordingTime: time.Now(),
+	}}
+}
+
+// Rename renames an entry, moving it to another directory if needed
+func (ed *Editor) Rename(oldname string, newname string) error {
+	return ed.edit(func() error {
+		src, err := ed.lookup(oldname)
+		if err != nil {
+			return err
+		}
+		if src.dir == nil {
+			return errors.New("udf: cannot rename the root directory")
+		}
+		newname = path.Clean("/" + newname)
+		if newname == src.path {
+			return nil
+		}
+		dst, err := ed.lookupDir(path.Dir(newname))
+		if err != nil {
+			return err
+		}
+		base := path.Base(newname)
+		if ed.child(dst, base) != nil {
+			return fmt.Errorf("udf: %s: %w", newname, os.ErrExist)
+		}
+		if len(w_dcharacters(base)) > 255 {
+			return fmt.Errorf("udf: name too long: %s", base)
+		}
+		isDir := isDirectoryEntry(src.fe)
+		if isDir && strings.HasPrefix(dst.path+"/", src.path+"/") {
+			return fmt.Errorf("udf: cannot move %s into itself", src.path)
+		}
+		moved := dst.path != src.dir.path
+
+		// Name the entry in the new directory, then delete the old name
+		fid := *src.fid
+		fid.FileIdentifier = base
+		b, _ := fid.MarshalBinary()
+		if isDir && moved {
+			entryFields(dst.fe).FileLinkCount++
+		}
+		if err := ed.setDirectory(dst, append(ed.readData(dst.fe), b...)); err != nil {
+			return err
+		}
+		linkDelta := 0
+		if isDir && moved {
+			linkDelta = -1
+		}
+		if err := ed.removeIdentifier(src, false, linkDelta); err != nil {
+			return err
+		}
+		if !isDir || !moved {
+			return nil
+		}
+
+		// The moved directory's parent entry references its new parent
+		dir, err := ed.lookupDir(newname)
+		if err != nil {
+			return err
+		}
+		parent, err := ed.lookupDir(dst.path)
+		if err != nil {
+			return err
+		}
+		data := ed.readData(dir.fe)
+		for off := 0; off+38 <= len(data); off += int(NewFileIdentifierDescriptor(data[off:]).Len()) {
+			if data[off+18]&FILE_CHARACTERISTIC_PARENT != 0 {
+				parent.loc.encode(data[off+24:])
+				wl_u32(data[off+20+12:], uint32(parent.fe.GetUniqueID()))
+				break
+			}
+		}
+		return ed.setDirectory(dir, data)
+	})
+}
+
+// Remove removes a file or an empty directory. Its identifier is kept,
+// marked deleted; the blocks of the entry are freed once no identifier
+// references it.
+func (ed *Editor) Remove(name string) error {
+	return ed.edit(func() error {
+		e, err := ed.lookup(name)
+		if err != nil {
+			return err
+		}
+		if e.dir == nil {
+			return errors.New("udf: cannot remove the root directory")
+		}
+		isDir := isDirectoryEntry(e.fe)
+		if isDir && len(ed.udf.ReadDir(e.fe)) > 0 {
+			return fmt.Errorf("udf: %s: directory not empty", e.path)
+		}
+		linkDelta := 0
+		if isDir {
+			linkDelta = -1
+		}
+		if err := ed.removeIdentifier(e, true, linkDelta); err != nil {
+			return err
+		}
+		if !isDir && e.fe.GetFileLinkCount() > 1 {
+			entryFields(e.fe).FileLinkCount--
+			return ed.writeEntry(e)
+		}
+		if isDir {
+			ed.dirs--
+		} else {
+			ed.files--
+		}
+		ed.freeEntry(e.fid.ICB, make(map[LbAddr]bool))
+		return nil
+	})
+}
+
+// freeEntry frees the blocks of an entry, its extended attributes and its
+// streams
+func (ed *Editor) freeEntry(icb ExtentLong, visited map[LbAddr]bool) {
+	udf := ed.udf
+	entries := udf.readICBHierarchy(icb)
+	fe := entries[len(entries)-1].fe
+	if visited[entries[len(entries)-1].location] {
+		return
+	}
+	visited[entries[len(entries)-1].location] = true
+	if fe.GetICBTag().AllocationType != Embedded {
+		udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+			if desc.GetLength()&UDF_EXTENT_FLAG_MASK == EXT_NOT_RECORDED_NOT_ALLOCATED {
+				return
+			}
+			length := uint64(ExtentLength(desc))
+			if aed {
+				length = udf.SECTOR_SIZE
+			}
+			ed.free(partition, uint32(desc.GetLocation()), uint32((length+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE))
+		})
+	}
+	if streams := fe.GetStreamDirectoryICB(); streams.GetLength() > 0 {
+		for _, f := range udf.ReadDir(udf.readFileEntry(streams)) {
+			ed.freeEntry(f.Fid.ICB, visited)
+		}
+		ed.freeEntry(streams, visited)
+	}
+	if eaICB := fe.GetExtendedAttributeICB(); eaICB.GetLength() > 0 {
+		ed.freeEntry(eaICB, visited)
+	}
+	for _, entry := range entries {
+		ed.free(entry.location.PartitionReferenceNumber, entry.location.LogicalBlockNumber, 1)
+	}
+}
+
+// changeEntry applies a change to the file entry of an entry
+func (ed *Editor) changeEntry(name string, change func(f *FileEntry)) error {
+	return ed.edit(func() error {
+		e, err := ed.lookup(name)
+		if err != nil {
+			return err
+		}
+		change(entryFields(e.fe))
+		return ed.writeEntry(e)
+	})
+}
+
+// applyMode sets the read, write and execute permissions and the setuid,
+// setgid and sticky bits of a file entry from mode, keeping its change
+// attribute and delete permissions
+func applyMode(f *FileEntry, mode os.FileMode) {
+	const rwx = 7 | 7<<5 | 7<<10
+	f.Permissions = f.Permissions&^rwx | udfPermissions(mode)&rwx
+	f.ICBTag.Flags &^= ICB_FLAG_SETUID | ICB_FLAG_SETGID | ICB_FLAG_STICKY
+	if mode&os.ModeSetuid != 0 {
+		f.ICBTag.Flags |= ICB_FLAG_SETUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		f.ICBTag.Flags |= ICB_FLAG_SETGID
+	}
+	if mode&os.ModeSticky != 0 {
+		f.ICBTag.Flags |= ICB_FLAG_STICKY
+	}
+}
+
+// Chmod changes the permission bits and the setuid, setgid and sticky
+// bits of an entry
+func (ed *Editor) Chmod(name string, mode os.FileMode) error {
+	return ed.changeEntry(name, func(f *FileEntry) {
+		applyMode(f, mode)
+		f.AttributeTime = time.Now()
+	})
+}
+
+// Chown changes the owner and group of an entry
+func (ed *Editor) Chown(name string, uid uint32, gid uint32) error {
+	return ed.changeEntry(name, func(f *FileEntry) {
+		f.Uid = uid
+		f.Gid = gid
+		f.AttributeTime = time.Now()
+	})
+}
+
+// Chtimes changes the access and modification times of an entry
+func (ed *Editor) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return ed.changeEntry(name, func(f *FileEntry) {
+		f.AccessTime = atime
+		f.ModificationTime = mtime
+		f.AttributeTime = time.Now()
+	})
+}
+
+// WriteFile replaces the contents of a regular file with data, which may
+// not be larger than its current contents
+func (ed *Editor) WriteFile(name string, data []byte) error {
+	return ed.edit(func() error {
+		e, err := ed.lookup(name)
+		if err != nil {
+			return err
+		}
+		if e.fe.GetICBTag().FileType != FILE_TYPE_REGULAR {
+			return fmt.Errorf("udf: %s is not a regular file", e.path)
+		}
+		if uint64(len(data)) > e.fe.GetInformationLength() {
+			return fmt.Errorf("udf: %s: new contents are larger than the file", e.path)
+		}
+		if err := ed.resize(e, uint64(len(data))); err != nil {
+			return err
+		}
+		f := entryFields(e.fe)
+		f.ModificationTime = time.Now()
+		f.AttributeTime = f.ModificationTime
+		return ed.writeData(e, data)
+	})
+}
+
+// Create adds an entry described by hdr, as for Writer.WriteHeader, taking
+// its blocks from the free space of the partition bitmaps. data holds the
+// contents of a regular file; hdr.Size is ignored.
+//
+// Images recorded by Writer only have the free space asked for in their
+// WriterOptions. On UDF 2.50 volumes the file entry, and a directory's
+// identifiers, go in the metadata partition, so Create needs
+// FreeMetadataBlocks as well as FreeBlocks for larger data.
+func (ed *Editor) Create(hdr *Header, data []byte) error {
+	return ed.edit(func() error {
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			return fmt.Errorf("udf: %s: %w", name, os.ErrExist)
+		}
+		dir, err := ed.lookupDir(path.Dir(name))
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		if ed.child(dir, base) != nil {
+			return fmt.Errorf("udf: %s: %w", name, os.ErrExist)
+		}
+		if len(w_dcharacters(base)) > 255 {
+			return fmt.Errorf("udf: name too long: %s", base)
+		}
+
+		// The file entry goes in the partition of the directory's
+		extents, err := ed.allocate(dir.loc.PartitionReferenceNumber, 1)
+		if err != nil {
+			return err
+		}
+		uw := ed.entryWriter()
+		node := &writerNode{
+			hdr:      *hdr,
+			location: extents[0].Location,
+			uniqueID: ed.nextUniqueID(),
+		}
+		node.hdr.Name = name
+		parent := &writerNode{location: dir.loc, uniqueID: dir.fe.GetUniqueID()}
+		var characteristics uint8
+		switch {
+		case node.isDir():
+			characteristics = FILE_CHARACTERISTIC_DIRECTORY
+			node.data = uw.fileIdentifier(parent, "", FILE_CHARACTERISTIC_PARENT|FILE_CHARACTERISTIC_DIRECTORY)
+			wl_u32(node.data[12:], node.location.LogicalBlockNumber)
+			setDescriptorTag(node.data)
+		case hdr.Mode&os.ModeSymlink != 0:
+			node.data = w_pathComponents(hdr.Linkname)
+		case hdr.Mode&os.ModeType == 0:
+			node.data = data
+		}
+		if len(node.data) > uw.embeddedLimit() {
+			partition := node.location.PartitionReferenceNumber
+			if !node.isDir() {
+				partition = ed.udf.physicalPartition(partition)
+			}
+			bs := uint64(ed.udf.SECTOR_SIZE)
+			node.extents, err = ed.allocate(partition, uint32((uint64(len(node.data))+bs-1)/bs))
+			if err != nil {
+				return err
+			}
+			remaining := uint64(len(node.data))
+			for i, extent := range node.extents {
+				for block := uint64(0); block < uint64(extent.Length)/bs; block++ {
+					off := uint64(len(node.data)) - remaining
+					ed.writeBlock(LbAddr{extent.Location.LogicalBlockNumber + uint32(block), extent.Location.PartitionReferenceNumber}, node.data[off:off+minUint64(bs, remaining)])
+					remaining -= minUint64(bs, remaining)
+				}
+				node.extents[i].Length = uint32(minUint64(uint64(extent.Length), uint64(len(node.data))-remaining))
+			}
+			node.data = nil
+		}
+		fe, err := uw.fileEntry(node)
+		if err != nil {
+			return err
+		}
+		ed.writeBlock(node.location, fe)
+
+		if node.isDir() {
+			entryFields(dir.fe).FileLinkCount++
+			ed.dirs++
+		} else {
+			ed.files++
+		}
+		fid := uw.fileIdentifier(node, base, characteristics)
+		return ed.setDirectory(dir, append(ed.readData(dir.fe), fid...))
+	})
+}
+
+// SetLabel changes the volume label, recorded as the volume identifier and
+// the logical volume identifier
+func (ed *Editor) SetLabel(label string) error {
+	return ed.edit(func() error {
+		if len(w_dcharacters(label)) > 31 {
+			return fmt.Errorf("udf: label too long: %s", label)
+		}
+		udf := ed.udf
+		anchor := NewAnchorVolumeDescriptorPointer(udf.ReadSector(256))
+		for _, extent := range []Extent{anchor.MainVolumeDescriptorSeq, anchor.ReserveVolumeDescriptorSeq} {
+			for sector := uint64(extent.Location); sector < uint64(extent.Location)+(uint64(extent.Length)+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE; sector++ {
+				desc := NewDescriptor(udf.ReadSector(sector))
+				if desc.TagIdentifier == DESCRIPTOR_TERMINATING || !desc.Valid() {
+					break
+				}
+				var b []byte
+				switch desc.TagIdentifier {
+				case DESCRIPTOR_PRIMARY_VOLUME:
+					pvd := desc.PrimaryVolumeDescriptor()
+					pvd.VolumeIdentifier = label
+					b, _ = pvd.MarshalBinary()
+				case DESCRIPTOR_LOGICAL_VOLUME:
+					lvd := desc.LogicalVolumeDescriptor()
+					lvd.LogicalVolumeIdentifier = label
+					b, _ = lvd.MarshalBinary()
+				case DESCRIPTOR_IMPLEMENTATION_USE_VOLUME:
+					iuvd := desc.ImplementationUseVolumeDescriptor()
+					if iuvd.ImplementationIdentifier.IdentifierString() != "*UDF LV Info" {
+						continue
+					}
+					iuvd.LogicalVolumeIdentifier = label
+					b, _ = iuvd.MarshalBinary()
+				default:
+					continue
+				}
+				buf := make([]byte, udf.SECTOR_SIZE)
+				copy(buf, b)
+				ed.overlay.sectors[sector] = buf
+			}
+		}
+		partition := udf.lvd.LogicalVolumeContentsUse.GetPartition()
+		for _, fsd := range udf.fileSets {
+			fsd.LogicalVolumeIdentifier = label
+			b, _ := fsd.MarshalBinary()
+			ed.writeBlock(LbAddr{fsd.Descriptor.TagLocation, partition}, b)
+		}
+		return nil
+	})
+}
+
+// Close records the changes. It does not close the underlying reader or
+// writer.
+func (ed *Editor) Close() error {
+	if ed.closed {
+		return ErrEditorClosed
+	}
+	ed.closed = true
+	udf := ed.udf
+	lvid, lvidSector := udf.logicalVolumeIntegrity()
+	for partition, bm := range ed.bitmaps {
+		if bm == nil || !bm.dirty {
+			continue
+		}
+		b, _ := bm.sbd.MarshalBinary()
+		for i, sector := range bm.sectors {
+			buf := make([]byte, udf.SECTOR_SIZE)
+			copy(buf, b[minUint64(uint64(i)*udf.SECTOR_SIZE, uint64(len(b))):])
+			ed.overlay.sectors[sector] = buf
+		}
+		if int(partition) < len(lvid.FreeSpaceTable) {
+			lvid.FreeSpaceTable[partition] = bm.freeBlocks()
+		}
+	}
+	if len(ed.overlay.sectors) == 0 {
+		return nil
+	}
+
+	// The integrity descriptor stays open until the changes are recorded
+	lvid.IntegrityType = INTEGRITY_TYPE_OPEN
+	lvid.RecordingDateTime = time.Now()
+	lvid.ImplementationIdentifier = implementationIdentifier()
+	if err := ed.writeIntegrity(lvid, lvidSector); err != nil {
+		return err
+	}
+	if err := ed.overlay.writeTo(ed.w, map[uint64]bool{lvidSector: true}); err != nil {
+		return err
+	}
+	lvid.IntegrityType = INTEGRITY_TYPE_CLOSE
+	lvid.NumberOfFiles = uint32(int(lvid.NumberOfFiles) + ed.files)
+	lvid.NumberOfDirectories = uint32(int(lvid.NumberOfDirectories) + ed.dirs)
+	lvid.UniqueID = maxUint64(lvid.UniqueID, ed.uniqueID)
+	return ed.writeIntegrity(lvid, lvidSector)
+}
+
+func (ed *Editor) writeIntegrity(lvid *LogicalVolumeIntegrityDescriptor, sector uint64) error {
+	b, _ := lvid.MarshalBinary()
+	buf := make([]byte, ed.udf.SECTOR_SIZE)
+	copy(buf, b)
+	_, err := ed.w.WriteAt(buf, int64(sector*ed.udf.SECTOR_SIZE))
+	return err
+}
+
+// freeBlocks counts the blocks marked free
+func (bm *editBitmap) freeBlocks() (free uint32) {
+	for block := uint32(0); block < bm.sbd.NumberOfBits; block++ {
+		if bm.sbd.IsFree(block) {
+			free++
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package udf
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+var editRevisions = []uint16{UDF_REVISION_102, UDF_REVISION_201, UDF_REVISION_250}
+
+func TestEditorEdits(t *testing.T) {
+	for _, revision := range editRevisions {
+		img := writeTestImage(t, WriterOptions{Revision: revision, FreeBlocks: 100, FreeMetadataBlocks: 16})
+		ed, err := NewEditor(img, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := bytes.Repeat([]byte("new contents "), 500)
+		edits := []struct {
+			name string
+			fn   func() error
+		}{
+			{"rename a file", func() error { return ed.Rename("dir/small.txt", "moved.txt") }},
+			{"move a directory", func() error { return ed.Rename("dir/sub", "many/sub") }},
+			{"remove a file", func() error { return ed.Remove("empty") }},
+			{"remove a link", func() error { return ed.Remove("link") }},
+			{"remove a directory", func() error { return ed.Remove("dir") }},
+			{"shorten a file", func() error { return ed.WriteFile("big.bin", []byte("shorter")) }},
+			{"create a directory", func() error { return ed.Create(&Header{Name: "new", Mode: os.ModeDir | 0755}, nil) }},
+			{"create a file", func() error { return ed.Create(&Header{Name: "new/file.txt", Mode: 0644}, contents) }},
+			{"create a link", func() error {
+				return ed.Create(&Header{Name: "new/link", Mode: os.ModeSymlink | 0777, Linkname: "file.txt"}, nil)
+			}},
+		}
+		for _, edit := range edits {
+			if err := edit.fn(); err != nil {
+				t.Fatalf("%s: %s: %v", UDFRevisionString(revision), edit.name, err)
+			}
+		}
+		if err := ed.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		u := checkVolume(t, img)
+		for _, name := range []string{"dir", "empty", "link"} {
+			if _, ok := findFile(u, name); ok {
+				t.Errorf("%s: %s was not removed", UDFRevisionString(revision), name)
+			}
+		}
+		if sub, ok := findFile(u, "many/sub"); !ok || !sub.IsDir() {
+			t.Errorf("%s: many/sub was not moved", UDFRevisionString(revision))
+		}
+		if s := readTestFile(t, u, "moved.txt"); s != "hello" {
+			t.Errorf("%s: moved.txt reads %q", UDFRevisionString(revision), s)
+		}
+		if s := readTestFile(t, u, "big.bin"); s != "shorter" {
+			t.Errorf("%s: big.bin reads %q", UDFRevisionString(revision), s)
+		}
+		if s := readTestFile(t, u, "new/file.txt"); s != string(contents) {
+			t.Errorf("%s: new/file.txt reads %d bytes", UDFRevisionString(revision), len(s))
+		}
+		if link, _ := findFile(u, "new/link"); link.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s: new/link has mode %v", UDFRevisionString(revision), link.Mode())
+		} else if target, err := link.Readlink(); err != nil || target != "file.txt" {
+			t.Errorf("%s: new/link points to %q (%v)", UDFRevisionString(revision), target, err)
+		}
+	}
+}
+
+func TestEditorFailedEdit(t *testing.T) {
+	for _, revision := range editRevisions {
+		img := writeTestImage(t, WriterOptions{Revision: revision, FreeBlocks: 10, FreeMetadataBlocks: 16})
+		recorded := append([]byte(nil), img.b...)
+
+		// The file entry is allocated before the data, which does not fit
+		tooLarge := make([]byte, 20*2048)
+		ed, err := NewEditor(img, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.Create(&Header{Name: "dir/large", Mode: 0644}, tooLarge); err == nil {
+			t.Fatalf("%s: created a file larger than the free space", UDFRevisionString(revision))
+		}
+		if err := ed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(img.b, recorded) {
+			t.Errorf("%s: a failed edit changed the image", UDFRevisionString(revision))
+		}
+
+		// Edits either side of the failed one are recorded
+		ed, err = NewEditor(img, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.Create(&Header{Name: "dir/before", Mode: 0644}, []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.Create(&Header{Name: "dir/large", Mode: 0644}, tooLarge); err == nil {
+			t.Fatalf("%s: created a file larger than the free space", UDFRevisionString(revision))
+		}
+		if err := ed.Rename("dir/small.txt", "dir/after"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		u := checkVolume(t, img)
+		if _, ok := findFile(u, "dir/large"); ok {
+			t.Errorf("%s: the failed file was recorded", UDFRevisionString(revision))
+		}
+		if readTestFile(t, u, "dir/before") != "before" || readTestFile(t, u, "dir/after") != "hello" {
+			t.Errorf("%s: lost the edits around the failed one", UDFRevisionString(revision))
+		}
+	}
+}
@@ -1,5 +1,61 @@
 package udf
 
+import (
+	"fmt"
+	"strings"
+)
+
+// Domain flags of the Domain Identifier Suffix (UDF 2.1.5.3)
+const (
+	DOMAIN_FLAG_HARD_WRITE_PROTECT = 1 << 0
+	DOMAIN_FLAG_SOFT_WRITE_PROTECT = 1 << 1
+)
+
+// Operating system classes of the UDF and Implementation Identifier Suffixes (UDF 6.3)
+const (
+	OS_CLASS_UNDEFINED  = 0
+	OS_CLASS_DOS        = 1
+	OS_CLASS_OS2        = 2
+	OS_CLASS_MACINTOSH  = 3
+	OS_CLASS_UNIX       = 4
+	OS_CLASS_WINDOWS_9X = 5
+	OS_CLASS_WINDOWS_NT = 6
+	OS_CLASS_OS400      = 7
+	OS_CLASS_BEOS       = 8
+	OS_CLASS_WINDOWS_CE = 9
+)
+
+const DOMAIN_IDENTIFIER_UDF = "*OSTA UDF Compliant"
+
+var osClassNames = map[uint8]string{
+	OS_CLASS_UNDEFINED:  "Undefined",
+	OS_CLASS_DOS:        "DOS",
+	OS_CLASS_OS2:        "OS/2",
+	OS_CLASS_MACINTOSH:  "Macintosh OS",
+	OS_CLASS_UNIX:       "UNIX",
+	OS_CLASS_WINDOWS_9X: "Windows 9x",
+	OS_CLASS_WINDOWS_NT: "Windows NT",
+	OS_CLASS_OS400:      "OS/400",
+	OS_CLASS_BEOS:       "BeOS",
+	OS_CLASS_WINDOWS_CE: "Windows CE",
+}
+
+var osIdentifierNames = map[uint8]map[uint8]string{
+	OS_CLASS_DOS:       {0: "DOS/Windows 3.x"},
+	OS_CLASS_MACINTOSH: {0: "Mac OS 9 and older", 1: "Mac OS X"},
+	OS_CLASS_UNIX: {
+		0: "Generic",
+		1: "IBM AIX",
+		2: "SUN OS / Solaris",
+		3: "HP/UX",
+		4: "Silicon Graphics Irix",
+		5: "Linux",
+		6: "MKLinux",
+		7: "FreeBSD",
+		8: "NetBSD",
+	},
+}
+
 type EntityID struct {
 	Flags            uint8
 	Identifier       [23]byte
@@ -12,3 +68,157 @@ func NewEntityID(b []byte) EntityID {
 	copy(e.IdentifierSuffix[:], b[24:32])
 	return e
 }
+
+// IdentifierString returns the identifier with its zero padding removed
+func (e EntityID) IdentifierString() string {
+	return strings.TrimRight(string(e.Identifier[:]), "\x00")
+}
+
+// IsDomain returns true for the OSTA UDF domain identifier, whose suffix is a
+// Domain Identifier Suffix
+func (e EntityID) IsDomain() bool {
+	return e.IdentifierString() == DOMAIN_IDENTIFIER_UDF
+}
+
+// IsUDF returns true for identifiers defined by UDF, whose suffix is a UDF
+// Identifier Suffix
+func (e EntityID) IsUDF() bool {
+	return strings.HasPrefix(e.IdentifierString(), "*UDF")
+}
+
+type DomainIdentifierSuffix struct {
+	UDFRevision uint16
+	DomainFlags uint8
+}
+
+func (e EntityID) DomainSuffix() DomainIdentifierSuffix {
+	return DomainIdentifierSuffix{
+		UDFRevision: rl_u16(e.IdentifierSuffix[0:]),
+		DomainFlags: e.IdentifierSuffix[2],
+	}
+}
+
+func (s DomainIdentifierSuffix) HardWriteProtect() bool {
+	return s.DomainFlags&DOMAIN_FLAG_HARD_WRITE_PROTECT != 0
+}
+
+func (s DomainIdentifierSuffix) SoftWriteProtect() bool {
+	return s.DomainFlags&DOMAIN_FLAG_SOFT_WRITE_PROTECT != 0
+}
+
+type UDFIdentifierSuffix struct {
+	UDFRevision  uint16
+	OSClass      uint8
+	OSIdentifier uint8
+}
+
+func (e EntityID) UDFSuffix() UDFIdentifierSuffix {
+	return UDFIdentifierSuffix{
+		UDFRevision:  rl_u16(e.IdentifierSuffix[0:]),
+		OSClass:      e.IdentifierSuffix[2],
+		OSIdentifier: e.IdentifierSuffix[3],
+	}
+}
+
+type ImplementationIdentifierSuffix struct {
+	OSClass           uint8
+	OSIdentifier      uint8
+	ImplementationUse [6]byte
+}
+
+func (e EntityID) ImplementationSuffix() ImplementationIdentifierSuffix {
+	s := ImplementationIdentifierSuffix{
+		OSClass:      e.IdentifierSuffix[0],
+		OSIdentifier: e.IdentifierSuffix[1],
+	}
+	copy(s.ImplementationUse[:], e.IdentifierSuffix[2:])
+	return s
+}
+
+// UDFRevisionString formats a BCD encoded UDF revision, e.g. 0x0201 as "2.01"
+func UDFRevisionString(revision uint16) string {
+	return fmt.Sprintf("%x.%02x", revision>>8, revision&0xff)
+}
+
+// OSName returns a readable name for an operating system class and identifier
+func OSName(osClass uint8, osIdentifier uint8) string {
+	name, ok := osClassNames[osClass]
+	if !ok {
+		return fmt.Sprintf("OS class %d, identifier %d", osClass, osIdentifier)
+	}
+	if ids, ok := osIdentifierNames[osClass]; ok {
+		if id, ok := ids[osIdentifier]; ok {
+			return name + " " + id
+		}
+		return fmt.Sprintf("%s identifier %d", name, osIdentifier)
+	}
+	return name
+}
+
+// String returns the identifier along with its decoded suffix
+func (e EntityID) String() string {
+	ident := e.IdentifierString()
+	switch {
+	case ident == "":
+		return ""
+	case e.IsDomain():
+		s := e.DomainSuffix()
+		desc := "UDF " + UDFRevisionString(s.UDFRevision)
+		if s.HardWriteProtect() {
+			desc += ", hard write-protect"
+		}
+		if s.SoftWriteProtect() {
+			desc += ", soft write-protect"
+		}
+		return fmt.Sprintf("%s (%s)", ident, desc)
+	case e.IsUDF():
+		s := e.UDFSuffix()
+		return fmt.Sprintf("%s (UDF %s, %s)", ident, UDFRevisionString(s.UDFRevision), OSName(s.OSClass, s.OSIdentifier))
+	case strings.HasPrefix(ident, "+"):
+		// ECMA registered identifiers such as "+NSR02" have no defined suffix
+		return ident
+	default:
+		s := e.ImplementationSuffix()
+		return fmt.Sprintf("%s (%s)", ident, OSName(s.OSClass, s.OSIdentifier))
+	}
+}
+
+// StructureEntityID is an EntityID along with the structure recording it
+type StructureEntityID struct {
+	Structure string
+	Field     string
+	EntityID  EntityID
+}
+
+// EntityIDs reports the identifiers recorded in the volume structures, which
+// tell the implementation that wrote each of them
+func (udf *Udf) EntityIDs() []StructureEntityID {
+	udf.init()
+	var ids []StructureEntityID
+	add := func(structure string, field string, e EntityID) {
+		if e.IdentifierString() != "" {
+			ids = append(ids, StructureEntityID{structure, field, e})
+		}
+	}
+	if udf.pvd != nil {
+		add("Primary Volume Descriptor", "Application", udf.pvd.ApplicationIdentifier)
+		add("Primary Volume Descriptor", "Implementation", udf.pvd.ImplementationIdentifier)
+	}
+	if udf.iuvd != nil {
+		add("Implementation Use Volume Descriptor", "Implementation", udf.iuvd.ImplementationIdentifier)
+		add("Implementation Use Volume Descriptor", "LV Info Implementation", udf.iuvd.LVInfoImplementationIdentifier)
+	}
+	for _, pd := range udf.partitionDescriptors() {
+		structure := fmt.Sprintf("Partition Descriptor %d", pd.PartitionNumber)
+		add(structure, "Partition Contents", pd.PartitionContents)
+		add(structure, "Implementation", pd.ImplementationIdentifier)
+	}
+	add("Logical Volume Descriptor", "Domain", udf.lvd.DomainIdentifier)
+	add("Logical Volume Descriptor", "Implementation", udf.lvd.ImplementationIdentifier)
+	if lvid := udf.LogicalVolumeIntegrity(); lvid != nil {
+		add("Logical Volume Integrity Descriptor", "Implementation", lvid.ImplementationIdentifier)
+	}
+	add("File Set Descriptor", "Domain", udf.fsd.DomainIdentifier)
+	add("Root Directory File Entry", "Implementation", udf.root_fe.GetImplementationIdentifier())
+	return ids
+}
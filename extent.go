@@ -9,6 +9,11 @@ type ExtentInterface interface {
 	HasExtended() bool
 }
 
+// ExtentLength returns the length of an extent without its type flags
+func ExtentLength(e ExtentInterface) uint32 {
+	return e.GetLength() &^ UDF_EXTENT_FLAG_MASK
+}
+
 type Extent struct {
 	Length   uint32
 	Location uint32
@@ -71,7 +76,7 @@ func (e ExtentSmall) IsNotRecorded() bool  {
 }
 
 func (e ExtentSmall) HasExtended() bool  {
-	return (e.Length >> 30) == 3
+	return (e.Length >> 14) == 3
 }
 
 func NewExtentSmall(b []byte) ExtentSmall {
@@ -1,8 +1,14 @@
 package udf
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -16,7 +22,13 @@ type File struct {
 
 // IsDir returns true if the entry is a directory or false otherwise
 func (f *File) IsDir() bool {
-	return f.FileEntry().GetICBTag().FileType == 4
+	fileType := f.FileType()
+	return fileType == FILE_TYPE_DIRECTORY || fileType == FILE_TYPE_STREAM_DIRECTORY
+}
+
+// FileType returns the ECMA-167 file type recorded in the entry's ICB tag
+func (f *File) FileType() uint8 {
+	return f.FileEntry().GetICBTag().FileType
 }
 
 // ModTime returns the entry's recording time
@@ -33,18 +45,181 @@ func (f *File) Mode() os.FileMode {
 	mode |= ((perms >> 5) & 7) << 3
 	mode |= ((perms >> 10) & 7) << 6
 
-	if f.IsDir() {
+	switch f.FileType() {
+	case FILE_TYPE_DIRECTORY, FILE_TYPE_STREAM_DIRECTORY:
 		mode |= os.ModeDir
+	case FILE_TYPE_BLOCK_DEVICE:
+		mode |= os.ModeDevice
+	case FILE_TYPE_CHARACTER_DEVICE:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case FILE_TYPE_FIFO:
+		mode |= os.ModeNamedPipe
+	case FILE_TYPE_SOCKET:
+		mode |= os.ModeSocket
+	case FILE_TYPE_SYMLINK:
+		mode |= os.ModeSymlink
+	}
+
+	flags := f.FileEntry().GetICBTag().Flags
+	if flags&ICB_FLAG_SETUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if flags&ICB_FLAG_SETGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if flags&ICB_FLAG_STICKY != 0 {
+		mode |= os.ModeSticky
 	}
 
 	return mode
 }
 
-// Name returns the base name of the given entry
+// Device returns the major and minor device numbers of a block or character
+// device, as recorded in its Device Specification extended attribute
+func (f *File) Device() (major uint32, minor uint32, ok bool) {
+	fileType := f.FileType()
+	if fileType != FILE_TYPE_BLOCK_DEVICE && fileType != FILE_TYPE_CHARACTER_DEVICE {
+		return
+	}
+	attrs, _ := f.ExtendedAttributes()
+	ds := attrs.DeviceSpecification()
+	if ds == nil {
+		return
+	}
+	return ds.MajorDeviceIdentification, ds.MinorDeviceIdentification, true
+}
+
+// Readlink returns the target of a symbolic link, decoded from its path components
+func (f *File) Readlink() (string, error) {
+	if f.FileType() != FILE_TYPE_SYMLINK {
+		return "", errors.New("not a symbolic link")
+	}
+	data, err := ioutil.ReadAll(f.NewReader())
+	if err != nil {
+		return "", err
+	}
+	return r_pathComponents(data)
+}
+
+// r_pathComponents decodes a sequence of Path Components (ECMA-167 4/14.16)
+func r_pathComponents(b []byte) (string, error) {
+	var parts []string
+	absolute := false
+	for off := 0; off < len(b); {
+		if off+4 > len(b) {
+			return "", errors.New("truncated path component")
+		}
+		componentType := b[off]
+		identLen := int(b[off+1])
+		if off+4+identLen > len(b) {
+			return "", errors.New("truncated path component")
+		}
+		ident := b[off+4 : off+4+identLen]
+		switch componentType {
+		case 1, 2:
+			absolute = true
+			parts = parts[:0]
+		case 3:
+			parts = append(parts, "..")
+		case 4:
+			parts = append(parts, ".")
+		case 5:
+			parts = append(parts, r_dcharacters(ident))
+		default:
+			return "", errors.New("invalid path component type")
+		}
+		off += 4 + identLen
+	}
+	target := strings.Join(parts, "/")
+	if absolute {
+		target = path.Join("/", target)
+	}
+	return target, nil
+}
+
+// w_pathComponents encodes a path as a sequence of Path Components
+func w_pathComponents(target string) (b []byte) {
+	if strings.HasPrefix(target, "/") {
+		b = append(b, 2, 0, 0, 0)
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "":
+		case ".":
+			b = append(b, 4, 0, 0, 0)
+		case "..":
+			b = append(b, 3, 0, 0, 0)
+		default:
+			ident := w_dcharacters(part)
+			b = append(b, 5, uint8(len(ident)), 0, 0)
+			b = append(b, ident...)
+		}
+	}
+	return
+}
+
+// Name returns the base name of the given entry, ".." for the parent entry
 func (f *File) Name() string {
+	if f.IsParent() && f.Fid.FileIdentifier == "" {
+		return ".."
+	}
 	return f.Fid.FileIdentifier
 }
 
+// Characteristics returns the FILE_CHARACTERISTIC_* flags of the directory entry
+func (f *File) Characteristics() uint8 {
+	return f.Fid.FileCharacteristics
+}
+
+func (f *File) IsHidden() bool {
+	return f.Fid.FileCharacteristics&FILE_CHARACTERISTIC_HIDDEN != 0
+}
+
+func (f *File) IsDeleted() bool {
+	return f.Fid.FileCharacteristics&FILE_CHARACTERISTIC_DELETED != 0
+}
+
+func (f *File) IsParent() bool {
+	return f.Fid.FileCharacteristics&FILE_CHARACTERISTIC_PARENT != 0
+}
+
+func (f *File) IsMetadata() bool {
+	return f.Fid.FileCharacteristics&FILE_CHARACTERISTIC_METADATA != 0
+}
+
+// ValidFileEntry returns true if the entry's file entry has a valid tag,
+// recorded at the location it claims, which is worth checking before
+// reading a deleted entry whose blocks may have been reused
+func (f *File) ValidFileEntry() bool {
+	icb := f.Fid.ICB
+	if icb.GetLength() == 0 && icb.GetLocation() == 0 {
+		return false
+	}
+	// Check the tag before parsing, as reused blocks may hold anything
+	if int(icb.GetPartition()) >= len(f.Udf.lvd.PartitionMaps) {
+		return false
+	}
+	sector, ok := f.Udf.partition(icb.GetPartition()).Sector(icb.GetLocation())
+	if !ok {
+		return false
+	}
+	b := make([]byte, f.Udf.SECTOR_SIZE)
+	if n, _ := f.Udf.r.ReadAt(b, int64(sector*f.Udf.SECTOR_SIZE)); n < len(b) {
+		return false
+	}
+	desc := NewDescriptor(b)
+	if (desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY) ||
+		!desc.Valid() || uint64(desc.TagLocation) != icb.GetLocation() {
+		return false
+	}
+	fe, position := f.recordedFileEntry()
+	desc = fe.GetDescriptor()
+	if desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY {
+		return false
+	}
+	return desc.Valid() && uint64(desc.TagLocation) == position
+}
+
 // Size returns the size in bytes of the extent occupied by the file or directory
 func (f *File) Size() int64 {
 	return int64(f.FileEntry().GetInformationLength())
@@ -59,42 +234,274 @@ func (f *File) ReadDir() []File {
 	return f.Udf.ReadDir(f.FileEntry())
 }
 
+// ReadDirAll returns the children entries in case of a directory, including
+// the hidden, deleted, parent or metadata ones selected by show
+func (f *File) ReadDirAll(show uint8) []File {
+	return f.Udf.ReadDirAll(f.FileEntry(), show)
+}
+
 func (f *File) GetFileEntryPosition() int64 {
 	return int64(f.fileEntryPosition)
 }
 
+// FileEntry returns the entry's file entry. A deleted entry whose file
+// entry does not validate gets an empty one, so that its mode, size and
+// times read as zero rather than from whatever reused its block.
 func (f *File) FileEntry() FileEntryInterface {
 	if f.fe == nil {
-		f.fileEntryPosition = uint64(f.Fid.ICB.GetLocation())
-		meta := f.Udf.LogicalPartitionStart(f.Fid.ICB.GetPartition())
-		f.fe = NewFileEntry(f.Fid.ICB.GetPartition(), f.Udf.ReadSector(meta+f.fileEntryPosition))
+		if f.IsDeleted() && !f.ValidFileEntry() {
+			f.fe = &FileEntry{ICBTag: &ICBTag{}, Partition: f.Fid.ICB.GetPartition()}
+		} else {
+			f.fe, f.fileEntryPosition = f.recordedFileEntry()
+		}
 	}
 	return f.fe
 }
 
-func (f *File) getReaders(descs []ExtentInterface, filePos int64) (readers []*sectionReader, finalFilePos int64) {
-	finalFilePos = filePos
-	for i := 0; i < len(descs); i++ {
-		if descs[i].HasExtended() {
-			extendData := f.Udf.ReadSector(f.Udf.LogicalPartitionStart(descs[i].GetPartition()) + descs[i].GetLocation())
+// recordedFileEntry reads the last file entry of the entry's ICB hierarchy,
+// along with its block
+func (f *File) recordedFileEntry() (FileEntryInterface, uint64) {
+	entries := f.Udf.readICBHierarchy(f.Fid.ICB)
+	current := entries[len(entries)-1]
+	return current.fe, uint64(current.location.LogicalBlockNumber)
+}
+
+// Versions returns the entry's earlier recorded states, oldest first, as kept
+// by strategy 4096 ICB hierarchies on write-once media
+func (f *File) Versions() []File {
+	entries := f.Udf.readICBHierarchy(f.Fid.ICB)
+	versions := make([]File, 0, len(entries)-1)
+	for _, entry := range entries[:len(entries)-1] {
+		versions = append(versions, File{
+			Udf:               f.Udf,
+			Fid:               f.Fid,
+			fe:                entry.fe,
+			fileEntryPosition: uint64(entry.location.LogicalBlockNumber),
+		})
+	}
+	return versions
+}
+
+// ExtendedAttributes returns the entry's extended attributes, both those
+// embedded in its file entry and those recorded in its extended attribute file
+func (f *File) ExtendedAttributes() (ExtendedAttributes, error) {
+	return f.Udf.ExtendedAttributes(f.FileEntry())
+}
+
+func (udf *Udf) ExtendedAttributes(fe FileEntryInterface) (ExtendedAttributes, error) {
+	attrs, err := NewExtendedAttributes(fe.GetExtendedAttributes())
+	if err != nil {
+		return attrs, err
+	}
+	eaICB := fe.GetExtendedAttributeICB()
+	if eaICB.GetLength() == 0 {
+		return attrs, nil
+	}
+	eaFe := udf.readFileEntry(eaICB)
+	if eaFe == nil || eaFe.GetICBTag().FileType != FILE_TYPE_EXTENDED_ATTRIBUTES {
+		return attrs, errors.New("invalid extended attribute file")
+	}
+	data, err := ioutil.ReadAll(udf.NewFileEntryReader(eaFe))
+	if err != nil {
+		return attrs, err
+	}
+	fileAttrs, err := NewExtendedAttributes(data)
+	return append(attrs, fileAttrs...), err
+}
+
+// adPartition returns the partition an allocation descriptor refers to: short
+// descriptors are relative to the partition recording the file entry
+func adPartition(fe FileEntryInterface, desc ExtentInterface) uint16 {
+	if _, ok := desc.(Extent); ok {
+		return fe.GetPartition()
+	}
+	return desc.GetPartition()
+}
+
+// walkAllocationDescriptors calls fn for every allocation descriptor of the
+// list, descending into allocation extent descriptors, which are reported
+// with aed set before the descriptors they hold
+func (udf *Udf) walkAllocationDescriptors(fe FileEntryInterface, descs []ExtentInterface, fn func(desc ExtentInterface, partition uint16, aed bool)) {
+	visited := make(map[uint64]bool)
+	var walk func(descs []ExtentInterface)
+	walk = func(descs []ExtentInterface) {
+		for _, desc := range descs {
+			partition := adPartition(fe, desc)
+			if !desc.HasExtended() {
+				fn(desc, partition, false)
+				continue
+			}
+			sector := udf.sectorOf(partition, desc.GetLocation())
+			if visited[sector] {
+				continue
+			}
+			visited[sector] = true
+			fn(desc, partition, true)
+			extendData := udf.ReadSector(sector)
 			aed := new(AED).FromBytes(extendData)
-			var subReaders []*sectionReader
-			subReaders, finalFilePos = f.getReaders(GetAllocationDescriptors(f.FileEntry().GetICBTag().AllocationType, extendData[24:], aed.LengthOfAllocationDescriptors), finalFilePos)
-			readers = append(readers, subReaders...)
-		} else if !descs[i].IsNotRecorded() {
-			readers = append(readers, newSectionReader(finalFilePos, f.Udf.r, int64(f.Udf.SECTOR_SIZE)*int64(f.Udf.LogicalPartitionStart(descs[i].GetPartition())+descs[i].GetLocation()), int64(descs[i].GetLength())))
+			walk(GetAllocationDescriptors(fe.GetICBTag().AllocationType, extendData[24:], aed.LengthOfAllocationDescriptors))
 		}
-		finalFilePos += int64(descs[i].GetLength())
 	}
+	walk(descs)
+}
+
+func (udf *Udf) getReaders(fe FileEntryInterface, descs []ExtentInterface, filePos int64) (readers []*sectionReader, finalFilePos int64) {
+	finalFilePos = filePos
+	udf.walkAllocationDescriptors(fe, descs, func(desc ExtentInterface, partition uint16, aed bool) {
+		if aed {
+			return
+		}
+		length := int64(ExtentLength(desc))
+		if !desc.IsNotRecorded() {
+			// Consecutive blocks need not be recorded consecutively
+			p := udf.partition(partition)
+			sectorSize := int64(udf.SECTOR_SIZE)
+			for off := int64(0); off < length; {
+				block := desc.GetLocation() + uint64(off/sectorSize)
+				sector, count, ok := p.run(block, uint64((length-off+sectorSize-1)/sectorSize))
+				if !ok {
+					panic(fmt.Errorf("block %d of partition %d is not recorded", block, partition))
+				}
+				n := length - off
+				if n > int64(count)*sectorSize {
+					n = int64(count) * sectorSize
+				}
+				readers = append(readers, newSectionReader(finalFilePos+off, udf.r, sectorSize*int64(sector), n))
+				off += n
+			}
+		}
+		finalFilePos += length
+	})
 	return
 }
 
-func (f *File) NewReader() *MultiSectionReader {
-	descs := f.FileEntry().GetAllocationDescriptors()
-	readers, _ := f.getReaders(descs, 0)
+// NewFileEntryReader returns a reader over the data described by a file entry
+func (udf *Udf) NewFileEntryReader(fe FileEntryInterface) *MultiSectionReader {
+	if fe.GetICBTag().AllocationType == Embedded {
+		data := fe.GetEmbeddedData()
+		if uint64(len(data)) > fe.GetInformationLength() {
+			data = data[:fe.GetInformationLength()]
+		}
+		return newMultiSectionReader([]*sectionReader{newSectionReader(0, bytes.NewReader(data), 0, int64(len(data)))})
+	}
+	readers, _ := udf.getReaders(fe, fe.GetAllocationDescriptors(), 0)
 	return newMultiSectionReader(readers)
 }
 
+// NewReader returns a reader over the entry's data; deleted entries read as
+// empty unless their file entry still validates. On damaged images, reads
+// of an entry whose file entry was lost fail with ErrDamagedFileEntry.
+func (f *File) NewReader() *MultiSectionReader {
+	if f.IsDeleted() && !f.ValidFileEntry() {
+		return newMultiSectionReader(nil)
+	}
+	if f.Udf.damage != nil && !f.ValidFileEntry() {
+		return &MultiSectionReader{err: ErrDamagedFileEntry}
+	}
+	return f.Udf.NewFileEntryReader(f.FileEntry())
+}
+
+// FileExtent is a run of the data of a file recorded in consecutive sectors
+// of the image, as listed by File.Extents
+type FileExtent struct {
+	// Offset is the position of the run in the file
+	Offset int64
+	Length int64
+	// ImageOffset is the position of the run in the image, -1 if its data
+	// is not recorded
+	ImageOffset int64
+	Partition   uint16
+	// Block is the logical block of the partition the run starts at
+	Block     uint32
+	Recorded  bool
+	Allocated bool
+	// Embedded is set for data recorded in the file entry itself
+	Embedded bool
+	// FromAED is set for runs listed in an allocation extent descriptor
+	// rather than in the file entry
+	FromAED bool
+}
+
+// Extents maps the data of the entry to the image: an allocation
+// descriptor whose blocks are not recorded consecutively, as in virtual or
+// sparable partitions, is split in several runs
+func (f *File) Extents() (extents []FileExtent) {
+	if f.IsDeleted() && !f.ValidFileEntry() {
+		return nil
+	}
+	udf := f.Udf
+	fe := f.FileEntry()
+	if fe.GetICBTag().AllocationType == Embedded {
+		length := uint64(len(fe.GetEmbeddedData()))
+		if length > fe.GetInformationLength() {
+			length = fe.GetInformationLength()
+		}
+		if length == 0 {
+			return nil
+		}
+		location := LbAddr{uint32(f.fileEntryPosition), f.Fid.ICB.GetPartition()}
+		sector := udf.sectorOf(location.PartitionReferenceNumber, uint64(location.LogicalBlockNumber))
+		return []FileExtent{{
+			Length:      int64(length),
+			ImageOffset: int64(sector*udf.SECTOR_SIZE) + int64(entryHeaderLength(fe)+len(fe.GetExtendedAttributes())),
+			Partition:   location.PartitionReferenceNumber,
+			Block:       location.LogicalBlockNumber,
+			Recorded:    true,
+			Allocated:   true,
+			Embedded:    true,
+		}}
+	}
+
+	var offset int64
+	fromAED := false
+	udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		// Extension descriptors come last, so every descriptor after
+		// the first one comes from an allocation extent descriptor
+		if aed {
+			fromAED = true
+			return
+		}
+		length := int64(ExtentLength(desc))
+		extent := FileExtent{
+			Offset:      offset,
+			Length:      length,
+			ImageOffset: -1,
+			Partition:   partition,
+			Block:       uint32(desc.GetLocation()),
+			Recorded:    !desc.IsNotRecorded(),
+			Allocated:   desc.GetLength()&UDF_EXTENT_FLAG_MASK != EXT_NOT_RECORDED_NOT_ALLOCATED,
+			FromAED:     fromAED,
+		}
+		offset += length
+		if !extent.Recorded {
+			extents = append(extents, extent)
+			return
+		}
+		p := udf.partition(partition)
+		sectorSize := int64(udf.SECTOR_SIZE)
+		for off := int64(0); off < length; {
+			block := desc.GetLocation() + uint64(off/sectorSize)
+			run := extent
+			run.Offset += off
+			run.Block = uint32(block)
+			sector, count, ok := p.run(block, uint64((length-off+sectorSize-1)/sectorSize))
+			if !ok {
+				// Unmapped blocks are reported one at a time
+				count = 1
+			} else {
+				run.ImageOffset = int64(sector) * sectorSize
+			}
+			run.Length = length - off
+			if run.Length > int64(count)*sectorSize {
+				run.Length = int64(count) * sectorSize
+			}
+			extents = append(extents, run)
+			off += run.Length
+		}
+	})
+	return
+}
+
 type sectionReader struct {
 	*io.SectionReader
 	start int64
@@ -114,6 +521,8 @@ type MultiSectionReader struct {
 	pos     int64
 	size    int64
 	index   int
+	// err is returned by every read of data that cannot be found
+	err error
 }
 
 func newMultiSectionReader(readers []*sectionReader) *MultiSectionReader {
@@ -146,6 +555,9 @@ func (r *MultiSectionReader) actualRead(p []byte) (n int, err error) {
 }
 
 func (r *MultiSectionReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	if r.index > len(r.readers)-1 {
 		return 0, io.EOF
 	}
@@ -176,6 +588,9 @@ func (r *MultiSectionReader) Seek(offset int64, whence int) (n int64, err error)
 }
 
 func (r *MultiSectionReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	var read int
 	err = os.ErrNotExist // No readers
 	for _, reader := range r.readers {
@@ -0,0 +1,80 @@
+package udf
+
+import (
+	"sort"
+)
+
+// readFileSets reads the File Set Descriptor sequence starting at the
+// logical volume contents use location, following Next Extent links
+func (udf *Udf) readFileSets() (fsds []*FileSetDescriptor) {
+	extent := udf.lvd.LogicalVolumeContentsUse
+	visited := make(map[LbAddr]bool)
+	for !visited[extent.Location] {
+		visited[extent.Location] = true
+		sectors := (uint64(extent.GetLength()) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+		if sectors == 0 {
+			sectors = 1
+		}
+		next := ExtentLong{}
+		for i := uint64(0); i < sectors; i++ {
+			if !udf.isMapped(extent.GetPartition(), extent.GetLocation()+i) {
+				return
+			}
+			desc := NewDescriptor(udf.ReadSector(udf.sectorOf(extent.GetPartition(), extent.GetLocation()+i)))
+			if desc.TagIdentifier != DESCRIPTOR_FILE_SET || desc.TagChecksum != desc.Checksum() {
+				// Terminating Descriptor or unrecorded block
+				return
+			}
+			fsd := desc.FileSetDescriptor()
+			fsds = append(fsds, fsd)
+			if fsd.NexExtent.GetLength() > 0 {
+				next = fsd.NexExtent
+				break
+			}
+		}
+		if next.GetLength() == 0 {
+			return
+		}
+		extent = next
+	}
+	return
+}
+
+// prevailingFileSets keeps, for every file set number, the descriptor with
+// the highest File Set Descriptor Number, ordered by file set number
+func prevailingFileSets(fsds []*FileSetDescriptor) []*FileSetDescriptor {
+	prevailing := make(map[uint32]*FileSetDescriptor)
+	for _, fsd := range fsds {
+		if cur, ok := prevailing[fsd.FileSetNumber]; !ok || fsd.FileSetDescriptorNumber >= cur.FileSetDescriptorNumber {
+			prevailing[fsd.FileSetNumber] = fsd
+		}
+	}
+	result := make([]*FileSetDescriptor, 0, len(prevailing))
+	for _, fsd := range prevailing {
+		result = append(result, fsd)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FileSetNumber < result[j].FileSetNumber
+	})
+	return result
+}
+
+// FileSets returns the prevailing descriptor of every file set recorded in
+// the logical volume, ordered by file set number
+func (udf *Udf) FileSets() []*FileSetDescriptor {
+	udf.init()
+	return udf.fileSets
+}
+
+// FileSet returns the prevailing descriptor of the file set used by ReadDir,
+// i.e. the one with the lowest file set number
+func (udf *Udf) FileSet() *FileSetDescriptor {
+	udf.init()
+	return udf.fsd
+}
+
+// FileSetRoot returns the root directory of the given file set, to be listed
+// with ReadDir
+func (udf *Udf) FileSetRoot(fsd *FileSetDescriptor) FileEntryInterface {
+	return udf.readFileEntry(fsd.RootDirectoryICB)
+}
@@ -0,0 +1,450 @@
+package udf
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Checks reported by Fsck
+const (
+	FSCK_BAD_FILE_ENTRY         = "bad-file-entry"
+	FSCK_BAD_SPACE_BITMAP       = "bad-space-bitmap"
+	FSCK_EXTENT_OUT_OF_BOUNDS   = "extent-out-of-bounds"
+	FSCK_CROSS_LINKED_EXTENT    = "cross-linked-extent"
+	FSCK_BLOCKS_RECORDED        = "blocks-recorded-mismatch"
+	FSCK_LINK_COUNT             = "link-count-mismatch"
+	FSCK_UNIQUE_ID_COLLISION    = "unique-id-collision"
+	FSCK_USED_BLOCK_FREE        = "used-block-marked-free"
+	FSCK_UNUSED_BLOCK_ALLOCATED = "unused-block-marked-allocated"
+	FSCK_LVID_FILE_COUNT        = "lvid-file-count-mismatch"
+	FSCK_LVID_DIRECTORY_COUNT   = "lvid-directory-count-mismatch"
+	FSCK_BAD_PARENT             = "bad-parent-pointer"
+)
+
+// Severities of the problems reported by Fsck
+const (
+	FSCK_ERROR   = "error"
+	FSCK_WARNING = "warning"
+)
+
+// FsckProblem is an inconsistency found by Fsck
+type FsckProblem struct {
+	Check    string
+	Severity string
+	Path     string
+	Message  string
+}
+
+type fsckEntry struct {
+	fe       FileEntryInterface
+	location LbAddr
+	path     string
+	isDir    bool
+	isStream bool
+	links    int
+}
+
+type fsckExtent struct {
+	start uint64
+	end   uint64
+	owner string
+	// kind is one of the SECTOR_* constants, and offset the position of
+	// the extent in the file data
+	kind   string
+	offset int64
+}
+
+type fsck struct {
+	udf      *Udf
+	problems []FsckProblem
+	entries  map[LbAddr]*fsckEntry
+	order    []*fsckEntry
+	extents  []fsckExtent
+}
+
+func (c *fsck) report(check string, severity string, path string, format string, args ...interface{}) {
+	c.problems = append(c.problems, FsckProblem{check, severity, path, fmt.Sprintf(format, args...)})
+}
+
+// Fsck walks the whole volume and reports its inconsistencies, without
+// changing anything. An empty list means the volume checked clean.
+func (udf *Udf) Fsck() []FsckProblem {
+	udf.init()
+	c := &fsck{
+		udf:     udf,
+		entries: make(map[LbAddr]*fsckEntry),
+	}
+	for _, fsd := range udf.fileSets {
+		c.addFileSet(fsd)
+	}
+	c.checkLinkCounts()
+	c.checkUniqueIDs()
+	c.checkCrossLinks()
+	c.checkSpaceBitmaps()
+	c.checkIntegrityCounts()
+	return c.problems
+}
+
+// partitionBlocks returns the number of blocks addressable in a partition
+func (udf *Udf) partitionBlocks(partition uint16) uint64 {
+	if int(partition) >= len(udf.lvd.PartitionMaps) {
+		return 0
+	}
+	if vat, ok := udf.vat[partition]; ok {
+		return uint64(len(vat.Entries))
+	}
+	pMap := udf.lvd.PartitionMaps[partition]
+	pd, ok := udf.mapDescriptor(&pMap)
+	if !ok {
+		return 0
+	}
+	end := uint64(pd.PartitionStartingLocation) + uint64(pd.PartitionLength)
+	if end < uint64(pMap.PartitionStart) {
+		return 0
+	}
+	return end - uint64(pMap.PartitionStart)
+}
+
+// addExtent records blocks used by the given owner, checking they fall
+// within their partition
+func (c *fsck) addExtent(owner string, kind string, offset int64, partition uint16, location uint64, length uint64) {
+	blocks := (length + c.udf.SECTOR_SIZE - 1) / c.udf.SECTOR_SIZE
+	if blocks == 0 {
+		return
+	}
+	if int(partition) >= len(c.udf.lvd.PartitionMaps) || location+blocks > c.udf.partitionBlocks(partition) {
+		c.report(FSCK_EXTENT_OUT_OF_BOUNDS, FSCK_ERROR, owner, "extent of %d blocks at %d is outside partition %d", blocks, location, partition)
+		return
+	}
+	p := c.udf.partition(partition)
+	for block := location; block < location+blocks; {
+		start, count, ok := p.run(block, location+blocks-block)
+		if !ok {
+			c.report(FSCK_EXTENT_OUT_OF_BOUNDS, FSCK_ERROR, owner, "block %d of partition %d is not mapped", block, partition)
+			block++
+			continue
+		}
+		c.extents = append(c.extents, fsckExtent{start, start + count, owner, kind, offset + int64((block-location)*c.udf.SECTOR_SIZE)})
+		block += count
+	}
+}
+
+func (c *fsck) addFileSet(fsd *FileSetDescriptor) {
+	root := c.addEntry(fsd.RootDirectoryICB, "/", false)
+	if root == nil {
+		return
+	}
+	// The root directory's parent entry identifies the root itself
+	c.walkDir(root, &root.location)
+	if streams := fsd.SystemStreamDirectoryICB; streams.GetLength() > 0 {
+		if dir := c.addEntry(streams, "/:system", true); dir != nil {
+			c.walkDir(dir, nil)
+		}
+	}
+}
+
+// addEntry reads and checks the file entry recorded at an ICB, the first
+// time it is referenced
+func (c *fsck) addEntry(icb ExtentLong, entryPath string, isStream bool) *fsckEntry {
+	if entry, ok := c.entries[icb.Location]; ok {
+		return entry
+	}
+	if int(icb.GetPartition()) >= len(c.udf.lvd.PartitionMaps) || icb.GetLocation() >= c.udf.partitionBlocks(icb.GetPartition()) {
+		c.report(FSCK_EXTENT_OUT_OF_BOUNDS, FSCK_ERROR, entryPath, "ICB at %d is outside partition %d", icb.GetLocation(), icb.GetPartition())
+		return nil
+	}
+	entries := c.udf.readICBHierarchy(icb)
+	current := entries[len(entries)-1]
+	desc := current.fe.GetDescriptor()
+	if (desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY) ||
+		!desc.Valid() || desc.TagLocation != current.location.LogicalBlockNumber {
+		c.report(FSCK_BAD_FILE_ENTRY, FSCK_ERROR, entryPath, "invalid file entry at block %d of partition %d", current.location.LogicalBlockNumber, current.location.PartitionReferenceNumber)
+		if c.udf.damage != nil {
+			// The entry lost in a bad range still belongs to the file
+			for _, e := range entries {
+				c.addExtent(entryPath, SECTOR_FILE_ENTRY, 0, e.location.PartitionReferenceNumber, uint64(e.location.LogicalBlockNumber), c.udf.SECTOR_SIZE)
+			}
+		}
+		return nil
+	}
+	fileType := current.fe.GetICBTag().FileType
+	entry := &fsckEntry{
+		fe:       current.fe,
+		location: icb.Location,
+		path:     entryPath,
+		isDir:    fileType == FILE_TYPE_DIRECTORY || fileType == FILE_TYPE_STREAM_DIRECTORY,
+		isStream: isStream,
+	}
+	c.entries[icb.Location] = entry
+	c.order = append(c.order, entry)
+
+	for _, e := range entries {
+		c.addExtent(entryPath, SECTOR_FILE_ENTRY, 0, e.location.PartitionReferenceNumber, uint64(e.location.LogicalBlockNumber), c.udf.SECTOR_SIZE)
+	}
+	c.addAllocation(entry)
+	if eaICB := entry.fe.GetExtendedAttributeICB(); eaICB.GetLength() > 0 {
+		if ea := c.addEntry(eaICB, entryPath+":ea", true); ea != nil {
+			ea.links++
+		}
+	}
+	if streams := entry.fe.GetStreamDirectoryICB(); streams.GetLength() > 0 {
+		if dir := c.addEntry(streams, entryPath+":", true); dir != nil {
+			c.walkDir(dir, &entry.location)
+		}
+	}
+	return entry
+}
+
+// addAllocation records the blocks of a file's data and allocation extent
+// descriptors, and checks the recorded block count against them
+func (c *fsck) addAllocation(entry *fsckEntry) {
+	fe := entry.fe
+	if fe.GetICBTag().AllocationType == Embedded {
+		return
+	}
+	kind := SECTOR_FILE_DATA
+	if entry.isDir {
+		kind = SECTOR_DIRECTORY_DATA
+	}
+	var recorded uint64
+	var offset int64
+	c.udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		length := uint64(ExtentLength(desc))
+		if aed {
+			c.addExtent(entry.path, SECTOR_ALLOCATION_EXTENT, 0, partition, desc.GetLocation(), length)
+			return
+		}
+		offset += int64(length)
+		if desc.GetLength()&UDF_EXTENT_FLAG_MASK == EXT_NOT_RECORDED_NOT_ALLOCATED {
+			return
+		}
+		c.addExtent(entry.path, kind, offset-int64(length), partition, desc.GetLocation(), length)
+		if !desc.IsNotRecorded() {
+			recorded += (length + c.udf.SECTOR_SIZE - 1) / c.udf.SECTOR_SIZE
+		}
+	})
+	if blocksRecorded := fe.GetLogicalBlocksRecorded(); blocksRecorded != recorded {
+		c.report(FSCK_BLOCKS_RECORDED, FSCK_ERROR, entry.path, "file entry records %d blocks, its extents hold %d", blocksRecorded, recorded)
+	}
+}
+
+// walkDir checks the entries of a directory, whose parent entry must
+// identify the given location, if any
+func (c *fsck) walkDir(dir *fsckEntry, parent *LbAddr) {
+	for _, f := range c.udf.ReadDirAll(dir.fe, FILE_CHARACTERISTIC_HIDDEN|FILE_CHARACTERISTIC_METADATA|FILE_CHARACTERISTIC_PARENT) {
+		if f.IsParent() {
+			if parent != nil && f.Fid.ICB.Location != *parent {
+				c.report(FSCK_BAD_PARENT, FSCK_ERROR, dir.path, "parent entry points to block %d of partition %d instead of block %d of partition %d",
+					f.Fid.ICB.Location.LogicalBlockNumber, f.Fid.ICB.Location.PartitionReferenceNumber, parent.LogicalBlockNumber, parent.PartitionReferenceNumber)
+			}
+			if target, ok := c.entries[f.Fid.ICB.Location]; ok && !dir.isStream {
+				target.links++
+			}
+			continue
+		}
+		childPath := path.Join(dir.path, f.Fid.FileIdentifier)
+		if dir.isStream {
+			childPath = dir.path + f.Fid.FileIdentifier
+		}
+		_, seen := c.entries[f.Fid.ICB.Location]
+		child := c.addEntry(f.Fid.ICB, childPath, dir.isStream)
+		if child == nil {
+			continue
+		}
+		child.links++
+		if !seen && child.isDir && !dir.isStream {
+			c.walkDir(child, &dir.location)
+		}
+	}
+}
+
+func (c *fsck) checkLinkCounts() {
+	for _, entry := range c.order {
+		if entry.isStream {
+			continue
+		}
+		if linkCount := int(entry.fe.GetFileLinkCount()); linkCount != entry.links {
+			c.report(FSCK_LINK_COUNT, FSCK_ERROR, entry.path, "file link count is %d, %d identifiers reference it", linkCount, entry.links)
+		}
+	}
+}
+
+func (c *fsck) checkUniqueIDs() {
+	seen := make(map[uint64]*fsckEntry)
+	for _, entry := range c.order {
+		id := entry.fe.GetUniqueID()
+		if id == 0 {
+			continue
+		}
+		if other, ok := seen[id]; ok {
+			c.report(FSCK_UNIQUE_ID_COLLISION, FSCK_ERROR, entry.path, "unique ID %d is also used by %s", id, other.path)
+			continue
+		}
+		seen[id] = entry
+	}
+}
+
+func (c *fsck) checkCrossLinks() {
+	sort.Slice(c.extents, func(i, j int) bool { return c.extents[i].start < c.extents[j].start })
+	var last *fsckExtent
+	for i := range c.extents {
+		ext := &c.extents[i]
+		if last != nil && ext.start < last.end {
+			if ext.owner != last.owner {
+				c.report(FSCK_CROSS_LINKED_EXTENT, FSCK_ERROR, ext.owner, "sectors %d-%d are also used by %s", ext.start, minUint64(ext.end, last.end)-1, last.owner)
+			}
+			if ext.end <= last.end {
+				continue
+			}
+		}
+		last = ext
+	}
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// checkSpaceBitmaps compares the unallocated space bitmaps against the
+// blocks used by the file sets and the file system structures
+func (c *fsck) checkSpaceBitmaps() {
+	for _, pd := range c.udf.partitionDescriptors() {
+		phd := pd.PartitionHeaderDescriptor()
+		bitmapExtent := phd.UnallocatedSpaceBitmap
+		if ExtentLength(bitmapExtent) == 0 {
+			continue
+		}
+		start := uint64(pd.PartitionStartingLocation)
+		bitmapSectors := (uint64(ExtentLength(bitmapExtent)) + c.udf.SECTOR_SIZE - 1) / c.udf.SECTOR_SIZE
+		sbd := NewSpaceBitmapDescriptor(c.udf.ReadSectors(start+uint64(bitmapExtent.Location), bitmapSectors))
+		if sbd.Descriptor.TagIdentifier != DESCRIPTOR_SPACE_BITMAP {
+			c.report(FSCK_BAD_SPACE_BITMAP, FSCK_ERROR, "", "missing space bitmap of partition %d", pd.PartitionNumber)
+			continue
+		}
+
+		used := make([]bool, pd.PartitionLength)
+		mark := func(from uint64, to uint64) {
+			for sector := from; sector < to; sector++ {
+				if sector >= start && sector-start < uint64(len(used)) {
+					used[sector-start] = true
+				}
+			}
+		}
+		for _, ext := range c.extents {
+			mark(ext.start, ext.end)
+		}
+		mark(start+uint64(bitmapExtent.Location), start+uint64(bitmapExtent.Location)+bitmapSectors)
+		c.markFileSets(mark)
+		c.markMetadataFiles(pd, mark)
+
+		var leaked uint64
+		for block := 0; block < len(used); block++ {
+			if !used[block] {
+				if !sbd.IsFree(uint32(block)) {
+					leaked++
+				}
+				continue
+			}
+			// Report runs of used blocks marked free at once
+			run := block
+			for run < len(used) && used[run] && sbd.IsFree(uint32(run)) {
+				run++
+			}
+			if run > block {
+				c.report(FSCK_USED_BLOCK_FREE, FSCK_ERROR, "", "blocks %d-%d of partition %d are in use but marked free", block, run-1, pd.PartitionNumber)
+				block = run - 1
+			}
+		}
+		if leaked > 0 {
+			c.report(FSCK_UNUSED_BLOCK_ALLOCATED, FSCK_WARNING, "", "%d blocks of partition %d are marked allocated but unused", leaked, pd.PartitionNumber)
+		}
+	}
+}
+
+// markFileSets marks the blocks of the file set descriptor sequence
+func (c *fsck) markFileSets(mark func(from uint64, to uint64)) {
+	fsdExtent := c.udf.lvd.LogicalVolumeContentsUse
+	blocks := (uint64(ExtentLength(fsdExtent)) + c.udf.SECTOR_SIZE - 1) / c.udf.SECTOR_SIZE
+	// The sequence is closed by a Terminating Descriptor
+	blocks = maxUint64(blocks, uint64(len(c.udf.fileSets))+1)
+	for block := fsdExtent.GetLocation(); block < fsdExtent.GetLocation()+blocks; block++ {
+		if c.udf.isMapped(fsdExtent.GetPartition(), block) {
+			start := c.udf.sectorOf(fsdExtent.GetPartition(), block)
+			mark(start, start+1)
+		}
+	}
+}
+
+func maxUint64(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// markMetadataFiles marks the blocks of the metadata file, its mirror and
+// its bitmap backing a metadata partition recorded in the given physical
+// partition
+func (c *fsck) markMetadataFiles(pd *PartitionDescriptor, mark func(from uint64, to uint64)) {
+	for i, pMap := range c.udf.lvd.PartitionMaps {
+		if recorded, _ := c.udf.mapDescriptor(&pMap); pMap.isPhysical() || pMap.isVirtual() || recorded != pd {
+			continue
+		}
+		physical := c.udf.partition(c.udf.physicalPartition(uint16(i)))
+		markBlocks := func(location uint64, blocks uint64) {
+			for block := location; block < location+blocks; block++ {
+				if sector, ok := physical.Sector(block); ok {
+					mark(sector, sector+1)
+				}
+			}
+		}
+		for _, location := range pMap.metadataFileLocations() {
+			metaFile := NewFileEntry(0, physical.ReadBlocks(uint64(location), 1))
+			markBlocks(uint64(location), 1)
+			for _, desc := range metaFile.GetAllocationDescriptors() {
+				markBlocks(desc.GetLocation(), (uint64(ExtentLength(desc))+c.udf.SECTOR_SIZE-1)/c.udf.SECTOR_SIZE)
+			}
+		}
+	}
+}
+
+func (c *fsck) checkIntegrityCounts() {
+	source := "integrity descriptor"
+	var recordedFiles, recordedDirs uint32
+	if vat := c.udf.VirtualAllocationTable(); vat != nil {
+		// The counts of write-once volumes are kept in the VAT, which
+		// only records them since UDF 2.00
+		if vat.data == nil {
+			return
+		}
+		source = "virtual allocation table"
+		recordedFiles, recordedDirs = vat.NumberOfFiles, vat.NumberOfDirectories
+	} else {
+		lvid := c.udf.LogicalVolumeIntegrity()
+		if lvid == nil || lvid.LengthOfImplementationUse < 46 {
+			return
+		}
+		recordedFiles, recordedDirs = lvid.NumberOfFiles, lvid.NumberOfDirectories
+	}
+	var files, dirs uint32
+	for _, entry := range c.order {
+		if entry.isStream {
+			continue
+		}
+		if entry.isDir {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	if recordedFiles != files {
+		c.report(FSCK_LVID_FILE_COUNT, FSCK_ERROR, "", "%s records %d files, found %d", source, recordedFiles, files)
+	}
+	if recordedDirs != dirs {
+		c.report(FSCK_LVID_DIRECTORY_COUNT, FSCK_ERROR, "", "%s records %d directories, found %d", source, recordedDirs, dirs)
+	}
+}
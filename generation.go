@@ -0,0 +1,154 @@
+package udf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Generation is a recorded state of the file system of a sequentially
+// recorded volume: each session records a new one, found from the VAT ICB
+// it ends with or from its own anchor
+type Generation struct {
+	// AnchorSector is the sector of the anchor volume descriptor pointer
+	// leading to the volume descriptors of the generation
+	AnchorSector uint64
+	// VATSector is the sector of the VAT ICB of the generation, 0 if the
+	// volume has no virtual partition
+	VATSector     uint64
+	RecordingTime time.Time
+	// Current is set for the generation read by the Udf
+	Current bool
+}
+
+// vatChain returns the sectors of the current VAT ICB and of the previous
+// ones it links to, oldest first
+func (udf *Udf) vatChain() (sectors []uint64) {
+	for partition := range udf.vat {
+		visited := make(map[uint64]bool)
+		for sector := udf.vatSector; sector != 0 && !visited[sector]; {
+			visited[sector] = true
+			vat := udf.readVAT(partition, sector)
+			if vat == nil {
+				break
+			}
+			sectors = append([]uint64{sector}, sectors...)
+			sector = 0
+			if vat.PreviousVATICBLocation != VAT_ENTRY_UNUSED {
+				sector = udf.sectorOf(udf.physicalPartition(partition), uint64(vat.PreviousVATICBLocation))
+			}
+		}
+		break
+	}
+	return
+}
+
+// sessionAnchors returns the anchors of the sessions recorded in the image,
+// one per volume descriptor sequence, scanning every sector
+func (udf *Udf) sessionAnchors() (anchors []uint64) {
+	const chunkSectors = 256
+	sequences := make(map[uint32]bool)
+	buf := make([]byte, chunkSectors*udf.SECTOR_SIZE)
+	for sector := uint64(0); ; sector += chunkSectors {
+		n, _ := udf.r.ReadAt(buf, int64(sector*udf.SECTOR_SIZE))
+		for i := uint64(0); (i+1)*udf.SECTOR_SIZE <= uint64(n); i++ {
+			b := buf[i*udf.SECTOR_SIZE : (i+1)*udf.SECTOR_SIZE]
+			if rl_u16(b[0:]) != DESCRIPTOR_ANCHOR_VOLUME_POINTER || uint64(rl_u32(b[12:])) != sector+i {
+				continue
+			}
+			anchor := NewAnchorVolumeDescriptorPointer(b)
+			if !anchor.Descriptor.Valid() || sequences[anchor.MainVolumeDescriptorSeq.Location] {
+				continue
+			}
+			sequences[anchor.MainVolumeDescriptorSeq.Location] = true
+			anchors = append(anchors, sector+i)
+		}
+		if n < len(buf) {
+			return
+		}
+	}
+}
+
+// openGeneration returns a reader of the volume as recorded by a generation
+func (udf *Udf) openGeneration(g Generation) (gen *Udf, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			gen, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	gen = &Udf{
+		r:           udf.r,
+		pd:          make(map[uint16]*PartitionDescriptor),
+		vatSector:   g.VATSector,
+		anchor:      g.AnchorSector,
+		SECTOR_SIZE: udf.SECTOR_SIZE,
+	}
+	if err = gen.init(); err != nil {
+		return nil, err
+	}
+	return gen, nil
+}
+
+// Generations lists the states of the file system recorded on the volume,
+// oldest first: one per VAT ICB linked from the current one, and one per
+// earlier session recording its own volume descriptors. Finding the
+// sessions reads the whole image.
+func (udf *Udf) Generations() (generations []Generation) {
+	udf.init()
+	current := udf.anchor
+	if current == 0 {
+		current = 256
+	}
+	anchors := udf.sessionAnchors()
+	found := false
+	for _, anchor := range anchors {
+		found = found || anchor == current
+	}
+	if !found {
+		anchors = append(anchors, current)
+		sort.Slice(anchors, func(i, j int) bool { return anchors[i] < anchors[j] })
+	}
+	chain := udf.vatChain()
+
+	for i, anchor := range anchors {
+		end := ^uint64(0)
+		if i+1 < len(anchors) {
+			end = anchors[i+1]
+		}
+		var vatSectors []uint64
+		for _, sector := range chain {
+			if sector > anchor && sector < end {
+				vatSectors = append(vatSectors, sector)
+			}
+		}
+		if len(vatSectors) == 0 {
+			vatSectors = []uint64{0}
+		}
+		for _, sector := range vatSectors {
+			g := Generation{AnchorSector: anchor, VATSector: sector}
+			if sector != 0 {
+				g.RecordingTime = NewFileEntry(0, udf.ReadSector(sector)).GetModificationTime()
+			}
+			gen, err := udf.openGeneration(g)
+			if err != nil {
+				continue
+			}
+			if g.VATSector == 0 {
+				g.VATSector = gen.vatSector
+			}
+			if g.RecordingTime.IsZero() && gen.pvd != nil {
+				g.RecordingTime = gen.pvd.RecordingDateTime
+			}
+			g.Current = anchor == current && g.VATSector == udf.vatSector
+			generations = append(generations, g)
+		}
+	}
+	return
+}
+
+// OpenGeneration returns a reader of the volume as recorded by one of its
+// generations
+func (udf *Udf) OpenGeneration(g Generation) (*Udf, error) {
+	udf.init()
+	return udf.openGeneration(g)
+}
@@ -9,6 +9,42 @@ const (
 	Embedded
 )
 
+// File types recorded in the ICB tag (ECMA-167 4/14.6.6, UDF 2.3.5.2)
+const (
+	FILE_TYPE_UNSPECIFIED         = 0
+	FILE_TYPE_UNALLOCATED_SPACE   = 1
+	FILE_TYPE_PARTITION_INTEGRITY = 2
+	FILE_TYPE_INDIRECT            = 3
+	FILE_TYPE_DIRECTORY           = 4
+	FILE_TYPE_REGULAR             = 5
+	FILE_TYPE_BLOCK_DEVICE        = 6
+	FILE_TYPE_CHARACTER_DEVICE    = 7
+	FILE_TYPE_EXTENDED_ATTRIBUTES = 8
+	FILE_TYPE_FIFO                = 9
+	FILE_TYPE_SOCKET              = 10
+	FILE_TYPE_TERMINAL            = 11
+	FILE_TYPE_SYMLINK             = 12
+	FILE_TYPE_STREAM_DIRECTORY    = 13
+	FILE_TYPE_VAT                 = 248
+	FILE_TYPE_REAL_TIME           = 249
+	FILE_TYPE_METADATA            = 250
+	FILE_TYPE_METADATA_MIRROR     = 251
+	FILE_TYPE_METADATA_BITMAP     = 252
+)
+
+// ICB strategy types (ECMA-167 4/A.5, 4/A.6)
+const (
+	ICB_STRATEGY_4    = 4
+	ICB_STRATEGY_4096 = 4096
+)
+
+// ICB tag flags besides the allocation type (ECMA-167 4/14.6.8)
+const (
+	ICB_FLAG_SETUID = 1 << 6
+	ICB_FLAG_SETGID = 1 << 7
+	ICB_FLAG_STICKY = 1 << 8
+)
+
 type ICBTag struct {
 	PriorRecordedNumberOfDirectEntries uint32
 	StrategyType                       uint16
@@ -23,7 +59,7 @@ type ICBTag struct {
 func (itag *ICBTag) FromBytes(b []byte) *ICBTag {
 	itag.PriorRecordedNumberOfDirectEntries = rl_u32(b[0:])
 	itag.StrategyType = rl_u16(b[4:])
-	itag.StrategyParameter = rl_u16(b[4:])
+	itag.StrategyParameter = rl_u16(b[6:])
 	itag.MaximumNumberOfEntries = rl_u16(b[8:])
 	itag.FileType = r_u8(b[11:])
 	itag.ParentICBLocation = rl_u48(b[12:])
@@ -35,3 +71,73 @@ func (itag *ICBTag) FromBytes(b []byte) *ICBTag {
 func NewICBTag(b []byte) *ICBTag {
 	return new(ICBTag).FromBytes(b)
 }
+
+type IndirectEntry struct {
+	Descriptor  Descriptor
+	ICBTag      *ICBTag
+	IndirectICB ExtentLong
+}
+
+func (ie *IndirectEntry) FromBytes(b []byte) *IndirectEntry {
+	ie.Descriptor.FromBytes(b)
+	ie.ICBTag = NewICBTag(b[16:])
+	ie.IndirectICB = NewExtentLong(b[36:])
+	return ie
+}
+
+func NewIndirectEntry(b []byte) *IndirectEntry {
+	return new(IndirectEntry).FromBytes(b)
+}
+
+func (d *Descriptor) IndirectEntry() *IndirectEntry {
+	return NewIndirectEntry(d.data)
+}
+
+// icbEntry is a direct entry of an ICB hierarchy along with its location
+type icbEntry struct {
+	fe       FileEntryInterface
+	location LbAddr
+}
+
+// readICBHierarchy walks the ICB hierarchy starting at the given ICB and
+// returns its direct entries in recording order, the current one last.
+// Under strategy 4096 an ICB holds a direct entry followed by either an
+// Indirect Entry pointing to the next ICB, a Terminal Entry or nothing.
+func (udf *Udf) readICBHierarchy(icb ExtentLong) (entries []icbEntry) {
+	loc := icb.Location
+	visited := make(map[LbAddr]bool)
+	for !visited[loc] {
+		visited[loc] = true
+		b := udf.ReadSector(udf.sectorOf(loc.PartitionReferenceNumber, uint64(loc.LogicalBlockNumber)))
+		if desc := NewDescriptor(b); desc.TagIdentifier == DESCRIPTOR_INDIRECT_ENTRY && desc.TagChecksum == desc.Checksum() {
+			loc = desc.IndirectEntry().IndirectICB.Location
+			continue
+		}
+		fe := NewFileEntry(loc.PartitionReferenceNumber, b)
+		entries = append(entries, icbEntry{fe, loc})
+		if fe.GetICBTag().StrategyType != ICB_STRATEGY_4096 {
+			return
+		}
+		nextSector, ok := udf.partition(loc.PartitionReferenceNumber).Sector(uint64(loc.LogicalBlockNumber) + 1)
+		if !ok {
+			return
+		}
+		// An entry in the last sector of the image has no neighbour
+		next := make([]byte, udf.SECTOR_SIZE)
+		if n, _ := udf.r.ReadAt(next, int64(nextSector*udf.SECTOR_SIZE)); n < len(next) {
+			return
+		}
+		desc := NewDescriptor(next)
+		if desc.TagIdentifier != DESCRIPTOR_INDIRECT_ENTRY || desc.TagChecksum != desc.Checksum() {
+			// A Terminal Entry or an unrecorded block ends the hierarchy
+			return
+		}
+		loc = desc.IndirectEntry().IndirectICB.Location
+	}
+	if len(entries) == 0 {
+		// Looping indirect entries, fall back to reading the ICB as a direct entry
+		b := udf.ReadSector(udf.sectorOf(icb.GetPartition(), icb.GetLocation()))
+		entries = append(entries, icbEntry{NewFileEntry(icb.GetPartition(), b), icb.Location})
+	}
+	return
+}
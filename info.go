@@ -0,0 +1,108 @@
+package udf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Partition access types (ECMA-167 3/10.5.7)
+const (
+	PARTITION_ACCESS_UNSPECIFIED  = 0
+	PARTITION_ACCESS_READ_ONLY    = 1
+	PARTITION_ACCESS_WRITE_ONCE   = 2
+	PARTITION_ACCESS_REWRITABLE   = 3
+	PARTITION_ACCESS_OVERWRITABLE = 4
+)
+
+type PartitionAccessType uint32
+
+func (t PartitionAccessType) String() string {
+	switch t {
+	case PARTITION_ACCESS_UNSPECIFIED:
+		return "unspecified"
+	case PARTITION_ACCESS_READ_ONLY:
+		return "read-only"
+	case PARTITION_ACCESS_WRITE_ONCE:
+		return "write-once"
+	case PARTITION_ACCESS_REWRITABLE:
+		return "rewritable"
+	case PARTITION_ACCESS_OVERWRITABLE:
+		return "overwritable"
+	}
+	return fmt.Sprintf("access type %d", uint32(t))
+}
+
+type PartitionInfo struct {
+	Number     uint16
+	AccessType PartitionAccessType
+	Start      uint32
+	Length     uint32
+}
+
+// VolumeInfo is a summary of the volume, gathered from its volume and file
+// set descriptors
+type VolumeInfo struct {
+	VolumeIdentifier         string
+	VolumeSetIdentifier      string
+	LogicalVolumeIdentifier  string
+	FileSetIdentifier        string
+	VolumeRecordingTime      time.Time
+	FileSetRecordingTime     time.Time
+	IntegrityRecordingTime   time.Time
+	ApplicationIdentifier    EntityID
+	ImplementationIdentifier EntityID
+	UDFRevision              uint16
+	HardWriteProtect         bool
+	SoftWriteProtect         bool
+	BlockSize                uint32
+	Partitions               []PartitionInfo
+	CopyrightFileIdentifier  string
+	AbstractFileIdentifier   string
+}
+
+// Info returns a summary of the volume
+func (udf *Udf) Info() *VolumeInfo {
+	udf.init()
+	info := &VolumeInfo{
+		LogicalVolumeIdentifier: udf.lvd.LogicalVolumeIdentifier,
+		BlockSize:               udf.lvd.LogicalBlockSize,
+		FileSetIdentifier:       udf.fsd.FileSetIdentifier,
+		FileSetRecordingTime:    udf.fsd.RecordingDateTime,
+		CopyrightFileIdentifier: udf.fsd.CopyrightFileIdentifier,
+		AbstractFileIdentifier:  udf.fsd.AbstractFileIdentifier,
+	}
+	if udf.pvd != nil {
+		info.VolumeIdentifier = udf.pvd.VolumeIdentifier
+		info.VolumeSetIdentifier = udf.pvd.VolumeSetIdentifier
+		info.VolumeRecordingTime = udf.pvd.RecordingDateTime
+		info.ApplicationIdentifier = udf.pvd.ApplicationIdentifier
+		info.ImplementationIdentifier = udf.pvd.ImplementationIdentifier
+	}
+
+	lvid := udf.LogicalVolumeIntegrity()
+	if lvid != nil {
+		info.IntegrityRecordingTime = lvid.RecordingDateTime
+	}
+	if domain := udf.lvd.DomainIdentifier; domain.IsDomain() {
+		suffix := domain.DomainSuffix()
+		info.UDFRevision = suffix.UDFRevision
+		info.HardWriteProtect = suffix.HardWriteProtect()
+		info.SoftWriteProtect = suffix.SoftWriteProtect()
+	} else if lvid != nil {
+		info.UDFRevision = lvid.MinimumUDFReadRevision
+	}
+
+	for _, pd := range udf.partitionDescriptors() {
+		info.Partitions = append(info.Partitions, PartitionInfo{
+			Number:     pd.PartitionNumber,
+			AccessType: PartitionAccessType(pd.AccessType),
+			Start:      pd.PartitionStartingLocation,
+			Length:     pd.PartitionLength,
+		})
+	}
+	sort.Slice(info.Partitions, func(i, j int) bool {
+		return info.Partitions[i].Number < info.Partitions[j].Number
+	})
+	return info
+}
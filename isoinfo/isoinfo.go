@@ -1,25 +1,49 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Xmister/udf"
 )
 
+var showAll = flag.Bool("all", false, "also list hidden, deleted, parent and metadata entries")
+
+func readDir(f *udf.File) []udf.File {
+	if *showAll {
+		return f.ReadDirAll(udf.FILE_CHARACTERISTIC_HIDDEN | udf.FILE_CHARACTERISTIC_DELETED | udf.FILE_CHARACTERISTIC_PARENT | udf.FILE_CHARACTERISTIC_METADATA)
+	}
+	return f.ReadDir()
+}
+
 func printDir(spaces string, files []udf.File) {
 	for _, f := range files {
-		fmt.Printf("%s %-10d %s %-20s %v\n", f.Mode().String(), f.Size(), spaces, f.Name(), f.ModTime())
-		if f.IsDir() {
-			printDir(spaces+"   ", f.ReadDir())
+		name := f.Name()
+		if f.IsDeleted() {
+			name += " (deleted)"
+		}
+		fmt.Printf("%s %-10d %s %-20s %v\n", f.Mode().String(), f.Size(), spaces, name, f.ModTime())
+		for _, st := range f.Streams() {
+			fmt.Printf("%s %-10d %s %-20s %v\n", st.Mode().String(), st.Size(), spaces, f.Name()+":"+st.Name(), st.ModTime())
+		}
+		if f.IsDir() && !f.IsParent() && (!f.IsDeleted() || f.ValidFileEntry()) {
+			printDir(spaces+"   ", readDir(&f))
 		}
 	}
 }
 
-func main() {
-	flag.Parse()
-	rdr, err := os.Open(flag.Arg(0))
+func openUdf(path string) *udf.Udf {
+	rdr, err := os.Open(path)
 	if err != nil {
 		panic(err)
 	}
@@ -28,6 +52,490 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	return u
+}
+
+// openVolumeSet opens the images of a volume set, one per volume
+func openVolumeSet(paths []string) *udf.Udf {
+	var volumes []io.ReaderAt
+	for _, path := range paths {
+		rdr, err := os.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		volumes = append(volumes, rdr)
+	}
+	u, err := udf.NewUdfFromVolumeSet(volumes)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func extractDir(dest string, files []udf.File, appleDouble bool) {
+	for _, f := range files {
+		target := filepath.Join(dest, f.Name())
+		if f.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				panic(err)
+			}
+			extractDir(target, f.ReadDir(), appleDouble)
+		} else if f.Mode().IsRegular() {
+			out, err := os.Create(target)
+			if err != nil {
+				panic(err)
+			}
+			if _, err := io.Copy(out, f.NewReader()); err != nil {
+				panic(err)
+			}
+			out.Close()
+		} else {
+			continue
+		}
+		os.Chtimes(target, f.ModTime(), f.ModTime())
+		if appleDouble && f.HasAppleDouble() {
+			out, err := os.Create(filepath.Join(dest, "._"+f.Name()))
+			if err != nil {
+				panic(err)
+			}
+			if err := f.WriteAppleDouble(out); err != nil {
+				panic(err)
+			}
+			out.Close()
+		}
+	}
+}
+
+func extract(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	appleDouble := fs.Bool("appledouble", false, "write Macintosh Finder info and resource forks to ._name files")
+	fs.Parse(args)
+	u := openUdf(fs.Arg(0))
+	extractDir(fs.Arg(1), u.ReadDir(nil), *appleDouble)
+}
+
+func entityIDs(args []string) {
+	for _, id := range openUdf(args[0]).EntityIDs() {
+		fmt.Printf("%-40s %-24s %s\n", id.Structure, id.Field, id.EntityID.String())
+	}
+}
+
+func info(args []string) {
+	info := openUdf(args[0]).Info()
+	fmt.Printf("Volume identifier:         %s\n", info.VolumeIdentifier)
+	fmt.Printf("Volume set identifier:     %s\n", info.VolumeSetIdentifier)
+	fmt.Printf("Logical volume identifier: %s\n", info.LogicalVolumeIdentifier)
+	fmt.Printf("File set identifier:       %s\n", info.FileSetIdentifier)
+	fmt.Printf("Volume recording time:     %v\n", info.VolumeRecordingTime)
+	fmt.Printf("File set recording time:   %v\n", info.FileSetRecordingTime)
+	fmt.Printf("Integrity recording time:  %v\n", info.IntegrityRecordingTime)
+	fmt.Printf("Application identifier:    %s\n", info.ApplicationIdentifier)
+	fmt.Printf("Implementation identifier: %s\n", info.ImplementationIdentifier)
+	fmt.Printf("UDF revision:              %s\n", udf.UDFRevisionString(info.UDFRevision))
+	fmt.Printf("Hard write-protect:        %v\n", info.HardWriteProtect)
+	fmt.Printf("Soft write-protect:        %v\n", info.SoftWriteProtect)
+	fmt.Printf("Block size:                %d\n", info.BlockSize)
+	fmt.Printf("Copyright file:            %s\n", info.CopyrightFileIdentifier)
+	fmt.Printf("Abstract file:             %s\n", info.AbstractFileIdentifier)
+	for _, p := range info.Partitions {
+		fmt.Printf("%-27s%s, start %d, length %d\n", fmt.Sprintf("Partition %d:", p.Number), p.AccessType, p.Start, p.Length)
+	}
+}
+
+func fileSets(args []string) {
+	u := openUdf(args[0])
+	for _, fsd := range u.FileSets() {
+		fmt.Printf("File set %d (descriptor %d): %s\n", fsd.FileSetNumber, fsd.FileSetDescriptorNumber, fsd.FileSetIdentifier)
+		printDir("   ", u.ReadDir(u.FileSetRoot(fsd)))
+	}
+}
+
+// df shows the free space of each partition, next to the free space the
+// integrity descriptor claims
+func df(args []string) {
+	u := openUdf(args[0])
+	fmt.Printf("%-4s %-9s %-10s %10s %10s %10s %10s %5s\n", "Map", "Partition", "Source", "Blocks", "Used", "Free", "Freed", "Use%")
+	for _, space := range u.FreeSpace() {
+		use := "-"
+		if space.Blocks > 0 && space.Source != udf.SPACE_VIRTUAL {
+			use = fmt.Sprintf("%d%%", uint64(space.UsedBlocks)*100/uint64(space.Blocks))
+		}
+		fmt.Printf("%-4d %-9d %-10s %10d %10d %10d %10d %5s", space.Partition, space.Number, space.Source, space.Blocks, space.UsedBlocks, space.FreeBlocks, space.FreedBlocks, use)
+		if space.RecordedFreeBlocks != 0xFFFFFFFF && space.RecordedFreeBlocks != space.FreeBlocks && space.Source != udf.SPACE_NONE {
+			fmt.Printf("  (integrity descriptor claims %d free)", space.RecordedFreeBlocks)
+		}
+		fmt.Println()
+	}
+	var sectors uint64
+	extents := u.UnallocatedVolumeSpace()
+	for _, extent := range extents {
+		sectors += (uint64(extent.Length) + uint64(u.SECTOR_SIZE) - 1) / uint64(u.SECTOR_SIZE)
+	}
+	fmt.Printf("Unallocated volume space: %d sectors in %d extents\n", sectors, len(extents))
+}
+
+// badSectors tells what is recorded in the sectors listed one per line in a
+// file or on the standard input, and which files they affect
+func badSectors(args []string) {
+	u := openUdf(args[0])
+	in := os.Stdin
+	if len(args) > 1 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	var affected []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sector, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			panic(err)
+		}
+		owners := u.WhoOwns(sector)
+		if len(owners) == 0 {
+			fmt.Printf("%d\tunused\n", sector)
+		}
+		for _, owner := range owners {
+			switch owner.Kind {
+			case udf.SECTOR_FILE_DATA, udf.SECTOR_DIRECTORY_DATA:
+				offset := owner.Offset + int64(sector-owner.Start)*int64(u.SECTOR_SIZE)
+				fmt.Printf("%d\t%s\t%s\t(offset %d)\n", sector, owner.Kind, owner.Path, offset)
+			default:
+				fmt.Printf("%d\t%s\t%s\n", sector, owner.Kind, owner.Path)
+			}
+			if owner.Path != "" && !seen[owner.Path] {
+				seen[owner.Path] = true
+				affected = append(affected, owner.Path)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("%d files affected\n", len(affected))
+	for _, path := range affected {
+		fmt.Println(path)
+	}
+}
+
+// damage lists the files of a partially recovered image affected by the
+// ranges its GNU ddrescue mapfile marks as not recovered
+func damage(args []string) {
+	rdr, err := os.Open(args[0])
+	if err != nil {
+		panic(err)
+	}
+	mapfile, err := os.Open(args[1])
+	if err != nil {
+		panic(err)
+	}
+	defer mapfile.Close()
+	u, err := udf.NewUdfFromDdrescueMap(rdr, mapfile)
+	if err != nil {
+		panic(err)
+	}
+	for _, d := range u.DamageReport() {
+		path := d.Path
+		if path == "" {
+			path = "(volume structures)"
+		}
+		fmt.Printf("%s\t%s\n", path, strings.Join(d.Kinds, ", "))
+		for _, r := range d.Ranges {
+			fmt.Printf("\tbytes %d-%d\n", r.Offset, r.Offset+r.Length-1)
+		}
+	}
+}
 
+// domain writes the GNU ddrescue domain mapfile of the sectors the volume
+// uses, or lists them
+func domain(args []string) {
+	fs := flag.NewFlagSet("domain", flag.ExitOnError)
+	withData := fs.Bool("data", true, "include the file data")
+	list := fs.Bool("list", false, "list the byte ranges instead of writing a mapfile")
+	fs.Parse(args)
+	u := openUdf(fs.Arg(0))
+	if *list {
+		for _, r := range u.UsedExtents(*withData) {
+			fmt.Printf("%d\t%d\n", r.Offset, r.Length)
+		}
+		return
+	}
+	if err := u.WriteDdrescueDomain(os.Stdout, *withData); err != nil {
+		panic(err)
+	}
+}
+
+// scan lists the UDF volumes found anywhere in an image, and the contents
+// of the one given by its index
+func scan(args []string) {
+	rdr, err := os.Open(args[0])
+	if err != nil {
+		panic(err)
+	}
+	volumes, err := udf.ScanVolumes(rdr)
+	if err != nil {
+		panic(err)
+	}
+	if len(args) < 2 {
+		for i, v := range volumes {
+			fmt.Printf("%d: offset %d, sector size %d, anchor %d, label %q\n", i, v.Offset, v.SectorSize, v.AnchorSector, v.Label)
+		}
+		return
+	}
+	i, err := strconv.Atoi(args[1])
+	if err != nil || i < 0 || i >= len(volumes) {
+		panic(fmt.Sprintf("no volume %s", args[1]))
+	}
+	u, err := volumes[i].Open(rdr)
+	if err != nil {
+		panic(err)
+	}
 	printDir("", u.ReadDir(nil))
 }
+
+// generations lists the recorded states of a sequential volume, or the
+// contents of the one given by its index
+func generations(args []string) {
+	u := openUdf(args[0])
+	gens := u.Generations()
+	if len(args) < 2 {
+		for i, g := range gens {
+			current := ""
+			if g.Current {
+				current = " (current)"
+			}
+			fmt.Printf("%d: anchor %d, VAT ICB %d, recorded %v%s\n", i, g.AnchorSector, g.VATSector, g.RecordingTime, current)
+		}
+		return
+	}
+	i, err := strconv.Atoi(args[1])
+	if err != nil || i < 0 || i >= len(gens) {
+		panic(fmt.Sprintf("no generation %s", args[1]))
+	}
+	gen, err := u.OpenGeneration(gens[i])
+	if err != nil {
+		panic(err)
+	}
+	printDir("", gen.ReadDir(nil))
+}
+
+func printSalvaged(spaces string, entries []*udf.SalvagedEntry) {
+	for _, e := range entries {
+		fmt.Printf("%s%s (sector %d, %d bytes)\n", spaces, e.DisplayName(), e.Sector, e.FileEntry.GetInformationLength())
+		printSalvaged(spaces+"   ", e.Children)
+	}
+}
+
+func extractSalvaged(dest string, entries []*udf.SalvagedEntry) {
+	for _, e := range entries {
+		target := filepath.Join(dest, e.DisplayName())
+		if e.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				panic(err)
+			}
+			extractSalvaged(target, e.Children)
+			continue
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			panic(err)
+		}
+		io.Copy(out, e.NewReader())
+		out.Close()
+	}
+}
+
+func salvage(args []string) {
+	fs := flag.NewFlagSet("salvage", flag.ExitOnError)
+	dest := fs.String("extract", "", "directory to extract the salvaged entries to")
+	fs.Parse(args)
+	rdr, err := os.Open(fs.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+	result, err := udf.Salvage(rdr)
+	if err != nil {
+		panic(err)
+	}
+	printSalvaged("", result.Roots)
+	fmt.Println("lost+found:")
+	printSalvaged("   ", result.LostAndFound)
+	if *dest != "" {
+		extractSalvaged(*dest, result.Roots)
+		lostAndFound := filepath.Join(*dest, "lost+found")
+		if err := os.MkdirAll(lostAndFound, 0755); err != nil {
+			panic(err)
+		}
+		extractSalvaged(lostAndFound, result.LostAndFound)
+	}
+}
+
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the problems as JSON")
+	fs.Parse(args)
+	problems := openUdf(fs.Arg(0)).Fsck()
+	if *asJSON {
+		out, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%s\t%s\t%s\t%s\n", p.Severity, p.Check, p.Path, p.Message)
+		}
+	}
+	for _, p := range problems {
+		if p.Severity == udf.FSCK_ERROR {
+			os.Exit(1)
+		}
+	}
+}
+
+func repair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "only show the fixes, without writing them")
+	fs.Parse(args)
+	mode := os.O_RDWR
+	if *dryRun {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(fs.Arg(0), mode, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	fixes, err := udf.Repair(f, f, *dryRun)
+	for _, fix := range fixes {
+		fmt.Printf("sector %-10d %-28s %s\n", fix.Sector, fix.Fix, fix.Message)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// edit opens an image for in-place changes and records them once fn is done
+func edit(image string, fn func(ed *udf.Editor) error) {
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	ed, err := udf.NewEditor(f, f)
+	if err != nil {
+		panic(err)
+	}
+	if err := fn(ed); err != nil {
+		panic(err)
+	}
+	if err := ed.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// put replaces the contents of a file in the image, or adds it
+func put(args []string) {
+	data, err := ioutil.ReadFile(args[2])
+	if err != nil {
+		panic(err)
+	}
+	edit(args[0], func(ed *udf.Editor) error {
+		err := ed.WriteFile(args[1], data)
+		if errors.Is(err, os.ErrNotExist) {
+			err = ed.Create(&udf.Header{Name: args[1], Mode: 0644, ModTime: time.Now()}, data)
+		}
+		return err
+	})
+}
+
+// appendFile records a file as a new session of a write-once image
+func appendFile(args []string) {
+	data, err := ioutil.ReadFile(args[2])
+	if err != nil {
+		panic(err)
+	}
+	f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	ua, err := udf.NewAppender(f, f)
+	if err != nil {
+		panic(err)
+	}
+	if err := ua.WriteHeader(&udf.Header{Name: args[1], Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		panic(err)
+	}
+	if _, err := ua.Write(data); err != nil {
+		panic(err)
+	}
+	if err := ua.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func label(args []string) {
+	edit(args[0], func(ed *udf.Editor) error {
+		return ed.SetLabel(args[1])
+	})
+}
+
+func main() {
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "extract":
+		extract(flag.Args()[1:])
+	case "info":
+		info(flag.Args()[1:])
+	case "filesets":
+		fileSets(flag.Args()[1:])
+	case "salvage":
+		salvage(flag.Args()[1:])
+	case "fsck":
+		fsck(flag.Args()[1:])
+	case "repair":
+		repair(flag.Args()[1:])
+	case "put":
+		put(flag.Args()[1:])
+	case "label":
+		label(flag.Args()[1:])
+	case "append":
+		appendFile(flag.Args()[1:])
+	case "df":
+		df(flag.Args()[1:])
+	case "badsectors":
+		badSectors(flag.Args()[1:])
+	case "damage":
+		damage(flag.Args()[1:])
+	case "domain":
+		domain(flag.Args()[1:])
+	case "scan":
+		scan(flag.Args()[1:])
+	case "generations":
+		generations(flag.Args()[1:])
+	case "entityids":
+		entityIDs(flag.Args()[1:])
+	default:
+		// Several images are the volumes of a volume set
+		var u *udf.Udf
+		if flag.NArg() > 1 {
+			u = openVolumeSet(flag.Args())
+		} else {
+			u = openUdf(flag.Arg(0))
+		}
+		if *showAll {
+			printDir("", u.ReadDirAll(nil, udf.FILE_CHARACTERISTIC_HIDDEN|udf.FILE_CHARACTERISTIC_DELETED|udf.FILE_CHARACTERISTIC_PARENT|udf.FILE_CHARACTERISTIC_METADATA))
+		} else {
+			printDir("", u.ReadDir(nil))
+		}
+	}
+}
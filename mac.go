@@ -0,0 +1,208 @@
+package udf
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// Macintosh implementation use extended attributes (UDF 3.3.4.5.4) and named
+// stream (UDF 3.3.7.2)
+const (
+	MAC_VOLUME_INFO_EA     = "*UDF Mac VolumeInfo"
+	MAC_FINDER_INFO_EA     = "*UDF Mac FinderInfo"
+	MAC_UNIQUE_ID_TABLE_EA = "*UDF Mac UniqueIDTable"
+	MAC_RESOURCE_FORK_EA   = "*UDF Mac ResourceFork"
+	MAC_RESOURCE_FORK      = "*UDF Macintosh Resource Fork"
+)
+
+type MacVolumeInfo struct {
+	LastModificationDate    time.Time
+	LastBackupDate          time.Time
+	VolumeFinderInformation [8]uint32
+}
+
+func (mvi *MacVolumeInfo) FromBytes(b []byte) *MacVolumeInfo {
+	mvi.LastModificationDate = r_timestamp(b[2:])
+	mvi.LastBackupDate = r_timestamp(b[14:])
+	for i := range mvi.VolumeFinderInformation {
+		mvi.VolumeFinderInformation[i] = rl_u32(b[26+4*i:])
+	}
+	return mvi
+}
+
+// MacFinderInfo holds the Finder information of a file or directory; the
+// resource fork lengths are only recorded for files
+type MacFinderInfo struct {
+	ParentDirectoryID       uint32
+	FileType                uint32
+	FileCreator             uint32
+	FinderFlags             uint16
+	LocationV               int16
+	LocationH               int16
+	Folder                  uint16
+	ExtendedFinderInfo      [16]byte
+	ResourceForkDataLength  uint32
+	ResourceForkAllocLength uint32
+}
+
+func (mfi *MacFinderInfo) FromBytes(b []byte) *MacFinderInfo {
+	mfi.ParentDirectoryID = rl_u32(b[4:])
+	mfi.FileType = rl_u32(b[8:])
+	mfi.FileCreator = rl_u32(b[12:])
+	mfi.FinderFlags = rl_u16(b[16:])
+	mfi.LocationV = rl_i16(b[18:])
+	mfi.LocationH = rl_i16(b[20:])
+	mfi.Folder = rl_u16(b[22:])
+	copy(mfi.ExtendedFinderInfo[:], b[24:40])
+	if len(b) >= 48 {
+		mfi.ResourceForkDataLength = rl_u32(b[40:])
+		mfi.ResourceForkAllocLength = rl_u32(b[44:])
+	}
+	return mfi
+}
+
+// TypeCode returns the Finder file type as its four character code, e.g. "TEXT"
+func (mfi *MacFinderInfo) TypeCode() string {
+	return fourCharCode(mfi.FileType)
+}
+
+// CreatorCode returns the Finder file creator as its four character code
+func (mfi *MacFinderInfo) CreatorCode() string {
+	return fourCharCode(mfi.FileCreator)
+}
+
+func fourCharCode(code uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], code)
+	return string(b[:])
+}
+
+// MacUniqueIDTable maps Macintosh file and directory IDs, used as table
+// indexes, to the ICB locations of the entries
+type MacUniqueIDTable struct {
+	Maps []LbAddr
+}
+
+func (mut *MacUniqueIDTable) FromBytes(b []byte) *MacUniqueIDTable {
+	count := rl_u32(b[4:])
+	for i := uint32(0); i < count && 8+6*(i+1) <= uint32(len(b)); i++ {
+		mut.Maps = append(mut.Maps, new(LbAddr).FromBytes(b[8+6*i:]))
+	}
+	return mut
+}
+
+// MacFinderInfo returns the entry's Finder information, or nil if none is recorded
+func (f *File) MacFinderInfo() *MacFinderInfo {
+	attrs, _ := f.ExtendedAttributes()
+	iu := attrs.ImplementationUse(MAC_FINDER_INFO_EA)
+	if iu == nil || len(iu.ImplementationUse) < 40 {
+		return nil
+	}
+	return new(MacFinderInfo).FromBytes(iu.ImplementationUse)
+}
+
+// MacResourceFork returns a reader over the entry's resource fork, recorded
+// either as a named stream or, before UDF 2.00, in an extended attribute
+func (f *File) MacResourceFork() (*MultiSectionReader, error) {
+	if r, err := f.OpenStream(MAC_RESOURCE_FORK); err == nil {
+		return r, nil
+	}
+	attrs, err := f.ExtendedAttributes()
+	if err != nil {
+		return nil, err
+	}
+	iu := attrs.ImplementationUse(MAC_RESOURCE_FORK_EA)
+	if iu == nil || len(iu.ImplementationUse) < 4 {
+		return nil, os.ErrNotExist
+	}
+	fe := f.FileEntry()
+	descs := GetAllocationDescriptors(fe.GetICBTag().AllocationType, iu.ImplementationUse[4:], uint32(len(iu.ImplementationUse)-4))
+	readers, _ := f.Udf.getReaders(fe, descs, 0)
+	return newMultiSectionReader(readers), nil
+}
+
+// MacVolumeInfo returns the Macintosh volume information recorded on the root
+// directory, or nil if there is none
+func (udf *Udf) MacVolumeInfo() *MacVolumeInfo {
+	udf.init()
+	attrs, _ := udf.ExtendedAttributes(udf.root_fe)
+	iu := attrs.ImplementationUse(MAC_VOLUME_INFO_EA)
+	if iu == nil || len(iu.ImplementationUse) < 58 {
+		return nil
+	}
+	return new(MacVolumeInfo).FromBytes(iu.ImplementationUse)
+}
+
+// MacUniqueIDTable returns the Macintosh unique ID table recorded on the root
+// directory, or nil if there is none
+func (udf *Udf) MacUniqueIDTable() *MacUniqueIDTable {
+	udf.init()
+	attrs, _ := udf.ExtendedAttributes(udf.root_fe)
+	iu := attrs.ImplementationUse(MAC_UNIQUE_ID_TABLE_EA)
+	if iu == nil || len(iu.ImplementationUse) < 8 {
+		return nil
+	}
+	return new(MacUniqueIDTable).FromBytes(iu.ImplementationUse)
+}
+
+// AppleDouble entry IDs
+const (
+	appleDoubleResourceFork = 2
+	appleDoubleFinderInfo   = 9
+)
+
+// HasAppleDouble returns true if the entry has Finder information or a
+// resource fork worth an AppleDouble sidecar file
+func (f *File) HasAppleDouble() bool {
+	if f.MacFinderInfo() != nil {
+		return true
+	}
+	_, err := f.MacResourceFork()
+	return err == nil
+}
+
+// WriteAppleDouble writes the entry's Finder information and resource fork
+// in the AppleDouble format, as found in "._name" sidecar files
+func (f *File) WriteAppleDouble(w io.Writer) error {
+	var finderInfo [32]byte
+	if mfi := f.MacFinderInfo(); mfi != nil {
+		binary.BigEndian.PutUint32(finderInfo[0:], mfi.FileType)
+		binary.BigEndian.PutUint32(finderInfo[4:], mfi.FileCreator)
+		binary.BigEndian.PutUint16(finderInfo[8:], mfi.FinderFlags)
+		binary.BigEndian.PutUint16(finderInfo[10:], uint16(mfi.LocationV))
+		binary.BigEndian.PutUint16(finderInfo[12:], uint16(mfi.LocationH))
+		binary.BigEndian.PutUint16(finderInfo[14:], mfi.Folder)
+		copy(finderInfo[16:], mfi.ExtendedFinderInfo[:])
+	}
+	var forkLen int64
+	fork, err := f.MacResourceFork()
+	if err == nil {
+		forkLen = fork.Size()
+	}
+
+	const headerLen = 26 + 2*12
+	header := make([]byte, headerLen)
+	binary.BigEndian.PutUint32(header[0:], 0x00051607)
+	binary.BigEndian.PutUint32(header[4:], 0x00020000)
+	binary.BigEndian.PutUint16(header[24:], 2)
+	binary.BigEndian.PutUint32(header[26:], appleDoubleFinderInfo)
+	binary.BigEndian.PutUint32(header[30:], headerLen)
+	binary.BigEndian.PutUint32(header[34:], uint32(len(finderInfo)))
+	binary.BigEndian.PutUint32(header[38:], appleDoubleResourceFork)
+	binary.BigEndian.PutUint32(header[42:], headerLen+uint32(len(finderInfo)))
+	binary.BigEndian.PutUint32(header[46:], uint32(forkLen))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(finderInfo[:]); err != nil {
+		return err
+	}
+	if forkLen > 0 {
+		if _, err := io.CopyN(w, fork, forkLen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package udf
+
+// The MarshalBinary encoders start from the bytes a descriptor was decoded
+// from, if any, so that the fields the decoders skip are recorded unchanged
+// and a decoded descriptor encodes back to the same bytes. The tag
+// checksum and CRC are always recomputed.
+
+// base returns a buffer of the given size holding the bytes the descriptor
+// was decoded from
+func (d *Descriptor) base(size int) []byte {
+	b := make([]byte, size)
+	copy(b, d.data)
+	return b
+}
+
+// marshalTag records the tag at the start of b, with a CRC covering the
+// crcLength bytes that follow it
+func (d *Descriptor) marshalTag(b []byte, tagIdentifier uint16, crcLength int) {
+	version := d.DescriptorVersion
+	if version == 0 {
+		version = 2
+	}
+	wl_u16(b[0:], tagIdentifier)
+	wl_u16(b[2:], version)
+	b[5] = 0
+	wl_u16(b[6:], d.TagSerialNumber)
+	wl_u16(b[10:], uint16(crcLength))
+	wl_u32(b[12:], d.TagLocation)
+	setDescriptorTag(b)
+}
+
+// encodeCharSpec records the OSTA Compressed Unicode character set in the
+// charspec fields at the given offsets that are still blank
+func encodeCharSpec(b []byte, offsets ...int) {
+	for _, off := range offsets {
+		if b[off] == 0 && b[off+1] == 0 {
+			copy(b[off+1:off+64], "OSTA Compressed Unicode")
+		}
+	}
+}
+
+func (e EntityID) encode(b []byte) {
+	b[0] = e.Flags
+	copy(b[1:24], e.Identifier[:])
+	copy(b[24:32], e.IdentifierSuffix[:])
+}
+
+func (e EntityID) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 32)
+	e.encode(b)
+	return b, nil
+}
+
+func (l LbAddr) encode(b []byte) {
+	wl_u32(b[0:], l.LogicalBlockNumber)
+	wl_u16(b[4:], l.PartitionReferenceNumber)
+}
+
+func (l LbAddr) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 6)
+	l.encode(b)
+	return b, nil
+}
+
+func (e Extent) encode(b []byte) {
+	wl_u32(b[0:], e.Length)
+	wl_u32(b[4:], e.Location)
+}
+
+func (e Extent) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	e.encode(b)
+	return b, nil
+}
+
+func (e ExtentSmall) encode(b []byte) {
+	wl_u16(b[0:], e.Length)
+	wl_u48(b[2:], e.Location)
+}
+
+func (e ExtentSmall) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	e.encode(b)
+	return b, nil
+}
+
+// encode records the extent length and location, leaving the
+// implementation use bytes as they are
+func (e ExtentLong) encode(b []byte) {
+	wl_u32(b[0:], e.Length)
+	e.Location.encode(b[4:])
+}
+
+func (e ExtentLong) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 16)
+	e.encode(b)
+	return b, nil
+}
+
+func (e ExtentExtended) encode(b []byte) {
+	wl_u32(b[0:], e.ExtentLength)
+	wl_u32(b[4:], e.RecordedLength)
+	wl_u32(b[8:], e.InfoLength)
+	e.Location.encode(b[12:])
+}
+
+func (e ExtentExtended) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 20)
+	e.encode(b)
+	return b, nil
+}
+
+func (itag *ICBTag) encode(b []byte) {
+	wl_u32(b[0:], itag.PriorRecordedNumberOfDirectEntries)
+	wl_u16(b[4:], itag.StrategyType)
+	wl_u16(b[6:], itag.StrategyParameter)
+	wl_u16(b[8:], itag.MaximumNumberOfEntries)
+	b[11] = itag.FileType
+	wl_u48(b[12:], itag.ParentICBLocation)
+	wl_u16(b[18:], itag.Flags&^0x3|uint16(itag.AllocationType)&0x3)
+}
+
+func (itag *ICBTag) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 20)
+	itag.encode(b)
+	return b, nil
+}
+
+func (ad *AnchorVolumeDescriptorPointer) MarshalBinary() ([]byte, error) {
+	b := ad.Descriptor.base(512)
+	ad.MainVolumeDescriptorSeq.encode(b[16:])
+	ad.ReserveVolumeDescriptorSeq.encode(b[24:])
+	ad.Descriptor.marshalTag(b, DESCRIPTOR_ANCHOR_VOLUME_POINTER, len(b)-16)
+	return b, nil
+}
+
+func (pvd *PrimaryVolumeDescriptor) MarshalBinary() ([]byte, error) {
+	b := pvd.Descriptor.base(512)
+	wl_u32(b[16:], pvd.VolumeDescriptorSequenceNumber)
+	wl_u32(b[20:], pvd.PrimaryVolumeDescriptorNumber)
+	w_dstring(b[24:], pvd.VolumeIdentifier, 32)
+	wl_u16(b[56:], pvd.VolumeSequenceNumber)
+	wl_u16(b[58:], pvd.MaximumVolumeSequenceNumber)
+	wl_u16(b[60:], pvd.InterchangeLevel)
+	wl_u16(b[62:], pvd.MaximumInterchangeLevel)
+	wl_u32(b[64:], pvd.CharacterSetList)
+	wl_u32(b[68:], pvd.MaximumCharacterSetList)
+	w_dstring(b[72:], pvd.VolumeSetIdentifier, 128)
+	encodeCharSpec(b, 200, 264)
+	pvd.VolumeAbstract.encode(b[328:])
+	pvd.VolumeCopyrightNoticeExtent.encode(b[336:])
+	pvd.ApplicationIdentifier.encode(b[344:])
+	w_timestamp(b[376:], pvd.RecordingDateTime)
+	pvd.ImplementationIdentifier.encode(b[388:])
+	copy(b[420:484], pvd.ImplementationUse)
+	wl_u32(b[484:], pvd.PredecessorVolumeDescriptorSequenceLocation)
+	wl_u16(b[488:], pvd.Flags)
+	pvd.Descriptor.marshalTag(b, DESCRIPTOR_PRIMARY_VOLUME, len(b)-16)
+	return b, nil
+}
+
+func (iuvd *ImplementationUseVolumeDescriptor) MarshalBinary() ([]byte, error) {
+	b := iuvd.Descriptor.base(512)
+	wl_u32(b[16:], iuvd.VolumeDescriptorSequenceNumber)
+	iuvd.ImplementationIdentifier.encode(b[20:])
+	encodeCharSpec(b, 52)
+	w_dstring(b[116:], iuvd.LogicalVolumeIdentifier, 128)
+	w_dstring(b[244:], iuvd.LVInfo1, 36)
+	w_dstring(b[280:], iuvd.LVInfo2, 36)
+	w_dstring(b[316:], iuvd.LVInfo3, 36)
+	iuvd.LVInfoImplementationIdentifier.encode(b[352:])
+	copy(b[384:512], iuvd.ImplementationUse)
+	iuvd.Descriptor.marshalTag(b, DESCRIPTOR_IMPLEMENTATION_USE_VOLUME, len(b)-16)
+	return b, nil
+}
+
+func (pd *PartitionDescriptor) MarshalBinary() ([]byte, error) {
+	b := pd.Descriptor.base(512)
+	wl_u32(b[16:], pd.VolumeDescriptorSequenceNumber)
+	wl_u16(b[20:], pd.PartitionFlags)
+	wl_u16(b[22:], pd.PartitionNumber)
+	pd.PartitionContents.encode(b[24:])
+	copy(b[56:184], pd.PartitionContentsUse)
+	wl_u32(b[184:], pd.AccessType)
+	wl_u32(b[188:], pd.PartitionStartingLocation)
+	wl_u32(b[192:], pd.PartitionLength)
+	pd.ImplementationIdentifier.encode(b[196:])
+	copy(b[228:356], pd.ImplementationUse)
+	pd.Descriptor.marshalTag(b, DESCRIPTOR_PARTITION, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary encodes a Type 1 map in 6 bytes and a Type 2 map in 64
+// bytes, keeping the type-specific fields of a decoded Type 2 map
+func (pm *PartitionMap) MarshalBinary() ([]byte, error) {
+	if pm.PartitionMapType != 2 {
+		b := make([]byte, 6)
+		b[0], b[1] = 1, 6
+		wl_u16(b[2:], pm.VolumeSequenceNumber)
+		wl_u16(b[4:], pm.PartitionNumber)
+		return b, nil
+	}
+	b := make([]byte, 64)
+	copy(b, pm.data)
+	b[0], b[1] = 2, 64
+	pm.PartitionTypeIdentifier.encode(b[4:])
+	wl_u16(b[36:], pm.VolumeSequenceNumber)
+	wl_u16(b[38:], pm.PartitionNumber)
+	return b, nil
+}
+
+// MarshalBinary records the partition maps, updating the map table length
+// and number of maps to match them
+func (lvd *LogicalVolumeDescriptor) MarshalBinary() ([]byte, error) {
+	var maps []byte
+	for i := range lvd.PartitionMaps {
+		pm, _ := lvd.PartitionMaps[i].MarshalBinary()
+		maps = append(maps, pm...)
+	}
+	b := lvd.Descriptor.base(440 + len(maps))
+	wl_u32(b[16:], lvd.VolumeDescriptorSequenceNumber)
+	encodeCharSpec(b, 20)
+	w_dstring(b[84:], lvd.LogicalVolumeIdentifier, 128)
+	wl_u32(b[212:], lvd.LogicalBlockSize)
+	lvd.DomainIdentifier.encode(b[216:])
+	lvd.LogicalVolumeContentsUse.encode(b[248:])
+	wl_u32(b[264:], uint32(len(maps)))
+	wl_u32(b[268:], uint32(len(lvd.PartitionMaps)))
+	lvd.ImplementationIdentifier.encode(b[272:])
+	copy(b[304:432], lvd.ImplementationUse)
+	lvd.IntegritySequenceExtent.encode(b[432:])
+	copy(b[440:], maps)
+	lvd.Descriptor.marshalTag(b, DESCRIPTOR_LOGICAL_VOLUME, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary records the free space and size tables and the
+// implementation use, updating their lengths to match them
+func (lvid *LogicalVolumeIntegrityDescriptor) MarshalBinary() ([]byte, error) {
+	partitions := len(lvid.FreeSpaceTable)
+	if len(lvid.SizeTable) > partitions {
+		partitions = len(lvid.SizeTable)
+	}
+	implUseLength := 46 + len(lvid.ImplementationUse)
+	if lvid.LengthOfImplementationUse > 0 && lvid.LengthOfImplementationUse < 46 {
+		// Not a UDF implementation use, keep it as recorded
+		implUseLength = int(lvid.LengthOfImplementationUse)
+	}
+	implUse := 80 + 8*partitions
+	b := lvid.Descriptor.base(implUse + implUseLength)
+	if len(lvid.Descriptor.data) > 0 && int(lvid.NumberOfPartitions) != partitions {
+		// The tables moved, so did the implementation use
+		for i := 80; i < len(b); i++ {
+			b[i] = 0
+		}
+	}
+	w_timestamp(b[16:], lvid.RecordingDateTime)
+	wl_u32(b[28:], lvid.IntegrityType)
+	lvid.NextIntegrityExtent.encode(b[32:])
+	wl_u64(b[40:], lvid.UniqueID)
+	wl_u32(b[72:], uint32(partitions))
+	wl_u32(b[76:], uint32(implUseLength))
+	for i := 0; i < partitions; i++ {
+		if i < len(lvid.FreeSpaceTable) {
+			wl_u32(b[80+4*i:], lvid.FreeSpaceTable[i])
+		}
+		if i < len(lvid.SizeTable) {
+			wl_u32(b[80+4*(partitions+i):], lvid.SizeTable[i])
+		}
+	}
+	if implUseLength >= 46 {
+		lvid.ImplementationIdentifier.encode(b[implUse:])
+		wl_u32(b[implUse+32:], lvid.NumberOfFiles)
+		wl_u32(b[implUse+36:], lvid.NumberOfDirectories)
+		wl_u16(b[implUse+40:], lvid.MinimumUDFReadRevision)
+		wl_u16(b[implUse+42:], lvid.MinimumUDFWriteRevision)
+		wl_u16(b[implUse+44:], lvid.MaximumUDFWriteRevision)
+		copy(b[implUse+46:], lvid.ImplementationUse)
+	}
+	lvid.Descriptor.marshalTag(b, DESCRIPTOR_LOGICAL_VOLUME_INTEGRITY, len(b)-16)
+	return b, nil
+}
+
+func (fsd *FileSetDescriptor) MarshalBinary() ([]byte, error) {
+	b := fsd.Descriptor.base(512)
+	w_timestamp(b[16:], fsd.RecordingDateTime)
+	wl_u16(b[28:], fsd.InterchangeLevel)
+	wl_u16(b[30:], fsd.MaximumInterchangeLevel)
+	wl_u32(b[32:], fsd.CharacterSetList)
+	wl_u32(b[36:], fsd.MaximumCharacterSetList)
+	wl_u32(b[40:], fsd.FileSetNumber)
+	wl_u32(b[44:], fsd.FileSetDescriptorNumber)
+	encodeCharSpec(b, 48, 240)
+	w_dstring(b[112:], fsd.LogicalVolumeIdentifier, 128)
+	w_dstring(b[304:], fsd.FileSetIdentifier, 32)
+	w_dstring(b[336:], fsd.CopyrightFileIdentifier, 32)
+	w_dstring(b[368:], fsd.AbstractFileIdentifier, 32)
+	fsd.RootDirectoryICB.encode(b[400:])
+	fsd.DomainIdentifier.encode(b[416:])
+	fsd.NexExtent.encode(b[448:])
+	fsd.SystemStreamDirectoryICB.encode(b[464:])
+	fsd.Descriptor.marshalTag(b, DESCRIPTOR_FILE_SET, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary records the identifier and its padding, updating the
+// identifier length to match it
+func (fid *FileIdentifierDescriptor) MarshalBinary() ([]byte, error) {
+	implUseLength := int(fid.LengthOfImplementationUse)
+	if implUseLength < 32 && fid.ImplementationUse != (EntityID{}) {
+		implUseLength = 32
+	}
+	identStart := 38 + implUseLength
+	recorded := make([]byte, fid.LengthOfFileIdentifier)
+	if implUseLength == int(fid.LengthOfImplementationUse) && len(fid.Descriptor.data) >= identStart+len(recorded) {
+		copy(recorded, fid.Descriptor.data[identStart:])
+	}
+	ident := recorded
+	if r_dcharacters(recorded) != fid.FileIdentifier {
+		ident = w_dcharacters(fid.FileIdentifier)
+	}
+	if len(ident) > 255 {
+		ident = ident[:255]
+	}
+	b := fid.Descriptor.base(int(4 * ((38 + uint64(implUseLength) + uint64(len(ident)) + 3) / 4)))
+	wl_u16(b[16:], fid.FileVersionNumber)
+	b[18] = fid.FileCharacteristics
+	b[19] = uint8(len(ident))
+	fid.ICB.encode(b[20:])
+	wl_u16(b[36:], uint16(implUseLength))
+	if implUseLength >= 32 {
+		fid.ImplementationUse.encode(b[38:])
+	}
+	copy(b[identStart:], ident)
+	for i := identStart + len(ident); i < len(b); i++ {
+		b[i] = 0
+	}
+	fid.Descriptor.marshalTag(b, DESCRIPTOR_IDENTIFIER, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary records the extended attributes and allocation descriptors,
+// updating their lengths to match them
+func (fe *FileEntry) MarshalBinary() ([]byte, error) {
+	b := fe.Descriptor.base(176 + len(fe.ExtendedAttributes) + len(fe.AllocationDescriptors))
+	if fe.ICBTag != nil {
+		fe.ICBTag.encode(b[16:])
+	}
+	wl_u32(b[36:], fe.Uid)
+	wl_u32(b[40:], fe.Gid)
+	wl_u32(b[44:], fe.Permissions)
+	wl_u16(b[48:], fe.FileLinkCount)
+	b[50] = fe.RecordFormat
+	b[51] = fe.RecordDisplayAttributes
+	wl_u32(b[52:], fe.RecordLength)
+	wl_u64(b[56:], fe.InformationLength)
+	wl_u64(b[64:], fe.LogicalBlocksRecorded)
+	w_timestamp(b[72:], fe.AccessTime)
+	w_timestamp(b[84:], fe.ModificationTime)
+	w_timestamp(b[96:], fe.AttributeTime)
+	wl_u32(b[108:], fe.Checkpoint)
+	fe.ExtendedAttributeICB.encode(b[112:])
+	fe.ImplementationIdentifier.encode(b[128:])
+	wl_u64(b[160:], fe.UniqueId)
+	wl_u32(b[168:], uint32(len(fe.ExtendedAttributes)))
+	wl_u32(b[172:], uint32(len(fe.AllocationDescriptors)))
+	copy(b[176:], fe.ExtendedAttributes)
+	copy(b[176+len(fe.ExtendedAttributes):], fe.AllocationDescriptors)
+	fe.Descriptor.marshalTag(b, DESCRIPTOR_FILE_ENTRY, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary records the extended attributes and allocation descriptors,
+// updating their lengths to match them
+func (fe *ExtendedFileEntry) MarshalBinary() ([]byte, error) {
+	b := fe.Descriptor.base(216 + len(fe.ExtendedAttributes) + len(fe.AllocationDescriptors))
+	if fe.ICBTag != nil {
+		fe.ICBTag.encode(b[16:])
+	}
+	wl_u32(b[36:], fe.Uid)
+	wl_u32(b[40:], fe.Gid)
+	wl_u32(b[44:], fe.Permissions)
+	wl_u16(b[48:], fe.FileLinkCount)
+	b[50] = fe.RecordFormat
+	b[51] = fe.RecordDisplayAttributes
+	wl_u32(b[52:], fe.RecordLength)
+	wl_u64(b[56:], fe.InformationLength)
+	wl_u64(b[64:], fe.ObjectSize)
+	wl_u64(b[72:], fe.LogicalBlocksRecorded)
+	w_timestamp(b[80:], fe.AccessTime)
+	w_timestamp(b[92:], fe.ModificationTime)
+	w_timestamp(b[104:], fe.CreationTime)
+	w_timestamp(b[116:], fe.AttributeTime)
+	wl_u32(b[128:], fe.Checkpoint)
+	fe.ExtendedAttributeICB.encode(b[136:])
+	fe.StreamDirectoryIcb.encode(b[152:])
+	fe.ImplementationIdentifier.encode(b[168:])
+	wl_u64(b[200:], fe.UniqueId)
+	wl_u32(b[208:], uint32(len(fe.ExtendedAttributes)))
+	wl_u32(b[212:], uint32(len(fe.AllocationDescriptors)))
+	copy(b[216:], fe.ExtendedAttributes)
+	copy(b[216+len(fe.ExtendedAttributes):], fe.AllocationDescriptors)
+	fe.Descriptor.marshalTag(b, DESCRIPTOR_EXTENDED_FILE_ENTRY, len(b)-16)
+	return b, nil
+}
+
+func (usd *UnallocatedSpaceDescriptor) MarshalBinary() ([]byte, error) {
+	b := usd.Descriptor.base(24 + 8*len(usd.AllocationDescriptors))
+	wl_u32(b[16:], usd.VolumeDescriptorSequenceNumber)
+	wl_u32(b[20:], uint32(len(usd.AllocationDescriptors)))
+	for i, ad := range usd.AllocationDescriptors {
+		ad.encode(b[24+8*i:])
+	}
+	usd.Descriptor.marshalTag(b, DESCRIPTOR_UNALLOCATED, len(b)-16)
+	return b, nil
+}
+
+// MarshalBinary records the bitmap; as UDF requires, the CRC only covers the
+// fixed part of the descriptor
+func (sbd *SpaceBitmapDescriptor) MarshalBinary() ([]byte, error) {
+	b := sbd.Descriptor.base(24 + len(sbd.Bitmap))
+	wl_u32(b[16:], sbd.NumberOfBits)
+	wl_u32(b[20:], uint32(len(sbd.Bitmap)))
+	copy(b[24:], sbd.Bitmap)
+	sbd.Descriptor.marshalTag(b, DESCRIPTOR_SPACE_BITMAP, 8)
+	return b, nil
+}
+
+func (ie *IndirectEntry) MarshalBinary() ([]byte, error) {
+	b := ie.Descriptor.base(52)
+	if ie.ICBTag != nil {
+		ie.ICBTag.encode(b[16:])
+	}
+	ie.IndirectICB.encode(b[36:])
+	ie.Descriptor.marshalTag(b, DESCRIPTOR_INDIRECT_ENTRY, len(b)-16)
+	return b, nil
+}
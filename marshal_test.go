@@ -0,0 +1,352 @@
+package udf
+
+import (
+	"bytes"
+	"encoding"
+	"testing"
+)
+
+// The descriptors below are laid out by hand after ECMA-167 and UDF 2.60,
+// with their reserved and implementation use fields filled, so that a
+// decoder skipping a field or an encoder moving one shows in the bytes.
+
+// fillPattern fills b with bytes no encoder would record by chance
+func fillPattern(b []byte) {
+	for i := range b {
+		b[i] = uint8(0xA0 + i%7)
+	}
+}
+
+// handTag records a tag of version 3 covering the whole descriptor
+func handTag(b []byte, id uint16, location uint32) {
+	wl_u16(b[0:], id)
+	wl_u16(b[2:], 3)
+	wl_u16(b[6:], 7)
+	wl_u16(b[10:], uint16(len(b)-16))
+	wl_u32(b[12:], location)
+	wl_u16(b[8:], crc_itu(b[16:]))
+	var checksum uint8
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			checksum += b[i]
+		}
+	}
+	b[4] = checksum
+}
+
+func handDstring(b []byte, s string) {
+	for i := range b {
+		b[i] = 0
+	}
+	b[0] = 8
+	copy(b[1:], s)
+	b[len(b)-1] = uint8(len(s) + 1)
+}
+
+func handCharSpec(b []byte) {
+	for i := 0; i < 64; i++ {
+		b[i] = 0
+	}
+	copy(b[1:], "OSTA Compressed Unicode")
+}
+
+func handEntityID(b []byte, id string) {
+	for i := 0; i < 32; i++ {
+		b[i] = 0
+	}
+	copy(b[1:24], id)
+	b[24], b[25] = 0x60, 0x02
+}
+
+// handTimestamp records 2024-03-14 15:09:26.535897 at UTC+1
+func handTimestamp(b []byte) {
+	copy(b, []byte{0x3C, 0x10, 0xE8, 0x07, 3, 14, 15, 9, 26, 53, 58, 97})
+}
+
+func handAnchor() []byte {
+	b := make([]byte, 512)
+	fillPattern(b[32:])
+	wl_u32(b[16:], 32768)
+	wl_u32(b[20:], 32)
+	wl_u32(b[24:], 32768)
+	wl_u32(b[28:], 48)
+	handTag(b, DESCRIPTOR_ANCHOR_VOLUME_POINTER, 256)
+	return b
+}
+
+func handPrimaryVolume() []byte {
+	b := make([]byte, 512)
+	fillPattern(b[420:])
+	wl_u32(b[16:], 1)
+	handDstring(b[24:56], "HAND_BUILT")
+	wl_u16(b[56:], 1)
+	wl_u16(b[58:], 1)
+	wl_u16(b[60:], 2)
+	wl_u16(b[62:], 3)
+	wl_u32(b[64:], 1)
+	wl_u32(b[68:], 1)
+	handDstring(b[72:200], "0123456789ABCDEFHand set")
+	handCharSpec(b[200:])
+	handCharSpec(b[264:])
+	handEntityID(b[344:], "*Hand Application")
+	handTimestamp(b[376:])
+	handEntityID(b[388:], "*Hand Implementation")
+	wl_u32(b[484:], 0)
+	wl_u16(b[488:], 1)
+	handTag(b, DESCRIPTOR_PRIMARY_VOLUME, 32)
+	return b
+}
+
+func handPartition() []byte {
+	b := make([]byte, 512)
+	fillPattern(b[56:184])
+	fillPattern(b[228:])
+	wl_u32(b[16:], 2)
+	wl_u16(b[20:], 1)
+	wl_u16(b[22:], 0)
+	handEntityID(b[24:], "+NSR03")
+	wl_u32(b[184:], 4)
+	wl_u32(b[188:], 257)
+	wl_u32(b[192:], 4000)
+	handEntityID(b[196:], "*Hand Implementation")
+	handTag(b, DESCRIPTOR_PARTITION, 33)
+	return b
+}
+
+// handLogicalVolume records a type 1 map of partition 0 and a metadata
+// partition map over it
+func handLogicalVolume() []byte {
+	b := make([]byte, 440+6+64)
+	fillPattern(b[304:432])
+	wl_u32(b[16:], 3)
+	handCharSpec(b[20:])
+	handDstring(b[84:212], "Hand volume")
+	wl_u32(b[212:], 2048)
+	handEntityID(b[216:], "*OSTA UDF Compliant")
+	wl_u32(b[248:], 2048)
+	wl_u32(b[252:], 0)
+	wl_u16(b[256:], 1)
+	wl_u32(b[264:], 70)
+	wl_u32(b[268:], 2)
+	handEntityID(b[272:], "*Hand Implementation")
+	wl_u32(b[432:], 4096)
+	wl_u32(b[436:], 64)
+	b[440], b[441] = 1, 6
+	wl_u16(b[442:], 1)
+	wl_u16(b[444:], 0)
+	pm := b[446:]
+	pm[0], pm[1] = 2, 64
+	handEntityID(pm[4:], "*UDF Metadata Partition")
+	wl_u16(pm[36:], 1)
+	wl_u16(pm[38:], 0)
+	wl_u32(pm[40:], 10)
+	wl_u32(pm[44:], 3990)
+	wl_u32(pm[48:], 0xFFFFFFFF)
+	wl_u32(pm[52:], 32)
+	wl_u16(pm[56:], 32)
+	pm[58] = 1
+	fillPattern(pm[59:64])
+	handTag(b, DESCRIPTOR_LOGICAL_VOLUME, 34)
+	return b
+}
+
+func handIntegrity() []byte {
+	b := make([]byte, 80+2*8+46+8)
+	handTimestamp(b[16:])
+	wl_u32(b[28:], 1)
+	wl_u64(b[40:], 42)
+	fillPattern(b[48:72])
+	wl_u32(b[72:], 2)
+	wl_u32(b[76:], 46+8)
+	wl_u32(b[80:], 100)
+	wl_u32(b[84:], 0)
+	wl_u32(b[88:], 4000)
+	wl_u32(b[92:], 3990)
+	handEntityID(b[96:], "*Hand Implementation")
+	wl_u32(b[128:], 5)
+	wl_u32(b[132:], 2)
+	wl_u16(b[136:], 0x0250)
+	wl_u16(b[138:], 0x0250)
+	wl_u16(b[140:], 0x0260)
+	fillPattern(b[142:])
+	handTag(b, DESCRIPTOR_LOGICAL_VOLUME_INTEGRITY, 64)
+	return b
+}
+
+func handFileSet() []byte {
+	b := make([]byte, 512)
+	fillPattern(b[480:])
+	handTimestamp(b[16:])
+	wl_u16(b[28:], 3)
+	wl_u16(b[30:], 3)
+	wl_u32(b[32:], 1)
+	wl_u32(b[36:], 1)
+	handCharSpec(b[48:])
+	handDstring(b[112:240], "Hand volume")
+	handCharSpec(b[240:])
+	handDstring(b[304:336], "Hand file set")
+	wl_u32(b[400:], 2048)
+	wl_u32(b[404:], 2)
+	handEntityID(b[416:], "*OSTA UDF Compliant")
+	handTag(b, DESCRIPTOR_FILE_SET, 0)
+	return b
+}
+
+func handIdentifier() []byte {
+	b := make([]byte, 84)
+	wl_u16(b[16:], 1)
+	b[18] = FILE_CHARACTERISTIC_HIDDEN
+	b[19] = 11
+	wl_u32(b[20:], 2048)
+	wl_u32(b[24:], 5)
+	fillPattern(b[30:36])
+	wl_u16(b[36:], 32)
+	handEntityID(b[38:], "*Hand Implementation")
+	b[70] = 8
+	copy(b[71:], "readme.txt")
+	handTag(b, DESCRIPTOR_IDENTIFIER, 3)
+	return b
+}
+
+func handICBTag(b []byte, fileType uint8, flags uint16) {
+	wl_u16(b[4:], 4)
+	wl_u16(b[8:], 1)
+	b[11] = fileType
+	wl_u32(b[12:], 2)
+	wl_u16(b[18:], flags)
+}
+
+// handFileEntry records an extended attribute header and a long
+// allocation descriptor
+func handFileEntry() []byte {
+	b := make([]byte, 176+24+16)
+	handICBTag(b[16:], FILE_TYPE_REGULAR, uint16(LongDescriptors)|ICB_FLAG_SETGID)
+	wl_u32(b[36:], 1000)
+	wl_u32(b[40:], 100)
+	wl_u32(b[44:], 0x14A5)
+	wl_u16(b[48:], 1)
+	wl_u64(b[56:], 5000)
+	wl_u64(b[64:], 3)
+	handTimestamp(b[72:])
+	handTimestamp(b[84:])
+	handTimestamp(b[96:])
+	wl_u32(b[108:], 1)
+	handEntityID(b[128:], "*Hand Implementation")
+	wl_u64(b[160:], 17)
+	wl_u32(b[168:], 24)
+	wl_u32(b[172:], 16)
+	ea := b[176:200]
+	wl_u16(ea[0:], DESCRIPTOR_EXTENDED_ATTRIBUTE_HEADER)
+	wl_u16(ea[2:], 3)
+	wl_u16(ea[10:], 8)
+	wl_u32(ea[12:], 5)
+	wl_u32(ea[16:], 24)
+	wl_u32(ea[20:], 24)
+	wl_u32(b[200:], 5000)
+	wl_u32(b[204:], 20)
+	fillPattern(b[210:216])
+	handTag(b, DESCRIPTOR_FILE_ENTRY, 5)
+	return b
+}
+
+func handExtendedFileEntry() []byte {
+	b := make([]byte, 216+8)
+	handICBTag(b[16:], FILE_TYPE_DIRECTORY, uint16(ShortDescriptors))
+	wl_u32(b[36:], 0xFFFFFFFF)
+	wl_u32(b[40:], 0xFFFFFFFF)
+	wl_u32(b[44:], 0x1CE7)
+	wl_u16(b[48:], 2)
+	wl_u64(b[56:], 2048)
+	wl_u64(b[64:], 2048)
+	wl_u64(b[72:], 1)
+	handTimestamp(b[80:])
+	handTimestamp(b[92:])
+	handTimestamp(b[104:])
+	handTimestamp(b[116:])
+	wl_u32(b[128:], 1)
+	fillPattern(b[132:136])
+	handEntityID(b[168:], "*Hand Implementation")
+	wl_u64(b[200:], 16)
+	wl_u32(b[212:], 8)
+	wl_u32(b[216:], 2048)
+	wl_u32(b[220:], 21)
+	handTag(b, DESCRIPTOR_EXTENDED_FILE_ENTRY, 6)
+	return b
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		build  func() []byte
+		decode func(b []byte) encoding.BinaryMarshaler
+	}{
+		{"anchor", handAnchor, func(b []byte) encoding.BinaryMarshaler { return NewAnchorVolumeDescriptorPointer(b) }},
+		{"primary volume", handPrimaryVolume, func(b []byte) encoding.BinaryMarshaler { return NewPrimaryVolumeDescriptor(b) }},
+		{"partition", handPartition, func(b []byte) encoding.BinaryMarshaler { return NewPartitionDescriptor(b) }},
+		{"logical volume", handLogicalVolume, func(b []byte) encoding.BinaryMarshaler { return NewLogicalVolumeDescriptor(b) }},
+		{"integrity", handIntegrity, func(b []byte) encoding.BinaryMarshaler { return NewLogicalVolumeIntegrityDescriptor(b) }},
+		{"file set", handFileSet, func(b []byte) encoding.BinaryMarshaler { return NewFileSetDescriptor(b) }},
+		{"file identifier", handIdentifier, func(b []byte) encoding.BinaryMarshaler { return NewFileIdentifierDescriptor(b) }},
+		{"file entry", handFileEntry, func(b []byte) encoding.BinaryMarshaler { return NewFileEntry(0, b).(*FileEntry) }},
+		{"extended file entry", handExtendedFileEntry, func(b []byte) encoding.BinaryMarshaler { return NewFileEntry(0, b).(*ExtendedFileEntry) }},
+	}
+	for _, test := range tests {
+		recorded := test.build()
+		if !NewDescriptor(recorded).Valid() {
+			t.Fatalf("%s: hand-built descriptor has a bad tag", test.name)
+		}
+		b, err := test.decode(append([]byte(nil), recorded...)).MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(b, recorded) {
+			for i := range recorded {
+				if i >= len(b) || b[i] != recorded[i] {
+					t.Errorf("%s: encoded %d bytes differing from the %d recorded from byte %d", test.name, len(b), len(recorded), i)
+					break
+				}
+			}
+			if len(b) > len(recorded) {
+				t.Errorf("%s: encoded %d bytes, %d recorded", test.name, len(b), len(recorded))
+			}
+		}
+	}
+}
+
+func TestMarshalPartitionMaps(t *testing.T) {
+	lvd := NewLogicalVolumeDescriptor(handLogicalVolume())
+	if n := len(lvd.PartitionMaps); n != 2 {
+		t.Fatalf("decoded %d partition maps, want 2", n)
+	}
+	if pm := lvd.PartitionMaps[0]; pm.VolumeSequenceNumber != 1 || pm.PartitionNumber != 0 {
+		t.Errorf("type 1 map decoded as volume %d partition %d", pm.VolumeSequenceNumber, pm.PartitionNumber)
+	}
+	if pm := lvd.PartitionMaps[1]; pm.PartitionTypeIdentifier.IdentifierString() != "*UDF Metadata Partition" || pm.VolumeSequenceNumber != 1 {
+		t.Errorf("type 2 map decoded as %q of volume %d", pm.PartitionTypeIdentifier.IdentifierString(), pm.VolumeSequenceNumber)
+	}
+
+	// Dropping the metadata map shortens the table
+	lvd.PartitionMaps = lvd.PartitionMaps[:1]
+	b, _ := lvd.MarshalBinary()
+	if len(b) != 446 || rl_u32(b[264:]) != 6 || rl_u32(b[268:]) != 1 || !NewDescriptor(b).Valid() {
+		t.Errorf("encoded %d bytes with a %d byte table of %d maps", len(b), rl_u32(b[264:]), rl_u32(b[268:]))
+	}
+}
+
+func TestMarshalIdentifier(t *testing.T) {
+	recorded := handIdentifier()
+	fid := NewFileIdentifierDescriptor(append([]byte(nil), recorded...))
+	if fid.FileIdentifier != "readme.txt" {
+		t.Fatalf("decoded identifier %q", fid.FileIdentifier)
+	}
+	fid.FileIdentifier = "a longer name.txt"
+	b, _ := fid.MarshalBinary()
+	renamed := NewFileIdentifierDescriptor(b)
+	if renamed.FileIdentifier != "a longer name.txt" || renamed.Len() != uint64(len(b)) || !renamed.Descriptor.Valid() {
+		t.Errorf("renamed to %q in %d bytes, %d long", renamed.FileIdentifier, len(b), renamed.Len())
+	}
+	if !bytes.Equal(b[20:70], recorded[20:70]) {
+		t.Errorf("renaming changed the ICB or implementation use")
+	}
+}
@@ -0,0 +1,226 @@
+package udf
+
+import "sort"
+
+// Structures occupying the sectors of an image
+const (
+	SECTOR_VRS               = "volume recognition sequence"
+	SECTOR_ANCHOR            = "anchor"
+	SECTOR_MAIN_VDS          = "main volume descriptor sequence"
+	SECTOR_RESERVE_VDS       = "reserve volume descriptor sequence"
+	SECTOR_INTEGRITY         = "integrity sequence"
+	SECTOR_FILE_SET          = "file set descriptor"
+	SECTOR_SPACE_BITMAP      = "space bitmap"
+	SECTOR_METADATA_FILE     = "metadata file"
+	SECTOR_VAT               = "virtual allocation table"
+	SECTOR_FILE_ENTRY        = "file entry"
+	SECTOR_ALLOCATION_EXTENT = "allocation extent descriptor"
+	SECTOR_FILE_DATA         = "file data"
+	SECTOR_DIRECTORY_DATA    = "directory data"
+)
+
+// SectorOwner is a structure recorded in a run of sectors of the image
+type SectorOwner struct {
+	// Kind is one of the SECTOR_* constants
+	Kind string
+	// Path is the file or directory the sectors belong to, empty for the
+	// volume structures
+	Path string
+	// Start is the first sector of the run and End the sector past it
+	Start uint64
+	End   uint64
+	// Offset is the position of the Start sector in the data of the file,
+	// for file and directory data
+	Offset int64
+}
+
+// sectorIndex lists the owners of the sectors of an image by start sector
+type sectorIndex struct {
+	owners []SectorOwner
+	// maxEnd is the highest end of the owners up to each index
+	maxEnd []uint64
+}
+
+// indexer collects the owners of the volume structures, merging runs
+// marked sector by sector
+type indexer struct {
+	owners []SectorOwner
+}
+
+func (ix *indexer) add(owner SectorOwner) {
+	if owner.End <= owner.Start {
+		return
+	}
+	if n := len(ix.owners); n > 0 {
+		last := &ix.owners[n-1]
+		if last.Kind == owner.Kind && last.Path == owner.Path && last.End == owner.Start {
+			last.End = owner.End
+			return
+		}
+	}
+	ix.owners = append(ix.owners, owner)
+}
+
+// marker returns a function adding the runs of sectors it is called with
+func (ix *indexer) marker(kind string, path string) func(from uint64, to uint64) {
+	return func(from uint64, to uint64) {
+		ix.add(SectorOwner{Kind: kind, Path: path, Start: from, End: to})
+	}
+}
+
+// validAnchors returns the sectors of the image recording a valid anchor,
+// including the one the volume was opened from
+func (udf *Udf) validAnchors() (sectors []uint64) {
+	last := uint64(readerSize(udf.r)) / udf.SECTOR_SIZE
+	candidates := append(anchorSectors(last), udf.anchor)
+	seen := make(map[uint64]bool)
+	for _, sector := range candidates {
+		if sector == 0 || sector >= last || seen[sector] {
+			continue
+		}
+		seen[sector] = true
+		desc := NewDescriptor(udf.ReadSector(sector))
+		if desc.TagIdentifier == DESCRIPTOR_ANCHOR_VOLUME_POINTER && uint64(desc.TagLocation) == sector && desc.Valid() {
+			sectors = append(sectors, sector)
+		}
+	}
+	return
+}
+
+// vrsIdentifiers are the volume structure descriptors that may make up a
+// volume recognition sequence
+var vrsIdentifiers = map[string]bool{"BEA01": true, "NSR02": true, "NSR03": true, "TEA01": true, "CD001": true, "BOOT2": true, "CDW02": true}
+
+// indexVolumeStructures adds the volume recognition sequence, anchors,
+// volume descriptor sequences and integrity sequence
+func (udf *Udf) indexVolumeStructures(ix *indexer) {
+	// The recognition sequence is recorded from byte 32768 in records of
+	// 2048 bytes or a sector
+	recordSize := maxUint64(2048, udf.SECTOR_SIZE)
+	for offset := uint64(32768); offset < 32768+64*recordSize; offset += recordSize {
+		record := make([]byte, 7)
+		udf.r.ReadAt(record, int64(offset))
+		if !vrsIdentifiers[string(record[1:6])] {
+			break
+		}
+		ix.marker(SECTOR_VRS, "")(offset/udf.SECTOR_SIZE, (offset+recordSize)/udf.SECTOR_SIZE)
+	}
+
+	anchors := udf.validAnchors()
+	sequences := make(map[uint32]bool)
+	for _, sector := range anchors {
+		ix.marker(SECTOR_ANCHOR, "")(sector, sector+1)
+	}
+	for _, sector := range anchors {
+		anchor := NewAnchorVolumeDescriptorPointer(udf.ReadSector(sector))
+		kinds := []string{SECTOR_MAIN_VDS, SECTOR_RESERVE_VDS}
+		for i, extent := range []Extent{anchor.MainVolumeDescriptorSeq, anchor.ReserveVolumeDescriptorSeq} {
+			if extent.Length == 0 || sequences[extent.Location] {
+				continue
+			}
+			sequences[extent.Location] = true
+			start := uint64(extent.Location)
+			ix.marker(kinds[i], "")(start, start+(uint64(extent.Length)+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE)
+		}
+	}
+	extent := udf.lvd.IntegritySequenceExtent
+	visited := make(map[uint32]bool)
+	for extent.Length > 0 && !visited[extent.Location] {
+		visited[extent.Location] = true
+		start := uint64(extent.Location)
+		end := start + (uint64(extent.Length)+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE
+		ix.marker(SECTOR_INTEGRITY, "")(start, end)
+		next := Extent{}
+		for sector := start; sector < end; sector++ {
+			desc := NewDescriptor(udf.ReadSector(sector))
+			if desc.TagIdentifier != DESCRIPTOR_LOGICAL_VOLUME_INTEGRITY {
+				break
+			}
+			next = desc.LogicalVolumeIntegrityDescriptor().NextIntegrityExtent
+		}
+		extent = next
+	}
+}
+
+// indexPartitionStructures adds the file set descriptors, space bitmaps,
+// metadata files and virtual allocation table
+func (udf *Udf) indexPartitionStructures(c *fsck, ix *indexer) {
+	c.markFileSets(ix.marker(SECTOR_FILE_SET, ""))
+	for i := range udf.lvd.PartitionMaps {
+		for _, sector := range udf.spaceBitmapSectors(uint16(i)) {
+			ix.marker(SECTOR_SPACE_BITMAP, "")(sector, sector+1)
+		}
+	}
+	for _, pd := range udf.partitionDescriptors() {
+		c.markMetadataFiles(pd, ix.marker(SECTOR_METADATA_FILE, ""))
+	}
+	for i := range udf.vat {
+		mark := ix.marker(SECTOR_VAT, "")
+		mark(udf.vatSector, udf.vatSector+1)
+		fe := NewFileEntry(udf.physicalPartition(i), udf.ReadSector(udf.vatSector))
+		if fe.GetICBTag().AllocationType == Embedded {
+			continue
+		}
+		udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+			if !aed && desc.IsNotRecorded() {
+				return
+			}
+			for _, sector := range udf.partitionSectors(partition, desc.GetLocation(), ExtentLength(desc)) {
+				mark(sector, sector+1)
+			}
+		})
+	}
+}
+
+// sectorOwners builds the index of the owners of the image sectors once
+func (udf *Udf) sectorOwners() *sectorIndex {
+	if udf.owners != nil {
+		return udf.owners
+	}
+	c := &fsck{
+		udf:     udf,
+		entries: make(map[LbAddr]*fsckEntry),
+	}
+	for _, fsd := range udf.fileSets {
+		c.addFileSet(fsd)
+	}
+	ix := &indexer{}
+	for _, ext := range c.extents {
+		ix.owners = append(ix.owners, SectorOwner{Kind: ext.kind, Path: ext.owner, Start: ext.start, End: ext.end, Offset: ext.offset})
+	}
+	udf.indexVolumeStructures(ix)
+	udf.indexPartitionStructures(c, ix)
+
+	index := &sectorIndex{owners: ix.owners}
+	sort.SliceStable(index.owners, func(i, j int) bool { return index.owners[i].Start < index.owners[j].Start })
+	var maxEnd uint64
+	for _, owner := range index.owners {
+		maxEnd = maxUint64(maxEnd, owner.End)
+		index.maxEnd = append(index.maxEnd, maxEnd)
+	}
+	udf.owners = index
+	return index
+}
+
+// overlapping returns the owners of sectors between start and end
+func (index *sectorIndex) overlapping(start uint64, end uint64) (owners []SectorOwner) {
+	i := sort.Search(len(index.owners), func(i int) bool { return index.owners[i].Start >= end })
+	for i--; i >= 0 && index.maxEnd[i] > start; i-- {
+		if index.owners[i].End > start {
+			owners = append([]SectorOwner{index.owners[i]}, owners...)
+		}
+	}
+	return
+}
+
+// WhoOwns returns the structures recorded in the given sector of the image,
+// the most specific first: a file's data comes before the metadata file
+// holding it. An empty list means the sector is not in use.
+func (udf *Udf) WhoOwns(sector uint64) []SectorOwner {
+	udf.init()
+	owners := udf.sectorOwners().overlapping(sector, sector+1)
+	sort.SliceStable(owners, func(i, j int) bool {
+		return owners[i].End-owners[i].Start < owners[j].End-owners[j].Start
+	})
+	return owners
+}
@@ -0,0 +1,409 @@
+package udf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SPARING_TABLE_IDENTIFIER identifies the sparing tables of sparable
+// partitions
+const SPARING_TABLE_IDENTIFIER = "*UDF Sparing Table"
+
+// Partition reads the blocks of a partition of the logical volume from the
+// sectors recording them, as its partition map lays them out
+type Partition interface {
+	// ReadAt reads at a byte offset from the start of the partition
+	io.ReaderAt
+	// ReadBlocks reads n blocks from the given logical block number
+	ReadBlocks(lbn uint64, n uint64) []byte
+	// Sector returns the sector recording a block, false if the block is
+	// not recorded
+	Sector(lbn uint64) (uint64, bool)
+	// run returns the sector recording a block, and how many of the n
+	// blocks from it are recorded in the sectors that follow
+	run(lbn uint64, n uint64) (sector uint64, count uint64, ok bool)
+}
+
+// readBlocks reads n blocks of a partition, panicking on blocks that are
+// not recorded
+func readBlocks(udf *Udf, p Partition, lbn uint64, n uint64) []byte {
+	b := make([]byte, 0, n*udf.SECTOR_SIZE)
+	for n > 0 {
+		sector, count, ok := p.run(lbn, n)
+		if !ok {
+			panic(fmt.Errorf("block %d is not recorded", lbn))
+		}
+		b = append(b, udf.ReadSectors(sector, count)...)
+		lbn += count
+		n -= count
+	}
+	return b
+}
+
+// readPartitionAt reads a partition at a byte offset from its start
+func readPartitionAt(udf *Udf, p Partition, b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("udf: negative offset")
+	}
+	sectorSize := int64(udf.SECTOR_SIZE)
+	for n < len(b) {
+		pos := off + int64(n)
+		lbn := uint64(pos / sectorSize)
+		within := pos % sectorSize
+		sector, count, ok := p.run(lbn, uint64((within+int64(len(b)-n)+sectorSize-1)/sectorSize))
+		if !ok {
+			return n, fmt.Errorf("udf: block %d is not recorded", lbn)
+		}
+		chunk := b[n:]
+		if end := int64(count)*sectorSize - within; int64(len(chunk)) > end {
+			chunk = chunk[:end]
+		}
+		read, err := udf.r.ReadAt(chunk, int64(sector)*sectorSize+within)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func partitionSector(p Partition, lbn uint64) (uint64, bool) {
+	sector, _, ok := p.run(lbn, 1)
+	return sector, ok
+}
+
+// physicalBlocks is a partition recorded as is from its starting sector,
+// for type 1 partition maps
+type physicalBlocks struct {
+	udf   *Udf
+	start uint64
+}
+
+func (p *physicalBlocks) run(lbn uint64, n uint64) (uint64, uint64, bool) {
+	return p.start + lbn, n, true
+}
+
+func (p *physicalBlocks) ReadAt(b []byte, off int64) (int, error) {
+	return readPartitionAt(p.udf, p, b, off)
+}
+
+func (p *physicalBlocks) ReadBlocks(lbn uint64, n uint64) []byte {
+	return readBlocks(p.udf, p, lbn, n)
+}
+
+func (p *physicalBlocks) Sector(lbn uint64) (uint64, bool) {
+	return partitionSector(p, lbn)
+}
+
+// sparableBlocks is a partition of rewritable media whose defective packets
+// are recorded elsewhere, as listed by its sparing table (UDF 2.2.9)
+type sparableBlocks struct {
+	udf          *Udf
+	start        uint64
+	packetLength uint64
+	// spared maps the first block of the spared packets to the sector
+	// recording them instead
+	spared map[uint64]uint64
+}
+
+func (p *sparableBlocks) run(lbn uint64, n uint64) (uint64, uint64, bool) {
+	packet := lbn / p.packetLength * p.packetLength
+	if count := packet + p.packetLength - lbn; n > count {
+		n = count
+	}
+	if sector, ok := p.spared[packet]; ok {
+		return sector + lbn - packet, n, true
+	}
+	return p.start + lbn, n, true
+}
+
+func (p *sparableBlocks) ReadAt(b []byte, off int64) (int, error) {
+	return readPartitionAt(p.udf, p, b, off)
+}
+
+func (p *sparableBlocks) ReadBlocks(lbn uint64, n uint64) []byte {
+	return readBlocks(p.udf, p, lbn, n)
+}
+
+func (p *sparableBlocks) Sector(lbn uint64) (uint64, bool) {
+	return partitionSector(p, lbn)
+}
+
+// newSparableBlocks reads the first valid copy of the sparing table of a
+// sparable partition
+func (udf *Udf) newSparableBlocks(pMap *PartitionMap, pd *PartitionDescriptor) *sparableBlocks {
+	p := &sparableBlocks{
+		udf:          udf,
+		start:        uint64(pd.PartitionStartingLocation),
+		packetLength: 32,
+		spared:       make(map[uint64]uint64),
+	}
+	if len(pMap.data) < 48 {
+		return p
+	}
+	if packetLength := rl_u16(pMap.data[40:]); packetLength != 0 {
+		p.packetLength = uint64(packetLength)
+	}
+	tables := int(pMap.data[42])
+	sectors := (uint64(rl_u32(pMap.data[44:])) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+	for i := 0; i < tables && 48+4*i+4 <= len(pMap.data); i++ {
+		b := udf.ReadSectors(uint64(rl_u32(pMap.data[48+4*i:])), sectors)
+		if len(b) < 56 || NewEntityID(b[16:]).IdentifierString() != SPARING_TABLE_IDENTIFIER {
+			continue
+		}
+		for entry := 0; entry < int(rl_u16(b[48:])) && 56+8*entry+8 <= len(b); entry++ {
+			// Original locations from 0xFFFFFFF0 on mark available or
+			// defective spare packets
+			if original := rl_u32(b[56+8*entry:]); original < 0xFFFFFFF0 {
+				p.spared[uint64(original)] = uint64(rl_u32(b[60+8*entry:]))
+			}
+		}
+		break
+	}
+	return p
+}
+
+// virtualBlocks is a partition of write-once media whose blocks are
+// recorded wherever its virtual allocation table says (UDF 2.2.11)
+type virtualBlocks struct {
+	udf      *Udf
+	vat      *VirtualAllocationTable
+	physical Partition
+}
+
+func (p *virtualBlocks) run(lbn uint64, n uint64) (uint64, uint64, bool) {
+	entries := p.vat.Entries
+	if lbn >= uint64(len(entries)) || entries[lbn] == VAT_ENTRY_UNUSED {
+		return 0, 0, false
+	}
+	count := uint64(1)
+	for count < n && lbn+count < uint64(len(entries)) && entries[lbn+count] == entries[lbn]+uint32(count) {
+		count++
+	}
+	return p.physical.run(uint64(entries[lbn]), count)
+}
+
+func (p *virtualBlocks) ReadAt(b []byte, off int64) (int, error) {
+	return readPartitionAt(p.udf, p, b, off)
+}
+
+func (p *virtualBlocks) ReadBlocks(lbn uint64, n uint64) []byte {
+	return readBlocks(p.udf, p, lbn, n)
+}
+
+func (p *virtualBlocks) Sector(lbn uint64) (uint64, bool) {
+	return partitionSector(p, lbn)
+}
+
+type metadataExtent struct {
+	block    uint64
+	location uint64
+	blocks   uint64
+}
+
+// metadataBlocks is a partition recorded in the metadata file, or its
+// mirror, of a physical partition (UDF 2.2.10)
+type metadataBlocks struct {
+	udf      *Udf
+	physical Partition
+	extents  []metadataExtent
+}
+
+func (p *metadataBlocks) run(lbn uint64, n uint64) (uint64, uint64, bool) {
+	i := sort.Search(len(p.extents), func(i int) bool { return p.extents[i].block+p.extents[i].blocks > lbn })
+	if i == len(p.extents) || p.extents[i].block > lbn {
+		return 0, 0, false
+	}
+	extent := p.extents[i]
+	if count := extent.block + extent.blocks - lbn; n > count {
+		n = count
+	}
+	return p.physical.run(extent.location+lbn-extent.block, n)
+}
+
+func (p *metadataBlocks) ReadAt(b []byte, off int64) (int, error) {
+	return readPartitionAt(p.udf, p, b, off)
+}
+
+func (p *metadataBlocks) ReadBlocks(lbn uint64, n uint64) []byte {
+	return readBlocks(p.udf, p, lbn, n)
+}
+
+func (p *metadataBlocks) Sector(lbn uint64) (uint64, bool) {
+	return partitionSector(p, lbn)
+}
+
+// metadataFile returns the file entry of the metadata file of the given
+// type of a metadata partition, nil if it is not recorded
+func (udf *Udf) metadataFile(partition uint16, fileType uint8) FileEntryInterface {
+	pMap := udf.lvd.PartitionMaps[partition]
+	physical := udf.physicalPartition(partition)
+	for _, location := range pMap.metadataFileLocations() {
+		b := udf.partition(physical).ReadBlocks(uint64(location), 1)
+		desc := NewDescriptor(b)
+		if (desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY) || !desc.Valid() {
+			continue
+		}
+		if fe := NewFileEntry(physical, b); fe.GetICBTag().FileType == fileType {
+			return fe
+		}
+	}
+	return nil
+}
+
+// mainMetadataFile returns the file entry of the metadata file of a
+// metadata partition, or of its mirror if the metadata file is damaged
+func (udf *Udf) mainMetadataFile(partition uint16) FileEntryInterface {
+	if fe := udf.metadataFile(partition, FILE_TYPE_METADATA); fe != nil {
+		return fe
+	}
+	return udf.metadataFile(partition, FILE_TYPE_METADATA_MIRROR)
+}
+
+// newMetadataBlocks maps the blocks of a metadata partition to those of
+// the given metadata or metadata mirror file
+func (udf *Udf) newMetadataBlocks(partition uint16, fe FileEntryInterface) *metadataBlocks {
+	p := &metadataBlocks{udf: udf, physical: udf.partition(udf.physicalPartition(partition))}
+	var block uint64
+	udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		if aed {
+			return
+		}
+		blocks := (uint64(ExtentLength(desc)) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+		if !desc.IsNotRecorded() && blocks > 0 {
+			p.extents = append(p.extents, metadataExtent{block, desc.GetLocation(), blocks})
+		}
+		block += blocks
+	})
+	return p
+}
+
+// isSparable returns true for the type 2 maps of sparable partitions
+func (pm *PartitionMap) isSparable() bool {
+	return pm.PartitionMapType == 2 && pm.PartitionTypeIdentifier.IdentifierString() == "*UDF Sparable Partition"
+}
+
+// isPhysical returns true for the maps of partitions recorded from their
+// starting sector on, possibly through a sparing table
+func (pm *PartitionMap) isPhysical() bool {
+	return pm.PartitionMapType == 1 || pm.isSparable()
+}
+
+// volumePartition identifies a partition of a volume set, whose partition
+// numbers are only unique within a volume
+type volumePartition struct {
+	volume uint16
+	number uint16
+}
+
+// mapDescriptor returns the partition descriptor a partition map refers to
+func (udf *Udf) mapDescriptor(pMap *PartitionMap) (pd *PartitionDescriptor, ok bool) {
+	if udf.volumePd != nil {
+		pd, ok = udf.volumePd[volumePartition{pMap.VolumeSequenceNumber, pMap.PartitionNumber}]
+	} else {
+		pd, ok = udf.pd[pMap.PartitionNumber]
+	}
+	return
+}
+
+// partitionDescriptors returns the partition descriptors of the volume, or
+// of every volume of a volume set, by starting location
+func (udf *Udf) partitionDescriptors() (pds []*PartitionDescriptor) {
+	if udf.volumePd != nil {
+		for _, pd := range udf.volumePd {
+			pds = append(pds, pd)
+		}
+	} else {
+		for _, pd := range udf.pd {
+			pds = append(pds, pd)
+		}
+	}
+	sort.Slice(pds, func(i, j int) bool {
+		if pds[i].PartitionStartingLocation != pds[j].PartitionStartingLocation {
+			return pds[i].PartitionStartingLocation < pds[j].PartitionStartingLocation
+		}
+		return pds[i].PartitionNumber < pds[j].PartitionNumber
+	})
+	return
+}
+
+// readPartitions sets up the partition of each partition map: physical and
+// sparable ones first, as metadata and virtual partitions are recorded in
+// them
+func (udf *Udf) readPartitions() error {
+	maps := udf.lvd.PartitionMaps
+	udf.partitions = make([]Partition, len(maps))
+	for i := range maps {
+		pMap := &maps[i]
+		pd, ok := udf.mapDescriptor(pMap)
+		if !ok {
+			return errors.New("could not find partition number")
+		}
+		if pMap.isPhysical() || pMap.isVirtual() {
+			pMap.PartitionStart = pd.PartitionStartingLocation
+		}
+		switch {
+		case pMap.PartitionMapType != 2:
+			udf.partitions[i] = &physicalBlocks{udf: udf, start: uint64(pd.PartitionStartingLocation)}
+		case pMap.isSparable():
+			udf.partitions[i] = udf.newSparableBlocks(pMap, pd)
+		}
+	}
+	for i := range maps {
+		pMap := &maps[i]
+		if pMap.isPhysical() || pMap.isVirtual() {
+			continue
+		}
+		fe := udf.mainMetadataFile(uint16(i))
+		if fe == nil {
+			return errors.New("could not find the metadata file")
+		}
+		p := udf.newMetadataBlocks(uint16(i), fe)
+		udf.partitions[i] = p
+		if sector, ok := p.Sector(0); ok {
+			pMap.PartitionStart = uint32(sector)
+		}
+	}
+	for i := range maps {
+		if !maps[i].isVirtual() {
+			continue
+		}
+		if err := udf.loadVAT(uint16(i)); err != nil {
+			return err
+		}
+		udf.partitions[i] = &virtualBlocks{udf: udf, vat: udf.vat[uint16(i)], physical: udf.partition(udf.physicalPartition(uint16(i)))}
+	}
+	return nil
+}
+
+// Partition returns the partition of a partition map of the logical volume
+func (udf *Udf) Partition(partition uint16) Partition {
+	udf.init()
+	return udf.partition(partition)
+}
+
+func (udf *Udf) partition(partition uint16) Partition {
+	if int(partition) < len(udf.partitions) && udf.partitions[partition] != nil {
+		return udf.partitions[partition]
+	}
+	// Salvaged volumes only know where their partitions start
+	return &physicalBlocks{udf: udf, start: udf.LogicalPartitionStart(partition)}
+}
+
+// isMapped returns true if a logical block of a partition is recorded,
+// which only virtual and metadata partitions may not be
+func (udf *Udf) isMapped(partition uint16, block uint64) bool {
+	_, ok := udf.partition(partition).Sector(block)
+	return ok
+}
+
+// sectorOf returns the sector recording a logical block of a partition
+func (udf *Udf) sectorOf(partition uint16, block uint64) uint64 {
+	sector, ok := udf.partition(partition).Sector(block)
+	if !ok {
+		panic(fmt.Errorf("block %d of partition %d is not recorded", block, partition))
+	}
+	return sector
+}
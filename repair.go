@@ -0,0 +1,670 @@
+package udf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Fixes applied by Repair
+const (
+	REPAIR_TAG_CHECKSUM    = "tag-checksum"
+	REPAIR_DESCRIPTOR_CRC  = "descriptor-crc"
+	REPAIR_ANCHOR          = "anchor"
+	REPAIR_VOLUME_SEQUENCE = "volume-descriptor-sequence"
+	REPAIR_INTEGRITY       = "logical-volume-integrity"
+)
+
+// RepairFix is a change made, or to be made in dry-run mode, by Repair
+type RepairFix struct {
+	Fix     string
+	Sector  uint64
+	Message string
+}
+
+// sectorOverlay records the sectors rewritten by a repair or an edit on top
+// of the original image, so that each step reads the changes of the previous
+// ones
+type sectorOverlay struct {
+	r          io.ReaderAt
+	sectorSize uint64
+	sectors    map[uint64][]byte
+}
+
+func (o *sectorOverlay) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = o.r.ReadAt(p, off)
+	end := uint64(off) + uint64(len(p))
+	for sector, b := range o.sectors {
+		start := sector * o.sectorSize
+		if start >= end || start+o.sectorSize <= uint64(off) {
+			continue
+		}
+		from, to := maxUint64(start, uint64(off)), minUint64(start+o.sectorSize, end)
+		copy(p[from-uint64(off):to-uint64(off)], b[from-start:to-start])
+		if int(to-uint64(off)) > n {
+			n = int(to - uint64(off))
+		}
+	}
+	if n == len(p) {
+		err = nil
+	}
+	return
+}
+
+type repairer struct {
+	overlay *sectorOverlay
+	udf     *Udf
+	fixes   []RepairFix
+	size    uint64
+}
+
+func (rp *repairer) report(fix string, sector uint64, format string, args ...interface{}) {
+	rp.fixes = append(rp.fixes, RepairFix{fix, sector, fmt.Sprintf(format, args...)})
+}
+
+// readSector reads a sector of the repaired image, zero-filled past its end
+func (rp *repairer) readSector(sector uint64) []byte {
+	b := make([]byte, rp.overlay.sectorSize)
+	rp.overlay.ReadAt(b, int64(sector*rp.overlay.sectorSize))
+	return b
+}
+
+func (rp *repairer) writeSector(sector uint64, b []byte) {
+	rp.overlay.sectors[sector] = append([]byte(nil), b[:rp.overlay.sectorSize]...)
+}
+
+// fixTag recomputes the checksum and CRC of a descriptor recorded at the
+// given location if they do not match, and reports the fix. It returns true
+// if b was changed.
+func (rp *repairer) fixTag(b []byte, sector uint64, name string) bool {
+	desc := NewDescriptor(b)
+	if desc.Valid() {
+		return false
+	}
+	crcOK := desc.ValidCRC()
+	setDescriptorTag(b)
+	if !crcOK {
+		rp.report(REPAIR_DESCRIPTOR_CRC, sector, "recomputed the CRC of the %s", name)
+	} else {
+		rp.report(REPAIR_TAG_CHECKSUM, sector, "recomputed the tag checksum of the %s", name)
+	}
+	return true
+}
+
+// fixSectorTag checks the descriptor at the start of a sector, which must
+// have the given tag identifier and location
+func (rp *repairer) fixSectorTag(sector uint64, tagIdentifier uint16, tagLocation uint32, name string) {
+	b := rp.readSector(sector)
+	desc := NewDescriptor(b)
+	if desc.TagIdentifier != tagIdentifier || desc.TagLocation != tagLocation {
+		return
+	}
+	if rp.fixTag(b, sector, name) {
+		rp.writeSector(sector, b)
+	}
+}
+
+// Repair checks a volume for damage that can be fixed without guessing and
+// writes the fixes to w, which normally writes to the same image as r:
+//
+//   - tag checksums and CRCs of the volume and file system descriptors
+//   - anchors missing or corrupt at sector 256 or at the end of the volume,
+//     rebuilt from a surviving one
+//   - a damaged main or reserve volume descriptor sequence, rebuilt from the
+//     other copy
+//   - an open Logical Volume Integrity Descriptor, closed with recomputed
+//     free space and file and directory counts
+//
+// In dry-run mode, w may be nil and nothing is written. The fixes are
+// returned either way.
+func Repair(r io.ReaderAt, w io.WriterAt, dryRun bool) ([]RepairFix, error) {
+	rp := &repairer{
+		overlay: &sectorOverlay{r: r, sectors: make(map[uint64][]byte)},
+		size:    uint64(readerSize(r)),
+	}
+	anchor, err := rp.repairAnchors()
+	if err != nil {
+		return nil, err
+	}
+	rp.repairVolumeDescriptors(anchor)
+	if err := rp.openVolume(); err != nil {
+		return rp.fixes, rp.flush(w, dryRun, err)
+	}
+	rp.repairFileSets()
+	rp.repairSpaceBitmaps()
+	rp.repairIntegrity()
+	return rp.fixes, rp.flush(w, dryRun, nil)
+}
+
+// flush writes the repaired sectors in disc order, unless in dry-run mode
+func (rp *repairer) flush(w io.WriterAt, dryRun bool, err error) error {
+	if dryRun || len(rp.overlay.sectors) == 0 {
+		return err
+	}
+	if w == nil {
+		return errors.New("no writer to record the fixes")
+	}
+	if werr := rp.overlay.writeTo(w, nil); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// writeTo writes the recorded sectors in disc order, except those skipped
+func (o *sectorOverlay) writeTo(w io.WriterAt, skip map[uint64]bool) error {
+	sectors := make([]uint64, 0, len(o.sectors))
+	for sector := range o.sectors {
+		if !skip[sector] {
+			sectors = append(sectors, sector)
+		}
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	for _, sector := range sectors {
+		if _, err := w.WriteAt(o.sectors[sector], int64(sector*o.sectorSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anchorSectors returns the sectors that may record an anchor in an image
+// of the given number of sectors: 256, N-256 and N-1
+func anchorSectors(last uint64) []uint64 {
+	sectors := []uint64{256}
+	if last > 512 {
+		sectors = append(sectors, last-256)
+	}
+	if last > 257 {
+		sectors = append(sectors, last-1)
+	}
+	return sectors
+}
+
+// repairAnchors finds the sector size from the surviving anchors and
+// rebuilds the missing or corrupt ones
+func (rp *repairer) repairAnchors() (*AnchorVolumeDescriptorPointer, error) {
+	var template []byte
+	var found []uint64
+	recorded := make(map[uint64]bool)
+	for rp.overlay.sectorSize = 512; rp.overlay.sectorSize <= 32768; rp.overlay.sectorSize <<= 1 {
+		found = found[:0]
+		for _, sector := range anchorSectors(rp.size / rp.overlay.sectorSize) {
+			b := rp.readSector(sector)
+			desc := NewDescriptor(b)
+			if desc.TagIdentifier != DESCRIPTOR_ANCHOR_VOLUME_POINTER || uint64(desc.TagLocation) != sector {
+				continue
+			}
+			recorded[sector] = true
+			// An anchor whose CRC holds only lost its tag checksum
+			if desc.ValidCRC() {
+				found = append(found, sector)
+				if template == nil {
+					template = b
+				}
+			}
+		}
+		if template != nil {
+			break
+		}
+		for sector := range recorded {
+			delete(recorded, sector)
+		}
+	}
+	if template == nil {
+		return nil, errors.New("no surviving anchor volume descriptor pointer")
+	}
+	for _, sector := range found {
+		rp.fixSectorTag(sector, DESCRIPTOR_ANCHOR_VOLUME_POINTER, uint32(sector), "anchor volume descriptor pointer")
+	}
+
+	anchor := NewAnchorVolumeDescriptorPointer(template)
+	sectors := anchorSectors(rp.size / rp.overlay.sectorSize)
+	for _, sector := range sectors {
+		valid := false
+		for _, f := range found {
+			valid = valid || f == sector
+		}
+		if valid {
+			continue
+		}
+		// Sector 256 and the last sector must record an anchor; N-256 is only
+		// rebuilt where one was recorded
+		last := sector == rp.size/rp.overlay.sectorSize-1
+		required := sector == 256 || (last && !rp.inVolumeStructures(anchor, sector))
+		if !recorded[sector] && !required {
+			continue
+		}
+		b := append([]byte(nil), template...)
+		binary.LittleEndian.PutUint32(b[12:], uint32(sector))
+		setDescriptorTag(b)
+		rp.writeSector(sector, b)
+		rp.report(REPAIR_ANCHOR, sector, "rebuilt the anchor volume descriptor pointer at sector %d", sector)
+	}
+	return anchor, nil
+}
+
+// inVolumeStructures returns true if a sector lies within a partition or a
+// volume descriptor sequence, where an anchor must not be written
+func (rp *repairer) inVolumeStructures(anchor *AnchorVolumeDescriptorPointer, sector uint64) bool {
+	for _, extent := range []Extent{anchor.MainVolumeDescriptorSeq, anchor.ReserveVolumeDescriptorSeq} {
+		blocks := (uint64(extent.Length) + rp.overlay.sectorSize - 1) / rp.overlay.sectorSize
+		if sector >= uint64(extent.Location) && sector < uint64(extent.Location)+blocks {
+			return true
+		}
+		for _, desc := range rp.readSequence(extent) {
+			if desc.TagIdentifier != DESCRIPTOR_PARTITION || !desc.ValidCRC() {
+				continue
+			}
+			pd := desc.PartitionDescriptor()
+			if sector >= uint64(pd.PartitionStartingLocation) && sector < uint64(pd.PartitionStartingLocation)+uint64(pd.PartitionLength) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readSequence reads the descriptors of a volume descriptor sequence up to
+// its terminating descriptor or its first blank sector
+func (rp *repairer) readSequence(extent Extent) (descs []*Descriptor) {
+	blocks := uint64(extent.Length) / rp.overlay.sectorSize
+	blank := make([]byte, rp.overlay.sectorSize)
+	for i := uint64(0); i < blocks; i++ {
+		b := rp.readSector(uint64(extent.Location) + i)
+		if bytes.Equal(b, blank) {
+			break
+		}
+		desc := NewDescriptor(b)
+		descs = append(descs, desc)
+		if desc.TagIdentifier == DESCRIPTOR_TERMINATING && desc.Valid() {
+			break
+		}
+	}
+	return
+}
+
+// sequenceDamaged returns true if a descriptor of a sequence does not check
+// out, or if the sequence is not terminated
+func sequenceDamaged(descs []*Descriptor, extent Extent) bool {
+	if len(descs) == 0 {
+		return true
+	}
+	for i, desc := range descs {
+		if desc.TagIdentifier < DESCRIPTOR_PRIMARY_VOLUME || desc.TagIdentifier > DESCRIPTOR_TERMINATING ||
+			desc.TagLocation != extent.Location+uint32(i) || !desc.Valid() {
+			return true
+		}
+	}
+	return false
+}
+
+// repairVolumeDescriptors rebuilds a damaged volume descriptor sequence from
+// the other copy, or fixes the tags of both if both are damaged
+func (rp *repairer) repairVolumeDescriptors(anchor *AnchorVolumeDescriptorPointer) {
+	main, reserve := anchor.MainVolumeDescriptorSeq, anchor.ReserveVolumeDescriptorSeq
+	mainDescs, reserveDescs := rp.readSequence(main), rp.readSequence(reserve)
+	mainDamaged, reserveDamaged := sequenceDamaged(mainDescs, main), sequenceDamaged(reserveDescs, reserve)
+	copySequence := func(descs []*Descriptor, to Extent, name string) {
+		if uint64(len(descs)) > uint64(to.Length)/rp.overlay.sectorSize {
+			return
+		}
+		for i, desc := range descs {
+			b := make([]byte, rp.overlay.sectorSize)
+			copy(b, desc.data)
+			binary.LittleEndian.PutUint32(b[12:], to.Location+uint32(i))
+			setDescriptorTag(b)
+			rp.writeSector(uint64(to.Location)+uint64(i), b)
+		}
+		rp.report(REPAIR_VOLUME_SEQUENCE, uint64(to.Location), "rebuilt the %s volume descriptor sequence from the other copy", name)
+	}
+	switch {
+	case mainDamaged && !reserveDamaged && main.Length > 0:
+		copySequence(reserveDescs, main, "main")
+	case reserveDamaged && !mainDamaged && reserve.Length > 0:
+		copySequence(mainDescs, reserve, "reserve")
+	case mainDamaged && reserveDamaged:
+		for _, seq := range []struct {
+			extent Extent
+			descs  []*Descriptor
+		}{{main, mainDescs}, {reserve, reserveDescs}} {
+			for i, desc := range seq.descs {
+				if desc.TagIdentifier >= DESCRIPTOR_PRIMARY_VOLUME && desc.TagIdentifier <= DESCRIPTOR_TERMINATING {
+					sector := uint64(seq.extent.Location) + uint64(i)
+					rp.fixSectorTag(sector, desc.TagIdentifier, uint32(sector), "volume descriptor")
+				}
+			}
+		}
+	}
+}
+
+// openVolume opens the repaired image, fixing the tags of the file set
+// descriptors first if that is what keeps it from opening
+func (rp *repairer) openVolume() error {
+	open := func() (udf *Udf, err error) {
+		udf = &Udf{
+			r:  rp.overlay,
+			pd: make(map[uint16]*PartitionDescriptor),
+		}
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = fmt.Errorf("%v", rec)
+			}
+		}()
+		err = udf.init()
+		return
+	}
+	udf, err := open()
+	if err != nil && !udf.partitionsResolved() {
+		return err
+	}
+	rp.udf = udf
+	rp.repairFileSetDescriptors()
+	if err != nil {
+		if rp.udf, err = open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairFileSetDescriptors fixes the tags of the file set descriptor
+// sequences
+func (rp *repairer) repairFileSetDescriptors() {
+	udf := rp.udf
+	extent := udf.lvd.LogicalVolumeContentsUse
+	visited := make(map[LbAddr]bool)
+	for extent.GetLength() > 0 && !visited[extent.Location] && int(extent.GetPartition()) < len(udf.lvd.PartitionMaps) {
+		visited[extent.Location] = true
+		next := ExtentLong{}
+		for block := extent.GetLocation(); block < extent.GetLocation()+maxUint64(1, (uint64(ExtentLength(extent))+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE); block++ {
+			if !udf.isMapped(extent.GetPartition(), block) {
+				break
+			}
+			sector := udf.sectorOf(extent.GetPartition(), block)
+			desc := NewDescriptor(rp.readSector(sector))
+			if desc.TagIdentifier == DESCRIPTOR_TERMINATING {
+				rp.fixSectorTag(sector, DESCRIPTOR_TERMINATING, uint32(block), "terminating descriptor")
+				break
+			}
+			if desc.TagIdentifier != DESCRIPTOR_FILE_SET {
+				break
+			}
+			rp.fixSectorTag(sector, DESCRIPTOR_FILE_SET, uint32(block), "file set descriptor")
+			next = NewFileSetDescriptor(rp.readSector(sector)).NexExtent
+		}
+		extent = next
+	}
+}
+
+// repairFileSets fixes the tags of every file entry, allocation extent
+// descriptor and file identifier descriptor of the file sets
+func (rp *repairer) repairFileSets() {
+	visited := make(map[LbAddr]bool)
+	for _, fsd := range rp.udf.fileSets {
+		rp.repairEntry(fsd.RootDirectoryICB, visited)
+		if streams := fsd.SystemStreamDirectoryICB; streams.GetLength() > 0 {
+			rp.repairEntry(streams, visited)
+		}
+	}
+}
+
+func (rp *repairer) repairEntry(icb ExtentLong, visited map[LbAddr]bool) {
+	udf := rp.udf
+	if visited[icb.Location] || int(icb.GetPartition()) >= len(udf.lvd.PartitionMaps) || icb.GetLocation() >= udf.partitionBlocks(icb.GetPartition()) {
+		return
+	}
+	visited[icb.Location] = true
+
+	entries := udf.readICBHierarchy(icb)
+	for i, e := range entries {
+		desc := e.fe.GetDescriptor()
+		if (desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY) ||
+			desc.TagLocation != e.location.LogicalBlockNumber {
+			continue
+		}
+		sector := udf.sectorOf(e.location.PartitionReferenceNumber, uint64(e.location.LogicalBlockNumber))
+		b := rp.readSector(sector)
+		changed := false
+		if i == len(entries)-1 && isDirectoryEntry(e.fe) && e.fe.GetICBTag().AllocationType == Embedded {
+			changed = rp.repairEmbeddedDirectory(b, sector)
+		}
+		if rp.fixTag(b, sector, "file entry") || changed {
+			rp.writeSector(sector, b)
+		}
+	}
+
+	fe := udf.readFileEntry(icb)
+	if fe.GetICBTag().AllocationType != Embedded {
+		udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+			if aed {
+				rp.fixSectorTag(udf.sectorOf(partition, desc.GetLocation()), DESCRIPTOR_ALLOCATION_EXTENT, uint32(desc.GetLocation()), "allocation extent descriptor")
+			}
+		})
+		if isDirectoryEntry(fe) {
+			rp.repairDirectory(fe)
+		}
+	}
+
+	if isDirectoryEntry(fe) {
+		for _, f := range udf.ReadDirAll(fe, FILE_CHARACTERISTIC_HIDDEN|FILE_CHARACTERISTIC_METADATA) {
+			rp.repairEntry(f.Fid.ICB, visited)
+		}
+	}
+	if eaICB := fe.GetExtendedAttributeICB(); eaICB.GetLength() > 0 {
+		rp.repairEntry(eaICB, visited)
+	}
+	if streams := fe.GetStreamDirectoryICB(); streams.GetLength() > 0 {
+		rp.repairEntry(streams, visited)
+	}
+}
+
+func isDirectoryEntry(fe FileEntryInterface) bool {
+	fileType := fe.GetICBTag().FileType
+	return fileType == FILE_TYPE_DIRECTORY || fileType == FILE_TYPE_STREAM_DIRECTORY
+}
+
+// repairFileIdentifiers fixes the tags of the file identifier descriptors
+// of directory data, returning true if any was changed
+func (rp *repairer) repairFileIdentifiers(data []byte, sectorOf func(off uint64) uint64) (changed bool) {
+	for off := uint64(0); off+38 <= uint64(len(data)); {
+		fid := NewFileIdentifierDescriptor(data[off:])
+		length := fid.Len()
+		if fid.Descriptor.TagIdentifier != DESCRIPTOR_IDENTIFIER || off+38+uint64(fid.LengthOfImplementationUse)+uint64(fid.LengthOfFileIdentifier) > uint64(len(data)) {
+			break
+		}
+		end := minUint64(off+length, uint64(len(data)))
+		if rp.fixTag(data[off:end], sectorOf(off), fmt.Sprintf("file identifier descriptor %q", fid.FileIdentifier)) {
+			changed = true
+		}
+		off += length
+	}
+	return
+}
+
+// repairEmbeddedDirectory fixes the file identifiers recorded in place of
+// the allocation descriptors of a directory's file entry, held in b
+func (rp *repairer) repairEmbeddedDirectory(b []byte, sector uint64) bool {
+	start, length := uint64(176)+uint64(rl_u32(b[168:])), uint64(rl_u32(b[172:]))
+	if rl_u16(b) == DESCRIPTOR_EXTENDED_FILE_ENTRY {
+		start, length = uint64(216)+uint64(rl_u32(b[208:])), uint64(rl_u32(b[212:]))
+	}
+	if start+length > uint64(len(b)) {
+		return false
+	}
+	return rp.repairFileIdentifiers(b[start:start+length], func(uint64) uint64 { return sector })
+}
+
+// repairDirectory fixes the file identifiers recorded in the extents of a
+// directory
+func (rp *repairer) repairDirectory(fe FileEntryInterface) {
+	udf := rp.udf
+	type segment struct {
+		off    uint64
+		length uint64
+		sector uint64
+	}
+	var segments []segment
+	var data []byte
+	udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		if aed {
+			return
+		}
+		length := uint64(ExtentLength(desc))
+		buf := make([]byte, length)
+		if !desc.IsNotRecorded() {
+			// One segment per block, as virtual blocks are mapped one by one
+			for off := uint64(0); off < length; off += udf.SECTOR_SIZE {
+				sector := udf.sectorOf(partition, desc.GetLocation()+off/udf.SECTOR_SIZE)
+				n := minUint64(length-off, udf.SECTOR_SIZE)
+				segments = append(segments, segment{uint64(len(data)) + off, n, sector})
+				rp.overlay.ReadAt(buf[off:off+n], int64(sector*udf.SECTOR_SIZE))
+			}
+		}
+		data = append(data, buf...)
+	})
+	if uint64(len(data)) > fe.GetInformationLength() {
+		data = data[:fe.GetInformationLength()]
+	}
+	original := append([]byte(nil), data...)
+	sectorOf := func(off uint64) uint64 {
+		for _, seg := range segments {
+			if off >= seg.off && off < seg.off+seg.length {
+				return seg.sector + (off-seg.off)/udf.SECTOR_SIZE
+			}
+		}
+		return 0
+	}
+	if !rp.repairFileIdentifiers(data, sectorOf) {
+		return
+	}
+	for _, seg := range segments {
+		for off := seg.off; off < seg.off+seg.length && off < uint64(len(data)); off += udf.SECTOR_SIZE {
+			end := minUint64(minUint64(off+udf.SECTOR_SIZE, seg.off+seg.length), uint64(len(data)))
+			if bytes.Equal(data[off:end], original[off:end]) {
+				continue
+			}
+			sector := seg.sector + (off-seg.off)/udf.SECTOR_SIZE
+			b := rp.readSector(sector)
+			copy(b, data[off:end])
+			rp.writeSector(sector, b)
+		}
+	}
+}
+
+// repairSpaceBitmaps fixes the tags of the unallocated space bitmaps
+func (rp *repairer) repairSpaceBitmaps() {
+	udf := rp.udf
+	for _, pd := range udf.partitionDescriptors() {
+		bitmapExtent := pd.PartitionHeaderDescriptor().UnallocatedSpaceBitmap
+		if ExtentLength(bitmapExtent) == 0 {
+			continue
+		}
+		sector := uint64(pd.PartitionStartingLocation) + uint64(bitmapExtent.Location)
+		blocks := (uint64(ExtentLength(bitmapExtent)) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+		b := make([]byte, blocks*udf.SECTOR_SIZE)
+		rp.overlay.ReadAt(b, int64(sector*udf.SECTOR_SIZE))
+		desc := NewDescriptor(b)
+		if desc.TagIdentifier != DESCRIPTOR_SPACE_BITMAP || desc.TagLocation != bitmapExtent.Location {
+			continue
+		}
+		if rp.fixTag(b, sector, "space bitmap descriptor") {
+			// Only the tag changes
+			rp.writeSector(sector, b)
+		}
+	}
+}
+
+// repairIntegrity fixes the tag of the prevailing integrity descriptor, and
+// closes it if it is open
+func (rp *repairer) repairIntegrity() {
+	udf := rp.udf
+	lvid, sector := udf.logicalVolumeIntegrity()
+	if lvid == nil {
+		return
+	}
+	b := rp.readSector(sector)
+	changed := false
+	if lvid.IntegrityType == INTEGRITY_TYPE_OPEN {
+		c := &fsck{
+			udf:     udf,
+			entries: make(map[LbAddr]*fsckEntry),
+		}
+		for _, fsd := range udf.fileSets {
+			c.addFileSet(fsd)
+		}
+		binary.LittleEndian.PutUint32(b[28:], INTEGRITY_TYPE_CLOSE)
+		rp.report(REPAIR_INTEGRITY, sector, "closed the open logical volume integrity descriptor")
+
+		for i := uint32(0); i < lvid.NumberOfPartitions && int(i) < len(udf.lvd.PartitionMaps); i++ {
+			free, ok := udf.freeBlocks(uint16(i))
+			if ok && free != lvid.FreeSpaceTable[i] {
+				binary.LittleEndian.PutUint32(b[80+4*i:], free)
+				rp.report(REPAIR_INTEGRITY, sector, "set the free space of partition %d to %d blocks instead of %d", i, free, lvid.FreeSpaceTable[i])
+			}
+		}
+
+		var files, dirs uint32
+		var uniqueID uint64
+		for _, entry := range c.order {
+			uniqueID = maxUint64(uniqueID, entry.fe.GetUniqueID())
+			if entry.isStream {
+				continue
+			}
+			if entry.isDir {
+				dirs++
+			} else {
+				files++
+			}
+		}
+		if implUse := 80 + 8*lvid.NumberOfPartitions; lvid.LengthOfImplementationUse >= 46 && int(implUse)+46 <= len(b) {
+			if files != lvid.NumberOfFiles {
+				binary.LittleEndian.PutUint32(b[implUse+32:], files)
+				rp.report(REPAIR_INTEGRITY, sector, "set the number of files to %d instead of %d", files, lvid.NumberOfFiles)
+			}
+			if dirs != lvid.NumberOfDirectories {
+				binary.LittleEndian.PutUint32(b[implUse+36:], dirs)
+				rp.report(REPAIR_INTEGRITY, sector, "set the number of directories to %d instead of %d", dirs, lvid.NumberOfDirectories)
+			}
+		}
+		// Unique IDs 1 to 15 are reserved for the root directory and streams
+		if next := maxUint64(uniqueID+1, 16); next > lvid.UniqueID {
+			binary.LittleEndian.PutUint64(b[40:], next)
+			rp.report(REPAIR_INTEGRITY, sector, "set the next unique ID to %d instead of %d", next, lvid.UniqueID)
+		}
+		setDescriptorTag(b)
+		changed = true
+	} else {
+		changed = rp.fixTag(b, sector, "logical volume integrity descriptor")
+	}
+	if changed {
+		rp.writeSector(sector, b)
+	}
+}
+
+// freeBlocks counts the blocks of a partition marked free in its unallocated
+// space bitmap; ok is false if it has none
+func (udf *Udf) freeBlocks(partition uint16) (free uint32, ok bool) {
+	pMap := udf.lvd.PartitionMaps[partition]
+	pd, found := udf.mapDescriptor(&pMap)
+	if pMap.PartitionMapType != 1 || !found {
+		return 0, false
+	}
+	bitmapExtent := pd.PartitionHeaderDescriptor().UnallocatedSpaceBitmap
+	if ExtentLength(bitmapExtent) == 0 {
+		return 0, false
+	}
+	blocks := (uint64(ExtentLength(bitmapExtent)) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE
+	sbd := NewSpaceBitmapDescriptor(udf.ReadSectors(uint64(pd.PartitionStartingLocation)+uint64(bitmapExtent.Location), blocks))
+	if sbd.Descriptor.TagIdentifier != DESCRIPTOR_SPACE_BITMAP {
+		return 0, false
+	}
+	for block := uint32(0); block < sbd.NumberOfBits; block++ {
+		if sbd.IsFree(block) {
+			free++
+		}
+	}
+	return free, true
+}
@@ -0,0 +1,90 @@
+package udf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, img *memImage)
+		fixes  []RepairFix
+		// restored is set if the repair records the image as written
+		restored bool
+	}{
+		{
+			"zeroed anchor",
+			func(t *testing.T, img *memImage) {
+				copy(img.b[256*2048:257*2048], make([]byte, 2048))
+			},
+			[]RepairFix{{Fix: REPAIR_ANCHOR, Sector: 256}},
+			true,
+		},
+		{
+			"corrupt main sequence",
+			func(t *testing.T, img *memImage) {
+				main := NewAnchorVolumeDescriptorPointer(img.b[256*2048:]).MainVolumeDescriptorSeq
+				fillPattern(img.b[main.Location*2048 : (main.Location+2)*2048])
+			},
+			[]RepairFix{{Fix: REPAIR_VOLUME_SEQUENCE, Sector: 32}},
+			true,
+		},
+		{
+			"open integrity descriptor",
+			func(t *testing.T, img *memImage) {
+				u, err := NewUdfFromReader(img)
+				if err != nil {
+					t.Fatal(err)
+				}
+				lvid, sector := u.logicalVolumeIntegrity()
+				lvid.IntegrityType = INTEGRITY_TYPE_OPEN
+				lvid.FreeSpaceTable[0] += 7
+				b, _ := lvid.MarshalBinary()
+				copy(img.b[sector*2048:], b)
+			},
+			[]RepairFix{
+				{Fix: REPAIR_INTEGRITY, Sector: 64, Message: "closed the open logical volume integrity descriptor"},
+				{Fix: REPAIR_INTEGRITY, Sector: 64, Message: "set the free space of partition 0 to 100 blocks instead of 107"},
+			},
+			false,
+		},
+	}
+	for _, test := range tests {
+		recorded := writeTestImage(t, WriterOptions{Revision: UDF_REVISION_201, FreeBlocks: 100})
+		img := &memImage{b: append([]byte(nil), recorded.b...)}
+		test.damage(t, img)
+		damaged := append([]byte(nil), img.b...)
+
+		fixes, err := Repair(img, nil, true)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(fixes) != len(test.fixes) {
+			t.Fatalf("%s: dry run lists %+v", test.name, fixes)
+		}
+		for i, fix := range fixes {
+			want := test.fixes[i]
+			if fix.Fix != want.Fix || fix.Sector != want.Sector || (want.Message != "" && fix.Message != want.Message) {
+				t.Errorf("%s: dry run lists %+v, want %+v", test.name, fix, want)
+			}
+		}
+		if !bytes.Equal(img.b, damaged) {
+			t.Errorf("%s: the dry run changed the image", test.name)
+		}
+
+		if _, err := Repair(img, img, false); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.restored && !bytes.Equal(img.b, recorded.b) {
+			t.Errorf("%s: the repaired image differs from the one written", test.name)
+		}
+		if fixes, err := Repair(img, nil, true); err != nil || len(fixes) != 0 {
+			t.Errorf("%s: a second repair lists %+v (%v)", test.name, fixes, err)
+		}
+		u := checkVolume(t, img)
+		if s := readTestFile(t, u, "dir/small.txt"); s != "hello" {
+			t.Errorf("%s: dir/small.txt reads %q", test.name, s)
+		}
+	}
+}
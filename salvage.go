@@ -0,0 +1,309 @@
+package udf
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// SalvagedEntry is a file entry found by scanning the partitions, placed in
+// the directory tree as far as its recorded relationships allow
+type SalvagedEntry struct {
+	Udf       *Udf
+	Location  LbAddr
+	Sector    uint64
+	FileEntry FileEntryInterface
+	// Name is the identifier of the FID referencing the entry, or empty if
+	// no surviving directory references it
+	Name     string
+	Parent   *SalvagedEntry
+	Children []*SalvagedEntry
+}
+
+// SalvageResult holds the file entries found by Salvage
+type SalvageResult struct {
+	// Entries are all the valid file entries found, in disc order
+	Entries []*SalvagedEntry
+	// Roots are the directories found without a parent, normally the root
+	// directory of each file set
+	Roots []*SalvagedEntry
+	// LostAndFound are the entries without a parent that are not directories
+	LostAndFound []*SalvagedEntry
+}
+
+// DisplayName returns the entry's name, or a name made of its location
+func (e *SalvagedEntry) DisplayName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return fmt.Sprintf("#%d-%d", e.Location.PartitionReferenceNumber, e.Location.LogicalBlockNumber)
+}
+
+// Path returns the entry's path from its topmost surviving ancestor
+func (e *SalvagedEntry) Path() string {
+	p := e.DisplayName()
+	seen := map[*SalvagedEntry]bool{e: true}
+	for parent := e.Parent; parent != nil && !seen[parent]; parent = parent.Parent {
+		seen[parent] = true
+		p = path.Join(parent.DisplayName(), p)
+	}
+	return p
+}
+
+func (e *SalvagedEntry) IsDir() bool {
+	fileType := e.FileEntry.GetICBTag().FileType
+	return fileType == FILE_TYPE_DIRECTORY || fileType == FILE_TYPE_STREAM_DIRECTORY
+}
+
+// NewReader returns a reader over the entry's data
+func (e *SalvagedEntry) NewReader() *MultiSectionReader {
+	return e.Udf.NewFileEntryReader(e.FileEntry)
+}
+
+// File types that are not part of the directory hierarchy
+var salvageSkippedTypes = map[uint8]bool{
+	FILE_TYPE_UNALLOCATED_SPACE:   true,
+	FILE_TYPE_PARTITION_INTEGRITY: true,
+	FILE_TYPE_INDIRECT:            true,
+	FILE_TYPE_EXTENDED_ATTRIBUTES: true,
+	FILE_TYPE_VAT:                 true,
+	FILE_TYPE_METADATA:            true,
+	FILE_TYPE_METADATA_MIRROR:     true,
+	FILE_TYPE_METADATA_BITMAP:     true,
+}
+
+const salvageChunkSectors = 256
+
+// Salvage scans every block of the volume's partitions for File Entries and
+// Extended File Entries whose checksum, CRC and tag location check out, and
+// rebuilds what it can of the directory tree from them. It works on volumes
+// NewUdfFromReader rejects: when the volume descriptors are lost, the whole
+// image is scanned and partitions are inferred from the tag locations.
+func Salvage(r io.ReaderAt) (result *SalvageResult, err error) {
+	udf := &Udf{
+		r:  r,
+		pd: make(map[uint16]*PartitionDescriptor),
+	}
+	func() {
+		// Use whatever structures survived until init gave up
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = fmt.Errorf("%v", rec)
+			}
+		}()
+		err = udf.init()
+	}()
+	if err == nil {
+		return udf.Salvage(), nil
+	}
+	if udf.SECTOR_SIZE > 32768 {
+		udf.SECTOR_SIZE = 2048
+	}
+	if !udf.partitionsResolved() {
+		udf.lvd = nil
+		udf.pd = make(map[uint16]*PartitionDescriptor)
+		udf.volumePd = nil
+		udf.inferPartitions()
+	}
+	udf.isInited = true
+	return udf.Salvage(), nil
+}
+
+// partitionsResolved returns true if init got as far as mapping every
+// partition of the logical volume
+func (udf *Udf) partitionsResolved() bool {
+	if udf.lvd == nil || len(udf.lvd.PartitionMaps) == 0 {
+		return false
+	}
+	for _, pMap := range udf.lvd.PartitionMaps {
+		if _, ok := udf.mapDescriptor(&pMap); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// salvageReadDir lists a directory that may well be damaged
+func (udf *Udf) salvageReadDir(fe FileEntryInterface) (files []File) {
+	defer func() {
+		if recover() != nil {
+			files = nil
+		}
+	}()
+	return udf.ReadDirAll(fe, FILE_CHARACTERISTIC_HIDDEN|FILE_CHARACTERISTIC_DELETED|FILE_CHARACTERISTIC_METADATA)
+}
+
+// scanRanges returns the sector ranges covered by the partitions, or the
+// whole image if there are no partition descriptors
+func (udf *Udf) scanRanges() (ranges [][2]uint64) {
+	for _, pd := range udf.partitionDescriptors() {
+		start := uint64(pd.PartitionStartingLocation)
+		ranges = append(ranges, [2]uint64{start, start + uint64(pd.PartitionLength)})
+	}
+	if len(ranges) == 0 {
+		ranges = append(ranges, [2]uint64{0, ^uint64(0)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return
+}
+
+// scanSectors calls fn for every recorded sector of the given ranges that
+// holds a valid File Entry or Extended File Entry tag
+func (udf *Udf) scanSectors(ranges [][2]uint64, fn func(sector uint64, b []byte)) {
+	buf := make([]byte, udf.SECTOR_SIZE*salvageChunkSectors)
+	for _, rng := range ranges {
+		for sector := rng[0]; sector < rng[1]; sector += salvageChunkSectors {
+			count := uint64(salvageChunkSectors)
+			if rng[1]-sector < count {
+				count = rng[1] - sector
+			}
+			n, _ := udf.r.ReadAt(buf[:count*udf.SECTOR_SIZE], int64(sector*udf.SECTOR_SIZE))
+			for i := uint64(0); (i+1)*udf.SECTOR_SIZE <= uint64(n); i++ {
+				b := buf[i*udf.SECTOR_SIZE : (i+1)*udf.SECTOR_SIZE]
+				tag := rl_u16(b)
+				if tag != DESCRIPTOR_FILE_ENTRY && tag != DESCRIPTOR_EXTENDED_FILE_ENTRY {
+					continue
+				}
+				if desc := NewDescriptor(b); desc.Valid() {
+					fn(sector+i, append([]byte(nil), b...))
+				}
+			}
+			if uint64(n) < count*udf.SECTOR_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// inferPartitions builds partition maps from the file entries found in the
+// whole image: an entry recorded at a sector holds its partition-relative
+// location in its tag, so their difference is the partition start
+func (udf *Udf) inferPartitions() {
+	counts := make(map[uint64]int)
+	udf.scanSectors(udf.scanRanges(), func(sector uint64, b []byte) {
+		if desc := NewDescriptor(b); uint64(desc.TagLocation) <= sector {
+			counts[sector-uint64(desc.TagLocation)]++
+		}
+	})
+	starts := make([]uint64, 0, len(counts))
+	for start := range counts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		if counts[starts[i]] != counts[starts[j]] {
+			return counts[starts[i]] > counts[starts[j]]
+		}
+		return starts[i] < starts[j]
+	})
+	udf.lvd = &LogicalVolumeDescriptor{LogicalBlockSize: uint32(udf.SECTOR_SIZE)}
+	for _, start := range starts {
+		udf.lvd.PartitionMaps = append(udf.lvd.PartitionMaps, PartitionMap{
+			PartitionMapType: 1,
+			PartitionStart:   uint32(start),
+		})
+	}
+}
+
+// Salvage scans the partitions of an opened volume for file entries, see the
+// Salvage function
+func (udf *Udf) Salvage() *SalvageResult {
+	udf.init()
+	result := &SalvageResult{}
+	byLocation := make(map[LbAddr]*SalvagedEntry)
+	byBlock := make(map[uint32][]*SalvagedEntry)
+	inferred := len(udf.partitionDescriptors()) == 0
+
+	udf.scanSectors(udf.scanRanges(), func(sector uint64, b []byte) {
+		desc := NewDescriptor(b)
+		for ref, pMap := range udf.lvd.PartitionMaps {
+			if uint64(pMap.PartitionStart)+uint64(desc.TagLocation) != sector {
+				continue
+			}
+			fe := NewFileEntry(uint16(ref), b)
+			if salvageSkippedTypes[fe.GetICBTag().FileType] {
+				return
+			}
+			entry := &SalvagedEntry{
+				Udf:       udf,
+				Location:  LbAddr{desc.TagLocation, uint16(ref)},
+				Sector:    sector,
+				FileEntry: fe,
+			}
+			result.Entries = append(result.Entries, entry)
+			byLocation[entry.Location] = entry
+			byBlock[desc.TagLocation] = append(byBlock[desc.TagLocation], entry)
+			return
+		}
+	})
+
+	lookup := func(loc LbAddr) *SalvagedEntry {
+		if entry, ok := byLocation[loc]; ok {
+			return entry
+		}
+		// Inferred partitions are numbered arbitrarily, match on the block alone
+		if inferred && len(byBlock[loc.LogicalBlockNumber]) == 1 {
+			return byBlock[loc.LogicalBlockNumber][0]
+		}
+		return nil
+	}
+	link := func(parent *SalvagedEntry, child *SalvagedEntry, name string) {
+		if child == nil || child.Parent != nil {
+			return
+		}
+		// A reused block may name an ancestor, which must not close a loop
+		for ancestor := parent; ancestor != nil; ancestor = ancestor.Parent {
+			if ancestor == child {
+				return
+			}
+		}
+		child.Parent = parent
+		child.Name = name
+		parent.Children = append(parent.Children, child)
+	}
+
+	// Directories name their children, live entries first
+	for _, deleted := range []bool{false, true} {
+		for _, entry := range result.Entries {
+			if !entry.IsDir() {
+				continue
+			}
+			for _, child := range udf.salvageReadDir(entry.FileEntry) {
+				if child.IsDeleted() == deleted {
+					link(entry, lookup(child.Fid.ICB.Location), child.Fid.FileIdentifier)
+				}
+			}
+		}
+	}
+	for _, entry := range result.Entries {
+		if streamDir := entry.FileEntry.GetStreamDirectoryICB(); streamDir.GetLength() > 0 {
+			link(entry, lookup(streamDir.Location), ":streams")
+		}
+	}
+	// Then fall back to the parent recorded in the ICB tag
+	for _, entry := range result.Entries {
+		if entry.Parent != nil {
+			continue
+		}
+		parentICB := entry.FileEntry.GetICBTag().ParentICBLocation
+		if parentICB == 0 {
+			continue
+		}
+		parent := lookup(LbAddr{uint32(parentICB), uint16(parentICB >> 32)})
+		if parent != nil && parent.IsDir() {
+			link(parent, entry, "")
+		}
+	}
+
+	for _, entry := range result.Entries {
+		if entry.Parent != nil {
+			continue
+		}
+		if entry.IsDir() {
+			result.Roots = append(result.Roots, entry)
+		} else {
+			result.LostAndFound = append(result.LostAndFound, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+package udf
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// FoundVolume is a UDF volume found inside a larger image
+type FoundVolume struct {
+	// Offset is the position of the volume in the image, in bytes
+	Offset int64
+	// Size is the length of the volume as told by its last anchor, 0 if
+	// it extends to the end of the image
+	Size       int64
+	SectorSize uint64
+	// AnchorSector is the sector of the volume the anchor it opens from is
+	// recorded in
+	AnchorSector uint64
+	Label        string
+}
+
+// Open returns a reader of the volume found in the image
+func (v FoundVolume) Open(r io.ReaderAt) (*Udf, error) {
+	return openVolumeAt(r, v.Offset, v.Size, v.SectorSize, v.AnchorSector)
+}
+
+// openVolumeAt opens the volume of the given size, or up to the end of the
+// image if zero, starting at the given byte offset of an image, from its
+// anchor at the given sector. The sector size is probed if zero, and the
+// anchor looked for at sector 256 if zero.
+func openVolumeAt(r io.ReaderAt, offset int64, size int64, sectorSize uint64, anchor uint64) (udf *Udf, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			udf, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	if size == 0 {
+		size = readerSize(r) - offset
+	}
+	udf = &Udf{
+		r:           io.NewSectionReader(r, offset, size),
+		pd:          make(map[uint16]*PartitionDescriptor),
+		anchor:      anchor,
+		SECTOR_SIZE: sectorSize,
+	}
+	if err = udf.init(); err != nil {
+		return nil, err
+	}
+	return udf, nil
+}
+
+// scanCandidate is a possible start of a volume found while scanning
+type scanCandidate struct {
+	sectorSize uint64
+	anchor     uint64
+}
+
+// scanChunkSize is how much of the image is scanned at once; chunks are
+// read with the length of an anchor descriptor more, for the matches
+// starting at their end
+const scanChunkSize = 1 << 20
+const scanOverlap = 512
+
+// ScanVolumes finds the UDF volumes recorded anywhere in an image, such as
+// a disk dump. Volumes are looked for at any byte offset, from their
+// volume recognition sequence and from anchors whose recorded location is
+// consistent with the volume descriptor sequence they point to. The
+// volumes found are those that could be opened, by increasing offset.
+func ScanVolumes(r io.ReaderAt) ([]FoundVolume, error) {
+	size := readerSize(r)
+	candidates := make(map[int64][]scanCandidate)
+	// The anchor recorded last tells where a volume ends, which matters to
+	// find the virtual allocation table of sequential volumes
+	ends := make(map[int64]int64)
+	// Sequential volumes left open have no anchor past 256, but end with
+	// their VAT ICB
+	var vats []int64
+	readAt := func(b []byte, off int64) bool {
+		n, _ := r.ReadAt(b, off)
+		return n == len(b)
+	}
+
+	buf := make([]byte, scanChunkSize+scanOverlap)
+	for pos := int64(0); pos < size; pos += scanChunkSize {
+		n, err := r.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for i := 0; i < n && i < scanChunkSize; i++ {
+			b := buf[i:n]
+			offset := pos + int64(i)
+			switch {
+			case len(b) >= 512 && b[0] == DESCRIPTOR_ANCHOR_VOLUME_POINTER && b[1] == 0:
+				desc := NewDescriptor(b[:512])
+				if !desc.Valid() {
+					continue
+				}
+				anchor := NewAnchorVolumeDescriptorPointer(b[:512])
+				location := uint64(desc.TagLocation)
+				main := uint64(anchor.MainVolumeDescriptorSeq.Location)
+				// The first descriptor of the sequence must record its own
+				// location for the sector size
+				for sectorSize := uint64(512); sectorSize <= 32768; sectorSize <<= 1 {
+					start := offset - int64(location*sectorSize)
+					if start < 0 {
+						break
+					}
+					tag := make([]byte, 16)
+					if !readAt(tag, start+int64(main*sectorSize)) {
+						continue
+					}
+					vds := NewDescriptor(tag)
+					if vds.TagChecksum == vds.Checksum() && uint64(vds.TagLocation) == main && vds.TagIdentifier >= DESCRIPTOR_PRIMARY_VOLUME && vds.TagIdentifier <= DESCRIPTOR_TERMINATING {
+						candidates[start] = append(candidates[start], scanCandidate{sectorSize, location})
+						if location > 256 && offset+int64(sectorSize) > ends[start] {
+							ends[start] = offset + int64(sectorSize)
+						}
+					}
+				}
+			case len(b) >= 28 && (rl_u16(b) == DESCRIPTOR_FILE_ENTRY || rl_u16(b) == DESCRIPTOR_EXTENDED_FILE_ENTRY) && b[27] == FILE_TYPE_VAT:
+				if desc := NewDescriptor(b[:16]); desc.TagChecksum == desc.Checksum() {
+					vats = append(vats, offset)
+				}
+			case len(b) >= 7 && b[0] == 0 && b[6] == 1 && (string(b[1:6]) == "NSR02" || string(b[1:6]) == "NSR03"):
+				// Walk back to the first record of the recognition
+				// sequence, recorded from byte 32768 of the volume
+				record := make([]byte, 7)
+				for recordSize := int64(2048); recordSize <= 32768; recordSize <<= 1 {
+					first := offset
+					for first-recordSize >= 0 && readAt(record, first-recordSize) && record[0] == 0 && vrsIdentifiers[string(record[1:6])] {
+						first -= recordSize
+					}
+					if first == offset || first < 32768 {
+						continue
+					}
+					var sectorSize uint64
+					if recordSize > 2048 {
+						sectorSize = uint64(recordSize)
+					}
+					candidates[first-32768] = append(candidates[first-32768], scanCandidate{sectorSize, 0})
+				}
+			}
+		}
+	}
+
+	starts := make([]int64, 0, len(candidates))
+	for start := range candidates {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	var volumes []FoundVolume
+	for i, start := range starts {
+		sizes := []int64{0}
+		if end, ok := ends[start]; ok {
+			sizes = []int64{end - start}
+		} else {
+			limit := size
+			if i+1 < len(starts) {
+				limit = starts[i+1]
+			}
+			// Try the VAT ICBs recorded before the next volume, last
+			// first, with room for the largest sector size
+			for j := len(vats) - 1; j >= 0; j-- {
+				if vats[j] > start && vats[j] < limit {
+					sizes = append(sizes, minInt64(vats[j]+32768, size)-start)
+				}
+			}
+		}
+		if v, ok := openFoundVolume(r, start, sizes, candidates[start]); ok {
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes, nil
+}
+
+// openFoundVolume opens the volume starting at the given offset with the
+// first candidate size and anchor that work
+func openFoundVolume(r io.ReaderAt, start int64, sizes []int64, candidates []scanCandidate) (FoundVolume, bool) {
+	for _, size := range sizes {
+		for _, c := range candidates {
+			udf, err := openVolumeAt(r, start, size, c.sectorSize, c.anchor)
+			if err != nil {
+				continue
+			}
+			anchor := udf.anchor
+			if anchor == 0 {
+				anchor = 256
+			}
+			label := udf.lvd.LogicalVolumeIdentifier
+			if label == "" && udf.pvd != nil {
+				label = udf.pvd.VolumeIdentifier
+			}
+			return FoundVolume{Offset: start, Size: size, SectorSize: udf.SECTOR_SIZE, AnchorSector: anchor, Label: label}, true
+		}
+	}
+	return FoundVolume{}, false
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
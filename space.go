@@ -0,0 +1,244 @@
+package udf
+
+// How the free space of a partition is recorded
+const (
+	SPACE_BITMAP     = "bitmap"
+	SPACE_TABLE      = "table"
+	SPACE_SEQUENTIAL = "sequential"
+	SPACE_VIRTUAL    = "virtual"
+	SPACE_NONE       = "none"
+)
+
+// BlockExtent is a run of consecutive blocks of a partition
+type BlockExtent struct {
+	Location uint32
+	Blocks   uint32
+}
+
+// PartitionSpace is the free space of the partition of a partition map,
+// as recorded by its space bitmap or table
+type PartitionSpace struct {
+	// Partition is the index of the partition map
+	Partition uint16
+	// Number is the number of the partition descriptor
+	Number uint16
+	// Source tells how the free space is recorded, one of the SPACE_*
+	// constants. Partitions without any (SPACE_NONE) count as full, and
+	// write-once partitions without any are free past their recorded end
+	// (SPACE_SEQUENTIAL). Virtual partitions are only counted by the
+	// blocks they map; their free space is that of the physical partition.
+	Source      string
+	Blocks      uint32
+	UsedBlocks  uint32
+	FreeBlocks  uint32
+	FreeExtents []BlockExtent
+	// FreedBlocks are the blocks of the freed space bitmap or table of
+	// rewritable partitions, which need to be erased before their reuse
+	FreedBlocks uint32
+	// RecordedFreeBlocks is the free space claimed by the logical volume
+	// integrity descriptor, 0xFFFFFFFF if it records none
+	RecordedFreeBlocks uint32
+}
+
+// partitionSectors returns the sectors recording an extent of a partition
+func (udf *Udf) partitionSectors(partition uint16, location uint64, length uint32) (sectors []uint64) {
+	for i := uint64(0); i < (uint64(length)+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE; i++ {
+		sectors = append(sectors, udf.sectorOf(partition, location+i))
+	}
+	return
+}
+
+// spaceBitmapSectors returns the sectors recording the unallocated space
+// bitmap of a partition, nil if it has none
+func (udf *Udf) spaceBitmapSectors(partition uint16) (sectors []uint64) {
+	pMap := udf.lvd.PartitionMaps[partition]
+	pd, ok := udf.mapDescriptor(&pMap)
+	if !ok || pMap.isVirtual() {
+		return nil
+	}
+	if pMap.isPhysical() {
+		extent := pd.PartitionHeaderDescriptor().UnallocatedSpaceBitmap
+		return udf.partitionSectors(partition, uint64(extent.Location), ExtentLength(extent))
+	}
+	// The bitmap of a metadata partition is recorded in a file
+	fe := udf.metadataFile(partition, FILE_TYPE_METADATA_BITMAP)
+	if fe == nil {
+		return nil
+	}
+	udf.walkAllocationDescriptors(fe, fe.GetAllocationDescriptors(), func(desc ExtentInterface, partition uint16, aed bool) {
+		if !aed && !desc.IsNotRecorded() {
+			sectors = append(sectors, udf.partitionSectors(partition, desc.GetLocation(), ExtentLength(desc))...)
+		}
+	})
+	return
+}
+
+// readSpaceBitmap reads the space bitmap recorded in the given sectors, nil
+// if there is none
+func (udf *Udf) readSpaceBitmap(sectors []uint64) *SpaceBitmapDescriptor {
+	if len(sectors) == 0 {
+		return nil
+	}
+	var b []byte
+	for _, sector := range sectors {
+		b = append(b, udf.ReadSector(sector)...)
+	}
+	sbd := NewSpaceBitmapDescriptor(b)
+	if sbd.Descriptor.TagIdentifier != DESCRIPTOR_SPACE_BITMAP {
+		return nil
+	}
+	return sbd
+}
+
+// readSpaceTable returns the extents listed by the unallocated space entry
+// at the given block of a physical partition, and false if there is none
+func (udf *Udf) readSpaceTable(partition uint16, block uint32) (extents []BlockExtent, ok bool) {
+	b := udf.partition(partition).ReadBlocks(uint64(block), 1)
+	if NewDescriptor(b).TagIdentifier != DESCRIPTOR_UNALLOCATED_SPACE_ENTRY {
+		return nil, false
+	}
+	use := NewUnallocatedSpaceEntry(b)
+	visited := make(map[uint64]bool)
+	var walk func(descs []ExtentInterface)
+	walk = func(descs []ExtentInterface) {
+		for _, desc := range descs {
+			if !desc.HasExtended() {
+				if blocks := (uint64(ExtentLength(desc)) + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE; blocks > 0 {
+					extents = append(extents, BlockExtent{Location: uint32(desc.GetLocation()), Blocks: uint32(blocks)})
+				}
+				continue
+			}
+			// The table goes on in an allocation extent descriptor
+			sector := udf.sectorOf(partition, desc.GetLocation())
+			if visited[sector] {
+				continue
+			}
+			visited[sector] = true
+			data := udf.ReadSector(sector)
+			aed := new(AED).FromBytes(data)
+			walk(GetAllocationDescriptors(use.ICBTag.AllocationType, data[24:], aed.LengthOfAllocationDescriptors))
+		}
+	}
+	walk(use.AllocationDescriptors)
+	return extents, true
+}
+
+// bitmapExtents returns the runs of free blocks of a space bitmap
+func bitmapExtents(sbd *SpaceBitmapDescriptor) (extents []BlockExtent) {
+	for block := uint32(0); block < sbd.NumberOfBits; block++ {
+		if !sbd.IsFree(block) {
+			continue
+		}
+		run := block
+		for run < sbd.NumberOfBits && sbd.IsFree(run) {
+			run++
+		}
+		extents = append(extents, BlockExtent{Location: block, Blocks: run - block})
+		block = run
+	}
+	return
+}
+
+func countBlocks(extents []BlockExtent) (blocks uint32) {
+	for _, extent := range extents {
+		blocks += extent.Blocks
+	}
+	return
+}
+
+// partitionSpace reads the free space of the partition of a partition map
+func (udf *Udf) partitionSpace(partition uint16) PartitionSpace {
+	pMap := udf.lvd.PartitionMaps[partition]
+	space := PartitionSpace{Partition: partition, Number: pMap.PartitionNumber, Source: SPACE_NONE}
+	pd, ok := udf.mapDescriptor(&pMap)
+	if !ok {
+		return space
+	}
+	switch {
+	case pMap.isVirtual():
+		space.Source = SPACE_VIRTUAL
+		if vat, ok := udf.vat[partition]; ok {
+			space.Blocks = uint32(len(vat.Entries))
+			for _, entry := range vat.Entries {
+				if entry != VAT_ENTRY_UNUSED {
+					space.UsedBlocks++
+				}
+			}
+		}
+		return space
+	case pMap.isPhysical():
+		space.Blocks = pd.PartitionLength
+	default:
+		// Metadata partitions span their metadata file
+		if fe := udf.mainMetadataFile(partition); fe != nil {
+			space.Blocks = uint32((fe.GetInformationLength() + udf.SECTOR_SIZE - 1) / udf.SECTOR_SIZE)
+		}
+	}
+
+	phd := pd.PartitionHeaderDescriptor()
+	sbd := udf.readSpaceBitmap(udf.spaceBitmapSectors(partition))
+	switch {
+	case sbd != nil:
+		space.Source = SPACE_BITMAP
+		space.FreeExtents = bitmapExtents(sbd)
+	case !pMap.isPhysical():
+		// Metadata partitions without a bitmap are read-only
+	case ExtentLength(phd.UnallocatedSpaceTable) > 0:
+		if extents, ok := udf.readSpaceTable(partition, phd.UnallocatedSpaceTable.Location); ok {
+			space.Source = SPACE_TABLE
+			space.FreeExtents = extents
+		}
+	case pd.AccessType == PARTITION_ACCESS_WRITE_ONCE:
+		// Write-once partitions are recorded from their start on
+		space.Source = SPACE_SEQUENTIAL
+		var recorded uint64
+		if end := uint64(readerSize(udf.r)) / udf.SECTOR_SIZE; end > uint64(pd.PartitionStartingLocation) {
+			recorded = end - uint64(pd.PartitionStartingLocation)
+		}
+		if recorded < uint64(space.Blocks) {
+			space.FreeExtents = []BlockExtent{{Location: uint32(recorded), Blocks: space.Blocks - uint32(recorded)}}
+		}
+	}
+	space.FreeBlocks = countBlocks(space.FreeExtents)
+
+	if pMap.isPhysical() {
+		if ExtentLength(phd.FreedSpaceBitmap) > 0 {
+			if sbd := udf.readSpaceBitmap(udf.partitionSectors(partition, uint64(phd.FreedSpaceBitmap.Location), ExtentLength(phd.FreedSpaceBitmap))); sbd != nil {
+				space.FreedBlocks = countBlocks(bitmapExtents(sbd))
+			}
+		} else if ExtentLength(phd.FreedSpaceTable) > 0 {
+			extents, _ := udf.readSpaceTable(partition, phd.FreedSpaceTable.Location)
+			space.FreedBlocks = countBlocks(extents)
+		}
+	}
+	if space.FreeBlocks+space.FreedBlocks < space.Blocks {
+		space.UsedBlocks = space.Blocks - space.FreeBlocks - space.FreedBlocks
+	}
+	return space
+}
+
+// FreeSpace returns the free space of each partition map of the logical
+// volume, next to the free space its integrity descriptor claims
+func (udf *Udf) FreeSpace() (spaces []PartitionSpace) {
+	udf.init()
+	lvid := udf.LogicalVolumeIntegrity()
+	for i := range udf.lvd.PartitionMaps {
+		space := udf.partitionSpace(uint16(i))
+		space.RecordedFreeBlocks = 0xFFFFFFFF
+		if lvid != nil && i < len(lvid.FreeSpaceTable) {
+			space.RecordedFreeBlocks = lvid.FreeSpaceTable[i]
+		}
+		spaces = append(spaces, space)
+	}
+	return
+}
+
+// UnallocatedVolumeSpace returns the extents of volume space outside of any
+// partition, as listed by the unallocated space descriptor
+func (udf *Udf) UnallocatedVolumeSpace() []Extent {
+	udf.init()
+	if udf.usd == nil {
+		return nil
+	}
+	return udf.usd.AllocationDescriptors
+}
@@ -0,0 +1,39 @@
+package udf
+
+import (
+	"os"
+)
+
+// Streams returns the named streams of the entry, listed in the stream
+// directory of its extended file entry
+func (f *File) Streams() []File {
+	return f.Udf.streams(f.FileEntry().GetStreamDirectoryICB())
+}
+
+// OpenStream returns a reader over the named stream with the given name
+func (f *File) OpenStream(name string) (*MultiSectionReader, error) {
+	for _, stream := range f.Streams() {
+		if stream.Name() == name {
+			return stream.NewReader(), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// SystemStreams returns the streams of the system stream directory recorded
+// in the file set descriptor
+func (udf *Udf) SystemStreams() []File {
+	udf.init()
+	return udf.streams(udf.fsd.SystemStreamDirectoryICB)
+}
+
+func (udf *Udf) streams(icb ExtentLong) []File {
+	if icb.GetLength() == 0 {
+		return nil
+	}
+	fe := udf.readFileEntry(icb)
+	if fe == nil || fe.GetICBTag().FileType != FILE_TYPE_STREAM_DIRECTORY {
+		return nil
+	}
+	return udf.ReadDir(fe)
+}
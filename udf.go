@@ -3,7 +3,8 @@ package udf
 import (
 	"errors"
 	"io"
-	"unsafe"
+	"io/ioutil"
+	"os"
 )
 
 // Udf is a wrapper around an .iso file that allows reading its ISO-13346 "UDF" data
@@ -11,10 +12,20 @@ type Udf struct {
 	r           io.ReaderAt
 	isInited    bool
 	pvd         *PrimaryVolumeDescriptor
+	iuvd        *ImplementationUseVolumeDescriptor
 	pd          map[uint16]*PartitionDescriptor
+	volumePd    map[volumePartition]*PartitionDescriptor // partitions of a volume set
 	lvd         *LogicalVolumeDescriptor
+	usd         *UnallocatedSpaceDescriptor
 	fsd         *FileSetDescriptor
+	fileSets    []*FileSetDescriptor
 	root_fe     FileEntryInterface
+	partitions  []Partition
+	vat         map[uint16]*VirtualAllocationTable
+	vatSector   uint64
+	anchor      uint64 // sector of the anchor read, 256 if zero
+	owners      *sectorIndex
+	damage      *damagedReader // set when reading a damaged image
 	SECTOR_SIZE uint64
 }
 
@@ -35,10 +46,52 @@ func (udf *Udf) init() (err error) {
 		return
 	}
 
+	// Volume sets have their volume descriptors read volume by volume
+	if udf.lvd == nil {
+		if err = udf.readVolumeDescriptors(); err != nil {
+			return
+		}
+	}
+
+	// DEBUGGING ONLY
+	// udf.pvd.Show()
+	// for i, pd := range udf.pd {
+	// 	pd.Show(i)
+	// }
+	// udf.lvd.Show()
+	// DEBUGGING ONLY - end
+
+	if err = udf.readPartitions(); err != nil {
+		return
+	}
+
+	udf.fileSets = prevailingFileSets(udf.readFileSets())
+	if len(udf.fileSets) == 0 {
+		return errors.New("could not find a file set descriptor")
+	}
+	udf.fsd = udf.fileSets[0]
+	udf.root_fe = udf.FileSetRoot(udf.fsd)
+
+	udf.isInited = true
+	return
+}
+
+// readVolumeDescriptors finds the sector size from the anchor and reads the
+// volume descriptor sequence it points to
+func (udf *Udf) readVolumeDescriptors() (err error) {
 	var anchorDesc *AnchorVolumeDescriptorPointer
 
-	for udf.SECTOR_SIZE = 512; udf.SECTOR_SIZE <= 32768; udf.SECTOR_SIZE <<= 1 {
-		anchorDesc = NewAnchorVolumeDescriptorPointer(udf.ReadSector(256))
+	anchorSector := udf.anchor
+	if anchorSector == 0 {
+		anchorSector = 256
+	}
+	first, last := uint64(512), uint64(32768)
+	if udf.SECTOR_SIZE != 0 {
+		// The sector size is known when opening an earlier generation
+		first, last = udf.SECTOR_SIZE, udf.SECTOR_SIZE
+	}
+	for udf.SECTOR_SIZE = first; udf.SECTOR_SIZE <= last; udf.SECTOR_SIZE <<= 1 {
+		anchorDesc = NewAnchorVolumeDescriptorPointer(udf.ReadSector(anchorSector))
 		if anchorDesc.Descriptor.TagIdentifier == DESCRIPTOR_ANCHOR_VOLUME_POINTER &&
 			anchorDesc.Descriptor.TagChecksum == anchorDesc.Descriptor.Checksum() {
 			break
@@ -65,39 +118,42 @@ func (udf *Udf) init() (err error) {
 			udf.pd[pd.PartitionNumber] = pd
 		case DESCRIPTOR_LOGICAL_VOLUME:
 			udf.lvd = desc.LogicalVolumeDescriptor()
+		case DESCRIPTOR_IMPLEMENTATION_USE_VOLUME:
+			udf.iuvd = desc.ImplementationUseVolumeDescriptor()
+		case DESCRIPTOR_UNALLOCATED:
+			udf.usd = desc.UnallocatedSpaceDescriptor()
 		}
 	}
+	return
+}
 
-	// DEBUGGING ONLY
-	// udf.pvd.Show()
-	// for i, pd := range udf.pd {
-	// 	pd.Show(i)
-	// }
-	// udf.lvd.Show()
-	// DEBUGGING ONLY - end
+// LogicalVolumeIntegrity returns the prevailing Logical Volume Integrity
+// Descriptor, i.e. the last one recorded in the integrity sequence
+func (udf *Udf) LogicalVolumeIntegrity() *LogicalVolumeIntegrityDescriptor {
+	lvid, _ := udf.logicalVolumeIntegrity()
+	return lvid
+}
 
-	for i, pMap := range udf.lvd.PartitionMaps {
-		if pMap.PartitionMapType != 2 {
-			// Check to error early if there is no match with a partition number
-			if _, ok := udf.pd[pMap.PartitionNumber]; !ok {
-				return errors.New("could not find partition number")
+// logicalVolumeIntegrity returns the prevailing integrity descriptor and the
+// sector recording it
+func (udf *Udf) logicalVolumeIntegrity() (lvid *LogicalVolumeIntegrityDescriptor, lvidSector uint64) {
+	udf.init()
+	extent := udf.lvd.IntegritySequenceExtent
+	visited := make(map[uint32]bool)
+	for extent.Length > 0 && !visited[extent.Location] {
+		visited[extent.Location] = true
+		next := Extent{}
+		for sector := uint64(extent.Location); sector < uint64(extent.Location)+(uint64(extent.Length)+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE; sector++ {
+			desc := NewDescriptor(udf.ReadSector(sector))
+			if desc.TagIdentifier != DESCRIPTOR_LOGICAL_VOLUME_INTEGRITY {
+				break
 			}
-			udf.lvd.PartitionMaps[i].PartitionStart = udf.pd[pMap.PartitionNumber].PartitionStartingLocation
-			continue
-		}
-		metaFile := NewFileEntry(0, udf.ReadSector(uint64(udf.pd[pMap.PartitionNumber].PartitionStartingLocation)))
-		if metaFile != nil && len(metaFile.GetAllocationDescriptors()) > 0 {
-			udf.lvd.PartitionMaps[i].PartitionStart = uint32(metaFile.GetAllocationDescriptors()[0].GetLocation()) + udf.pd[pMap.PartitionNumber].PartitionStartingLocation
+			lvid = desc.LogicalVolumeIntegrityDescriptor()
+			lvidSector = sector
+			next = lvid.NextIntegrityExtent
 		}
+		extent = next
 	}
-
-	partitionStart := udf.LogicalPartitionStart(udf.lvd.LogicalVolumeContentsUse.GetPartition())
-
-	udf.fsd = NewFileSetDescriptor(udf.ReadSector(partitionStart + uint64(udf.lvd.LogicalVolumeContentsUse.Location.LogicalBlockNumber)))
-	rootICB := udf.fsd.RootDirectoryICB
-	udf.root_fe = NewFileEntry(udf.lvd.LogicalVolumeContentsUse.GetPartition(), udf.ReadSector(udf.LogicalPartitionStart(rootICB.GetPartition())+rootICB.GetLocation()))
-
-	udf.isInited = true
 	return
 }
 
@@ -117,30 +173,49 @@ func (udf *Udf) ReadSectors(sectorNumber uint64, sectorsCount uint64) []byte {
 	return buf[:read]
 }
 
+// readFileEntry reads the current file entry of the ICB at the given location
+func (udf *Udf) readFileEntry(icb ExtentLong) FileEntryInterface {
+	entries := udf.readICBHierarchy(icb)
+	return entries[len(entries)-1].fe
+}
+
+// ReadDir returns the children entries of a directory, or of the root
+// directory if fe is nil. Deleted entries and the parent entry are omitted.
 func (udf *Udf) ReadDir(fe FileEntryInterface) []File {
+	return udf.ReadDirAll(fe, FILE_CHARACTERISTIC_HIDDEN|FILE_CHARACTERISTIC_METADATA)
+}
+
+// ReadDirAll returns the children entries of a directory, or of the root
+// directory if fe is nil. Entries flagged hidden, deleted, parent or metadata
+// are only listed if the matching FILE_CHARACTERISTIC_* flag is set in show.
+func (udf *Udf) ReadDirAll(fe FileEntryInterface, show uint8) []File {
 	udf.init()
 	if fe == nil {
 		fe = udf.root_fe
 	}
 
-	ps := udf.LogicalPartitionStart(fe.GetPartition())
-	adPos := fe.GetAllocationDescriptors()[0]
-	fdLen := uint64(adPos.GetLength())
-
-	fdBuf := udf.ReadSectors(ps+adPos.GetLocation(), (fdLen+udf.SECTOR_SIZE-1)/udf.SECTOR_SIZE)
+	fdBuf, _ := ioutil.ReadAll(udf.NewFileEntryReader(fe))
 	fdOff := uint64(0)
 
 	result := make([]File, 0)
-	var dummy *FileIdentifierDescriptor
-	fidSize := int(unsafe.Sizeof(*dummy))
-	for uint32(fdOff) < adPos.GetLength() {
+	for fdOff+38 <= uint64(len(fdBuf)) {
+		// Damaged directories are listed from the identifiers that survive
+		if udf.damage != nil {
+			if desc := NewDescriptor(fdBuf[fdOff:]); desc.TagIdentifier != DESCRIPTOR_IDENTIFIER || desc.TagChecksum != desc.Checksum() {
+				fdOff += 4
+				continue
+			}
+		}
 		// Some Windows ISOs have some padding data that we can ignore?
-		if len(fdBuf[fdOff:]) < fidSize {
+		if fdOff+38+uint64(rl_u16(fdBuf[fdOff+36:]))+uint64(fdBuf[fdOff+19]) > uint64(len(fdBuf)) {
 			//fmt.Printf("WARNING: skipping incomplete data\n")
 			break
 		}
 		fid := NewFileIdentifierDescriptor(fdBuf[fdOff:])
-		if fid.FileIdentifier != "" {
+		chars := fid.FileCharacteristics
+		filtered := chars &^ show & (FILE_CHARACTERISTIC_HIDDEN | FILE_CHARACTERISTIC_DELETED | FILE_CHARACTERISTIC_PARENT | FILE_CHARACTERISTIC_METADATA)
+		shown := fid.FileIdentifier != "" || (chars&show != 0 && fid.Descriptor.TagIdentifier == DESCRIPTOR_IDENTIFIER)
+		if filtered == 0 && shown {
 			result = append(result, File{
 				Udf: udf,
 				Fid: fid,
@@ -168,6 +243,41 @@ func (udf *Udf) LogicalPartitionStart(partition uint16) (logical uint64) {
 	}
 }
 
+// readerSize returns the size of the data behind a reader, probing for its
+// end if the reader does not know it
+func readerSize(r io.ReaderAt) int64 {
+	switch sized := r.(type) {
+	case interface{ Size() int64 }:
+		return sized.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := sized.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	var buf [1]byte
+	readable := func(off int64) bool {
+		n, _ := r.ReadAt(buf[:], off)
+		return n == 1
+	}
+	if !readable(0) {
+		return 0
+	}
+	high := int64(1)
+	for readable(high) {
+		high <<= 1
+	}
+	low := high >> 1
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		if readable(mid) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return high
+}
+
 func (udf *Udf) GetReader() io.ReaderAt {
 	return udf.r
 }
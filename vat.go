@@ -0,0 +1,187 @@
+package udf
+
+import (
+	"errors"
+	"io/ioutil"
+)
+
+// VAT_ENTRY_UNUSED marks a virtual block not mapped to a physical block
+const VAT_ENTRY_UNUSED = 0xFFFFFFFF
+
+// VAT_IDENTIFIER closes the virtual allocation tables of UDF 1.50
+const VAT_IDENTIFIER = "*UDF Virtual Alloc Tbl"
+
+// VirtualAllocationTable maps the blocks of a virtual partition to the
+// blocks of the physical partition recording them, on write-once media
+// (UDF 2.2.11)
+type VirtualAllocationTable struct {
+	LogicalVolumeIdentifier string
+	// PreviousVATICBLocation is the block of the physical partition
+	// recording the previous VAT ICB, VAT_ENTRY_UNUSED if there is none
+	PreviousVATICBLocation  uint32
+	NumberOfFiles           uint32
+	NumberOfDirectories     uint32
+	MinimumUDFReadRevision  uint16
+	MinimumUDFWriteRevision uint16
+	MaximumUDFWriteRevision uint16
+	ImplementationUse       []byte
+	Entries                 []uint32
+	data                    []byte
+}
+
+// FromBytes decodes the contents of a VAT file of type FILE_TYPE_VAT, as
+// recorded since UDF 2.00
+func (vat *VirtualAllocationTable) FromBytes(b []byte) *VirtualAllocationTable {
+	if len(b) < 152 {
+		return nil
+	}
+	headerLength := int(rl_u16(b[0:]))
+	implUseLength := int(rl_u16(b[2:]))
+	if headerLength < 152 || headerLength > len(b) || 152+implUseLength > headerLength {
+		return nil
+	}
+	vat.LogicalVolumeIdentifier = r_dstring(b[4:], 128)
+	vat.PreviousVATICBLocation = rl_u32(b[132:])
+	vat.NumberOfFiles = rl_u32(b[136:])
+	vat.NumberOfDirectories = rl_u32(b[140:])
+	vat.MinimumUDFReadRevision = rl_u16(b[144:])
+	vat.MinimumUDFWriteRevision = rl_u16(b[146:])
+	vat.MaximumUDFWriteRevision = rl_u16(b[148:])
+	vat.ImplementationUse = b[152 : 152+implUseLength]
+	vat.Entries = readVATEntries(b[headerLength:])
+	vat.data = b
+	return vat
+}
+
+func NewVirtualAllocationTable(b []byte) *VirtualAllocationTable {
+	return new(VirtualAllocationTable).FromBytes(b)
+}
+
+// fromOldBytes decodes the contents of a UDF 1.50 VAT file, whose entries
+// are followed by an identifier and the previous VAT ICB location
+func (vat *VirtualAllocationTable) fromOldBytes(b []byte) *VirtualAllocationTable {
+	if len(b) < 36 || NewEntityID(b[len(b)-36:]).IdentifierString() != VAT_IDENTIFIER {
+		return nil
+	}
+	vat.PreviousVATICBLocation = rl_u32(b[len(b)-4:])
+	vat.Entries = readVATEntries(b[:len(b)-36])
+	return vat
+}
+
+func readVATEntries(b []byte) []uint32 {
+	entries := make([]uint32, len(b)/4)
+	for i := range entries {
+		entries[i] = rl_u32(b[4*i:])
+	}
+	return entries
+}
+
+// MarshalBinary records the table in the UDF 2.00 format
+func (vat *VirtualAllocationTable) MarshalBinary() ([]byte, error) {
+	headerLength := 152 + len(vat.ImplementationUse)
+	b := make([]byte, headerLength+4*len(vat.Entries))
+	if len(vat.data) >= 152 && int(rl_u16(vat.data[0:])) == headerLength {
+		copy(b, vat.data[:headerLength])
+	}
+	wl_u16(b[0:], uint16(headerLength))
+	wl_u16(b[2:], uint16(len(vat.ImplementationUse)))
+	w_dstring(b[4:], vat.LogicalVolumeIdentifier, 128)
+	wl_u32(b[132:], vat.PreviousVATICBLocation)
+	wl_u32(b[136:], vat.NumberOfFiles)
+	wl_u32(b[140:], vat.NumberOfDirectories)
+	wl_u16(b[144:], vat.MinimumUDFReadRevision)
+	wl_u16(b[146:], vat.MinimumUDFWriteRevision)
+	wl_u16(b[148:], vat.MaximumUDFWriteRevision)
+	copy(b[152:], vat.ImplementationUse)
+	for i, entry := range vat.Entries {
+		wl_u32(b[headerLength+4*i:], entry)
+	}
+	return b, nil
+}
+
+// isVirtual returns true for the type 2 maps of virtual
+// partitions
+func (pm *PartitionMap) isVirtual() bool {
+	return pm.PartitionMapType == 2 && pm.PartitionTypeIdentifier.IdentifierString() == "*UDF Virtual Partition"
+}
+
+// physicalPartition returns the partition map of the physical or sparable
+// partition a virtual or metadata partition is recorded in, or the given one
+func (udf *Udf) physicalPartition(partition uint16) uint16 {
+	maps := udf.lvd.PartitionMaps
+	if maps[partition].isPhysical() {
+		return partition
+	}
+	pd, ok := udf.mapDescriptor(&maps[partition])
+	for i := range maps {
+		if recorded, _ := udf.mapDescriptor(&maps[i]); ok && maps[i].isPhysical() && recorded == pd {
+			return uint16(i)
+		}
+	}
+	return partition
+}
+
+// readVAT reads the virtual allocation table recorded by the VAT ICB at the
+// given sector, nil if there is none
+func (udf *Udf) readVAT(partition uint16, sector uint64) *VirtualAllocationTable {
+	b := udf.ReadSector(sector)
+	desc := NewDescriptor(b)
+	if (desc.TagIdentifier != DESCRIPTOR_FILE_ENTRY && desc.TagIdentifier != DESCRIPTOR_EXTENDED_FILE_ENTRY) || !desc.Valid() {
+		return nil
+	}
+	fe := NewFileEntry(udf.physicalPartition(partition), b)
+	fileType := fe.GetICBTag().FileType
+	if fileType != FILE_TYPE_VAT && fileType != FILE_TYPE_UNSPECIFIED {
+		return nil
+	}
+	data, err := ioutil.ReadAll(udf.NewFileEntryReader(fe))
+	if err != nil {
+		return nil
+	}
+	if uint64(len(data)) > fe.GetInformationLength() {
+		data = data[:fe.GetInformationLength()]
+	}
+	if fileType == FILE_TYPE_VAT {
+		return NewVirtualAllocationTable(data)
+	}
+	return new(VirtualAllocationTable).fromOldBytes(data)
+}
+
+// vatSearchSectors is how far before the end of the image the last VAT ICB
+// is looked for, to skip the run-out blocks of packet writing
+const vatSearchSectors = 32
+
+// loadVAT finds the virtual allocation table of a virtual partition: the
+// one recorded at vatSector if set, else the last one recorded
+func (udf *Udf) loadVAT(partition uint16) error {
+	sector := udf.vatSector
+	if sector == 0 {
+		last := uint64(readerSize(udf.r)) / udf.SECTOR_SIZE
+		for s := last; s > 0 && s+vatSearchSectors > last; s-- {
+			if vat := udf.readVAT(partition, s-1); vat != nil {
+				sector = s - 1
+				break
+			}
+		}
+	}
+	vat := udf.readVAT(partition, sector)
+	if sector == 0 || vat == nil {
+		return errors.New("could not find the virtual allocation table")
+	}
+	if udf.vat == nil {
+		udf.vat = make(map[uint16]*VirtualAllocationTable)
+	}
+	udf.vat[partition] = vat
+	udf.vatSector = sector
+	return nil
+}
+
+// VirtualAllocationTable returns the virtual allocation table in use, nil
+// unless the volume has a virtual partition
+func (udf *Udf) VirtualAllocationTable() *VirtualAllocationTable {
+	udf.init()
+	for _, vat := range udf.vat {
+		return vat
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package udf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// volumeSet reads the volumes of a volume set as a single image, volume n
+// starting at byte (n-1)*stride
+type volumeSet struct {
+	volumes []io.ReaderAt
+	sizes   []int64
+	stride  int64
+}
+
+func (vs *volumeSet) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		volume := pos / vs.stride
+		if volume >= int64(len(vs.volumes)) || vs.volumes[volume] == nil {
+			return n, io.EOF
+		}
+		within := pos % vs.stride
+		chunk := p[n:]
+		if int64(len(chunk)) > vs.stride-within {
+			chunk = chunk[:vs.stride-within]
+		}
+		read, err := vs.volumes[volume].ReadAt(chunk, within)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Size returns the end of the last volume
+func (vs *volumeSet) Size() int64 {
+	last := len(vs.volumes) - 1
+	for last > 0 && vs.volumes[last] == nil {
+		last--
+	}
+	return int64(last)*vs.stride + vs.sizes[last]
+}
+
+// NewUdfFromVolumeSet returns an Udf reader of a volume set recorded on
+// several images, one per volume, given in any order. The volumes must
+// share their volume set identifier; partitions and extents are read from
+// the volume recording them, which each partition map names along with
+// the partition number.
+func NewUdfFromVolumeSet(volumes []io.ReaderAt) (udf *Udf, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			udf, err = nil, fmt.Errorf("udf: %v", r)
+		}
+	}()
+	if len(volumes) == 0 {
+		return nil, errors.New("udf: no volumes")
+	}
+	var first *Udf
+	set := &volumeSet{}
+	descriptors := make([]*Udf, 0, len(volumes))
+	for i, r := range volumes {
+		v := &Udf{r: r, pd: make(map[uint16]*PartitionDescriptor)}
+		if err := v.readVolumeDescriptors(); err != nil {
+			return nil, fmt.Errorf("udf: volume %d: %v", i, err)
+		}
+		if v.pvd == nil {
+			return nil, fmt.Errorf("udf: volume %d has no primary volume descriptor", i)
+		}
+		if first == nil {
+			first = v
+			set.volumes = make([]io.ReaderAt, v.pvd.MaximumVolumeSequenceNumber)
+			set.sizes = make([]int64, v.pvd.MaximumVolumeSequenceNumber)
+		}
+		switch seq := int(v.pvd.VolumeSequenceNumber); {
+		case v.SECTOR_SIZE != first.SECTOR_SIZE:
+			return nil, fmt.Errorf("udf: volume %d has %d byte sectors, not %d", i, v.SECTOR_SIZE, first.SECTOR_SIZE)
+		case v.pvd.VolumeSetIdentifier != first.pvd.VolumeSetIdentifier || v.pvd.MaximumVolumeSequenceNumber != first.pvd.MaximumVolumeSequenceNumber:
+			return nil, fmt.Errorf("udf: volume %d belongs to volume set %q, not %q", i, v.pvd.VolumeSetIdentifier, first.pvd.VolumeSetIdentifier)
+		case seq < 1 || seq > len(set.volumes):
+			return nil, fmt.Errorf("udf: volume %d has sequence number %d of %d", i, seq, len(set.volumes))
+		case set.volumes[seq-1] != nil:
+			return nil, fmt.Errorf("udf: volume %d is volume %d again", i, seq)
+		default:
+			set.volumes[seq-1] = r
+			set.sizes[seq-1] = readerSize(r)
+			if set.sizes[seq-1] > set.stride {
+				set.stride = set.sizes[seq-1]
+			}
+		}
+		descriptors = append(descriptors, v)
+	}
+	sectorSize := int64(first.SECTOR_SIZE)
+	set.stride = (set.stride + sectorSize - 1) / sectorSize * sectorSize
+	if set.stride/sectorSize*int64(len(set.volumes)) > 0xFFFFFFFF {
+		return nil, errors.New("udf: the volume set is too large")
+	}
+
+	udf = &Udf{
+		r:           set,
+		pd:          make(map[uint16]*PartitionDescriptor),
+		volumePd:    make(map[volumePartition]*PartitionDescriptor),
+		SECTOR_SIZE: first.SECTOR_SIZE,
+	}
+	var lvdBase uint32
+	// The partitions of each volume are addressed within its range of the
+	// set, and the logical volume descriptor with the highest sequence
+	// number prevails
+	for _, v := range descriptors {
+		base := uint32((int64(v.pvd.VolumeSequenceNumber) - 1) * set.stride / sectorSize)
+		if v.pvd.VolumeSequenceNumber == 1 || udf.pvd == nil {
+			udf.pvd, udf.iuvd, udf.usd = v.pvd, v.iuvd, v.usd
+		}
+		for number, pd := range v.pd {
+			pd.PartitionStartingLocation += base
+			udf.volumePd[volumePartition{v.pvd.VolumeSequenceNumber, number}] = pd
+		}
+		if v.lvd != nil && (udf.lvd == nil || v.lvd.VolumeDescriptorSequenceNumber > udf.lvd.VolumeDescriptorSequenceNumber) {
+			udf.lvd = v.lvd
+			lvdBase = base
+		}
+	}
+	if udf.lvd == nil {
+		return nil, errors.New("udf: could not find a logical volume descriptor")
+	}
+	// The integrity sequence is recorded on the volume of the prevailing
+	// logical volume descriptor
+	if udf.lvd.IntegritySequenceExtent.Length > 0 {
+		udf.lvd.IntegritySequenceExtent.Location += lvdBase
+	}
+	if err := udf.init(); err != nil {
+		return nil, err
+	}
+	return udf, nil
+}
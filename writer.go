@@ -0,0 +1,1039 @@
+package udf
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// UDF revisions recorded by Writer
+const (
+	UDF_REVISION_102 = 0x0102
+	UDF_REVISION_201 = 0x0201
+	UDF_REVISION_250 = 0x0250
+)
+
+var (
+	ErrWriteTooLong    = errors.New("udf: write too long")
+	ErrWriteAfterClose = errors.New("udf: write after close")
+)
+
+// IMPLEMENTATION_IDENTIFIER identifies this library in the structures it writes
+const IMPLEMENTATION_IDENTIFIER = "*Xmister UDF"
+
+// Header describes an entry added to an image by Writer.WriteHeader
+type Header struct {
+	// Name is the slash-separated path of the entry; missing parent
+	// directories are created. A Name of "/" sets the root directory's
+	// metadata.
+	Name string
+	// Mode holds the permission bits, the setuid, setgid and sticky bits
+	// and the type: os.ModeDir, os.ModeSymlink, os.ModeDevice (with
+	// os.ModeCharDevice), os.ModeNamedPipe, os.ModeSocket, or none for a
+	// regular file
+	Mode os.FileMode
+	// Linkname is the target of a symbolic link
+	Linkname string
+	// Size is the length of a regular file's data, to be written with Write
+	Size       int64
+	Uid        uint32
+	Gid        uint32
+	ModTime    time.Time
+	AccessTime time.Time
+	// ChangeTime is recorded as the attribute time
+	ChangeTime time.Time
+	// Devmajor and Devminor are the numbers of a block or character
+	// device, recorded in a Device Specification extended attribute
+	Devmajor uint32
+	Devminor uint32
+}
+
+// WriterOptions are the volume-wide settings of a Writer
+type WriterOptions struct {
+	// Revision is one of the UDF_REVISION_* values, UDF_REVISION_201 if zero
+	Revision uint16
+	// VolumeIdentifier is the volume label
+	VolumeIdentifier string
+	// BlockSize is the sector and logical block size, 2048 if zero
+	BlockSize uint32
+	// FreeBlocks is the number of blocks left free at the end of the
+	// partition, for later modifications such as Editor.Create. Write-once
+	// volumes leave the rest of an 80 minute CD-R free if zero.
+	FreeBlocks uint32
+	// FreeMetadataBlocks is the number of blocks left free in the metadata
+	// partition of UDF 2.50 volumes, where new file entries and directories
+	// go. Without them, an Editor cannot add entries to the volume.
+	FreeMetadataBlocks uint32
+	// WriteOnce records a sequential volume for write-once media, UDF 2.01
+	// only: file entries and directories go in a virtual partition mapped
+	// by a virtual allocation table recorded last, and later sessions can
+	// be added with an Appender
+	WriteOnce bool
+	// RecordingTime is the time recorded in the volume structures and the
+	// default time of entries, the current time if zero
+	RecordingTime time.Time
+}
+
+type writerNode struct {
+	hdr      Header
+	parent   *writerNode
+	children []*writerNode
+	byName   map[string]*writerNode
+	// data holds the contents of small files, symbolic links and directories
+	data []byte
+	// extents are the blocks of a file's data in the physical partition
+	extents  []ExtentLong
+	location LbAddr
+	uniqueID uint64
+}
+
+func (n *writerNode) isDir() bool {
+	return n.hdr.Mode&os.ModeDir != 0
+}
+
+// Writer creates a UDF image on an io.WriterAt, in the spirit of
+// archive/tar.Writer: each entry is added with WriteHeader and the data of
+// regular files is then written with Write. The volume structures are
+// recorded by Close.
+//
+// File data is written as it comes; directories and file entries are kept
+// in memory until Close.
+type Writer struct {
+	w    io.WriterAt
+	opts WriterOptions
+	root *writerNode
+	// nodes are the entries in the order they were added
+	nodes []*writerNode
+
+	cur       *writerNode
+	remaining int64
+	pos       int64
+	embedded  bool
+
+	// next is the next free block of the physical partition
+	next   uint32
+	err    error
+	closed bool
+}
+
+// Fixed layout of the volume, in sectors: the partition starts right after
+// the anchor at sector 256
+const writerPartitionStart = 257
+
+// writeOnceCapacity is the size in bytes of an 80 minute CD-R, which
+// write-once partitions span by default
+const writeOnceCapacity = 360000 * 2048
+
+// NewWriter returns a Writer recording an image on w. opts may be nil.
+func NewWriter(w io.WriterAt, opts *WriterOptions) *Writer {
+	uw := &Writer{w: w}
+	if opts != nil {
+		uw.opts = *opts
+	}
+	if uw.opts.Revision == 0 {
+		uw.opts.Revision = UDF_REVISION_201
+	}
+	if uw.opts.BlockSize == 0 {
+		uw.opts.BlockSize = 2048
+	}
+	if uw.opts.RecordingTime.IsZero() {
+		uw.opts.RecordingTime = time.Now()
+	}
+	switch {
+	case uw.opts.Revision != UDF_REVISION_102 && uw.opts.Revision != UDF_REVISION_201 && uw.opts.Revision != UDF_REVISION_250:
+		uw.err = fmt.Errorf("udf: unsupported revision %s", UDFRevisionString(uw.opts.Revision))
+	case uw.opts.BlockSize < 512 || uw.opts.BlockSize > 32768 || uw.opts.BlockSize&(uw.opts.BlockSize-1) != 0:
+		uw.err = fmt.Errorf("udf: invalid block size %d", uw.opts.BlockSize)
+	case uw.opts.WriteOnce && uw.opts.Revision != UDF_REVISION_201:
+		uw.err = errors.New("udf: write-once volumes are only supported for UDF 2.01")
+	}
+	uw.root = &writerNode{
+		hdr:    Header{Name: "/", Mode: os.ModeDir | 0755},
+		byName: make(map[string]*writerNode),
+	}
+	if uw.opts.Revision >= UDF_REVISION_250 {
+		// The metadata file, its mirror and its bitmap have their file
+		// entries first
+		uw.next = 3
+	}
+	return uw
+}
+
+// fileEntryHeaderLength returns the length of the file entries written,
+// before their extended attributes and allocation descriptors
+func (uw *Writer) fileEntryHeaderLength() int {
+	if uw.opts.Revision >= UDF_REVISION_250 {
+		return 216
+	}
+	return 176
+}
+
+// embeddedLimit returns the largest data recorded in the file entry itself
+func (uw *Writer) embeddedLimit() int {
+	return int(uw.opts.BlockSize) - uw.fileEntryHeaderLength()
+}
+
+// maxExtentLength is the largest multiple of the block size an allocation
+// descriptor can record
+func (uw *Writer) maxExtentLength() uint32 {
+	return 1<<30 - uw.opts.BlockSize
+}
+
+// finishEntry checks the current entry got all its data
+func (uw *Writer) finishEntry() error {
+	if uw.remaining > 0 {
+		return fmt.Errorf("udf: missed writing %d bytes of %s", uw.remaining, uw.cur.hdr.Name)
+	}
+	uw.cur = nil
+	return nil
+}
+
+// lookupDir returns the directory at the given clean path, creating it and
+// its parents if needed
+func (uw *Writer) lookupDir(dir string) (*writerNode, error) {
+	node := uw.root
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := node.byName[name]
+		if !ok {
+			child = uw.addNode(node, name, Header{
+				Name:    path.Join(dir, name),
+				Mode:    os.ModeDir | 0755,
+				ModTime: uw.opts.RecordingTime,
+			})
+		}
+		if !child.isDir() {
+			return nil, fmt.Errorf("udf: %s is not a directory", child.hdr.Name)
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (uw *Writer) addNode(parent *writerNode, name string, hdr Header) *writerNode {
+	node := &writerNode{
+		hdr:    hdr,
+		parent: parent,
+	}
+	if node.isDir() {
+		node.byName = make(map[string]*writerNode)
+	}
+	parent.children = append(parent.children, node)
+	parent.byName[name] = node
+	uw.nodes = append(uw.nodes, node)
+	return node
+}
+
+// WriteHeader adds an entry to the image. For regular files, hdr.Size bytes
+// of data must then be written with Write.
+func (uw *Writer) WriteHeader(hdr *Header) error {
+	if uw.closed {
+		return ErrWriteAfterClose
+	}
+	if uw.err != nil {
+		return uw.err
+	}
+	if err := uw.finishEntry(); err != nil {
+		return err
+	}
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		if hdr.Mode&os.ModeType != os.ModeDir {
+			return errors.New("udf: the root entry must be a directory")
+		}
+		uw.root.hdr = *hdr
+		return nil
+	}
+	parent, err := uw.lookupDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if existing, ok := parent.byName[base]; ok {
+		// Directories created for their children take the explicit header
+		if existing.isDir() && hdr.Mode&os.ModeDir != 0 {
+			existing.hdr = *hdr
+			existing.hdr.Name = name
+			return nil
+		}
+		return fmt.Errorf("udf: duplicate entry %s", name)
+	}
+	if len(w_dcharacters(base)) > 255 {
+		return fmt.Errorf("udf: name too long: %s", base)
+	}
+	node := uw.addNode(parent, base, *hdr)
+	node.hdr.Name = name
+
+	switch {
+	case hdr.Mode&os.ModeSymlink != 0:
+		node.data = w_pathComponents(hdr.Linkname)
+	case hdr.Mode&os.ModeType == 0:
+		if hdr.Size < 0 {
+			return fmt.Errorf("udf: negative size for %s", name)
+		}
+		uw.cur = node
+		uw.remaining = hdr.Size
+		uw.embedded = hdr.Size <= int64(uw.embeddedLimit())
+		if uw.embedded {
+			node.data = make([]byte, 0, hdr.Size)
+			break
+		}
+		node.extents = uw.allocateExtents(uint64(hdr.Size), 0)
+		if len(node.extents) > (int(uw.opts.BlockSize)-uw.fileEntryHeaderLength())/16 {
+			uw.err = fmt.Errorf("udf: %s is too large for a single file entry", name)
+			return uw.err
+		}
+		uw.pos = int64(writerPartitionStart+uint64(node.extents[0].Location.LogicalBlockNumber)) * int64(uw.opts.BlockSize)
+	}
+	return nil
+}
+
+// allocateExtents allocates contiguous blocks of the physical partition for
+// length bytes, split into extents an allocation descriptor can record
+func (uw *Writer) allocateExtents(length uint64, partition uint16) (extents []ExtentLong) {
+	for length > 0 {
+		extentLength := uint32(minUint64(length, uint64(uw.maxExtentLength())))
+		extents = append(extents, ExtentLong{extentLength, LbAddr{uw.next, partition}})
+		uw.next += (extentLength + uw.opts.BlockSize - 1) / uw.opts.BlockSize
+		length -= uint64(extentLength)
+	}
+	return
+}
+
+// Write writes data of the current regular file
+func (uw *Writer) Write(p []byte) (n int, err error) {
+	if uw.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if uw.err != nil {
+		return 0, uw.err
+	}
+	if uw.cur == nil || int64(len(p)) > uw.remaining {
+		err = ErrWriteTooLong
+		if uw.cur == nil {
+			return 0, err
+		}
+		p = p[:uw.remaining]
+	}
+	if uw.embedded {
+		uw.cur.data = append(uw.cur.data, p...)
+		n = len(p)
+	} else {
+		n, uw.err = uw.w.WriteAt(p, uw.pos)
+		if uw.err != nil {
+			return n, uw.err
+		}
+		uw.pos += int64(n)
+	}
+	uw.remaining -= int64(n)
+	return n, err
+}
+
+// udfPermissions converts Unix permission bits to UDF permissions, where
+// owners may also change attributes and delete the entry
+func udfPermissions(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	udfPerm := perm&7 | (perm>>3&7)<<5 | (perm>>6&7)<<10
+	if perm&0200 != 0 {
+		udfPerm |= 3 << 13
+	}
+	return udfPerm
+}
+
+func udfFileType(mode os.FileMode) uint8 {
+	switch {
+	case mode&os.ModeDir != 0:
+		return FILE_TYPE_DIRECTORY
+	case mode&os.ModeSymlink != 0:
+		return FILE_TYPE_SYMLINK
+	case mode&os.ModeCharDevice != 0:
+		return FILE_TYPE_CHARACTER_DEVICE
+	case mode&os.ModeDevice != 0:
+		return FILE_TYPE_BLOCK_DEVICE
+	case mode&os.ModeNamedPipe != 0:
+		return FILE_TYPE_FIFO
+	case mode&os.ModeSocket != 0:
+		return FILE_TYPE_SOCKET
+	}
+	return FILE_TYPE_REGULAR
+}
+
+// newEntityID returns an EntityID with the given identifier and suffix
+func newEntityID(identifier string, suffix ...byte) (e EntityID) {
+	copy(e.Identifier[:], identifier)
+	copy(e.IdentifierSuffix[:], suffix)
+	return
+}
+
+// implementationIdentifier identifies this library, along with the
+// operating system it runs on
+func implementationIdentifier() EntityID {
+	osClass, osIdentifier := uint8(OS_CLASS_UNDEFINED), uint8(0)
+	switch runtime.GOOS {
+	case "windows":
+		osClass = OS_CLASS_WINDOWS_NT
+	case "darwin":
+		osClass, osIdentifier = OS_CLASS_MACINTOSH, 1
+	case "linux":
+		osClass, osIdentifier = OS_CLASS_UNIX, 5
+	case "freebsd":
+		osClass, osIdentifier = OS_CLASS_UNIX, 7
+	case "netbsd":
+		osClass, osIdentifier = OS_CLASS_UNIX, 8
+	}
+	return newEntityID(IMPLEMENTATION_IDENTIFIER, osClass, osIdentifier)
+}
+
+func (uw *Writer) domainIdentifier() EntityID {
+	return newEntityID(DOMAIN_IDENTIFIER_UDF, uint8(uw.opts.Revision), uint8(uw.opts.Revision>>8))
+}
+
+func (uw *Writer) udfIdentifier(identifier string) EntityID {
+	impl := implementationIdentifier()
+	return newEntityID(identifier, uint8(uw.opts.Revision), uint8(uw.opts.Revision>>8), impl.IdentifierSuffix[0], impl.IdentifierSuffix[1])
+}
+
+func (uw *Writer) descriptorVersion() uint16 {
+	if uw.opts.Revision >= UDF_REVISION_201 {
+		return 3
+	}
+	return 2
+}
+
+// metadataSpace lays out the blocks holding the file set, file entries and
+// directories: the metadata partition for UDF 2.50, else the physical
+// partition after the file data
+type metadataSpace struct {
+	blockSize uint32
+	// base and partition address the first block of the space
+	base      uint32
+	partition uint16
+	data      []byte
+}
+
+func (m *metadataSpace) blocks() uint32 {
+	return uint32(len(m.data)) / m.blockSize
+}
+
+// allocate reserves blocks for length bytes, returning the first one
+func (m *metadataSpace) allocate(length int) uint32 {
+	block := m.blocks()
+	count := (length + int(m.blockSize) - 1) / int(m.blockSize)
+	if count == 0 {
+		count = 1
+	}
+	m.data = append(m.data, make([]byte, count*int(m.blockSize))...)
+	return block
+}
+
+func (m *metadataSpace) address(block uint32) LbAddr {
+	return LbAddr{m.base + block, m.partition}
+}
+
+func (m *metadataSpace) put(block uint32, b []byte) {
+	copy(m.data[block*m.blockSize:], b)
+}
+
+// Close records the directories, the file entries and the volume
+// structures. It does not close the underlying writer.
+func (uw *Writer) Close() error {
+	if uw.closed {
+		return ErrWriteAfterClose
+	}
+	if uw.err != nil {
+		return uw.err
+	}
+	if err := uw.finishEntry(); err != nil {
+		return err
+	}
+	uw.closed = true
+	uw.err = uw.close()
+	return uw.err
+}
+
+func (uw *Writer) close() error {
+	bs := uw.opts.BlockSize
+	rev250 := uw.opts.Revision >= UDF_REVISION_250
+	meta := &metadataSpace{blockSize: bs}
+	if rev250 || uw.opts.WriteOnce {
+		meta.partition = 1
+	}
+
+	// The file set descriptor and its terminator come first
+	fsdBlock := meta.allocate(int(bs))
+	meta.allocate(int(bs))
+
+	// Then a file entry per entry, root first
+	all := append([]*writerNode{uw.root}, uw.nodes...)
+	var files, dirs uint32
+	for i, node := range all {
+		node.location.LogicalBlockNumber = meta.allocate(int(bs))
+		node.location.PartitionReferenceNumber = meta.partition
+		// Unique IDs 1 to 15 are reserved, the root directory's is 0
+		if i > 0 {
+			node.uniqueID = uint64(15 + i)
+		}
+		if node.isDir() {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	nextUniqueID := uint64(len(all) + 15)
+
+	// The physical partition records the file data, then the metadata
+	if meta.partition == 0 {
+		meta.base = uw.next
+		for _, node := range all {
+			node.location.LogicalBlockNumber += meta.base
+		}
+	}
+
+	// Directories name their entries, after a parent entry
+	for _, node := range all {
+		if !node.isDir() {
+			continue
+		}
+		parent := node.parent
+		if parent == nil {
+			parent = node
+		}
+		fids := [][]byte{uw.fileIdentifier(parent, "", FILE_CHARACTERISTIC_PARENT|FILE_CHARACTERISTIC_DIRECTORY)}
+		for _, child := range node.children {
+			var characteristics uint8
+			if child.isDir() {
+				characteristics = FILE_CHARACTERISTIC_DIRECTORY
+			}
+			fids = append(fids, uw.fileIdentifier(child, path.Base(child.hdr.Name), characteristics))
+		}
+		var length int
+		for _, fid := range fids {
+			length += len(fid)
+		}
+		start := node.location.LogicalBlockNumber - meta.base
+		if length > uw.embeddedLimit() {
+			start = meta.allocate(length)
+			node.extents = []ExtentLong{{uint32(length), meta.address(start)}}
+		}
+		// Each identifier records the block holding its tag
+		off := 0
+		for _, fid := range fids {
+			wl_u32(fid[12:], meta.base+start+uint32(off)/bs)
+			setDescriptorTag(fid)
+			node.data = append(node.data, fid...)
+			off += len(fid)
+		}
+		if node.extents != nil {
+			meta.put(start, node.data)
+			node.data = nil
+		}
+	}
+	for _, node := range all {
+		if node.hdr.Mode&os.ModeSymlink != 0 && len(node.data) > uw.embeddedLimit() {
+			start := meta.allocate(len(node.data))
+			node.extents = []ExtentLong{{uint32(len(node.data)), meta.address(start)}}
+			meta.put(start, node.data)
+			node.data = nil
+		}
+	}
+
+	for _, node := range all {
+		fe, err := uw.fileEntry(node)
+		if err != nil {
+			return err
+		}
+		meta.put(node.location.LogicalBlockNumber-meta.base, fe)
+	}
+	fsd := &FileSetDescriptor{
+		Descriptor:              Descriptor{DescriptorVersion: uw.descriptorVersion(), TagLocation: meta.base + fsdBlock},
+		RecordingDateTime:       uw.opts.RecordingTime,
+		InterchangeLevel:        3,
+		MaximumInterchangeLevel: 3,
+		CharacterSetList:        1,
+		MaximumCharacterSetList: 1,
+		LogicalVolumeIdentifier: uw.opts.VolumeIdentifier,
+		FileSetIdentifier:       uw.opts.VolumeIdentifier,
+		RootDirectoryICB:        ExtentLong{bs, uw.root.location},
+		DomainIdentifier:        uw.domainIdentifier(),
+	}
+	b, _ := fsd.MarshalBinary()
+	meta.put(fsdBlock, b)
+	meta.put(fsdBlock+1, uw.terminatingDescriptor(meta.base+fsdBlock+1))
+
+	// Lay out the physical partition: the metadata file, its mirror and its
+	// bitmap for UDF 2.50, then the space bitmap and the free blocks
+	metaStart := uw.next
+	metaBlocks := meta.blocks()
+	if rev250 {
+		metaBlocks += uw.opts.FreeMetadataBlocks
+		uw.next += 2 * metaBlocks
+		metaFile := make([]byte, metaBlocks*bs)
+		copy(metaFile, meta.data)
+		for i, fileType := range []uint8{FILE_TYPE_METADATA, FILE_TYPE_METADATA_MIRROR} {
+			fe, err := uw.metadataFileEntry(uint32(i), fileType, metaStart+uint32(i)*metaBlocks, uint64(len(metaFile)))
+			if err != nil {
+				return err
+			}
+			if err := uw.writeBlocks(uint32(i), fe); err != nil {
+				return err
+			}
+			if err := uw.writeBlocks(metaStart+uint32(i)*metaBlocks, metaFile); err != nil {
+				return err
+			}
+		}
+		metaBitmap := &SpaceBitmapDescriptor{
+			Descriptor:   Descriptor{DescriptorVersion: uw.descriptorVersion()},
+			NumberOfBits: metaBlocks,
+			Bitmap:       make([]byte, (metaBlocks+7)/8),
+		}
+		for block := meta.blocks(); block < metaBlocks; block++ {
+			metaBitmap.Bitmap[block/8] |= 1 << (block % 8)
+		}
+		b, _ := metaBitmap.MarshalBinary()
+		fe, err := uw.metadataFileEntry(2, FILE_TYPE_METADATA_BITMAP, uw.next, uint64(len(b)))
+		if err != nil {
+			return err
+		}
+		if err := uw.writeBlocks(2, fe); err != nil {
+			return err
+		}
+		if err := uw.writeBlocks(uw.next, b); err != nil {
+			return err
+		}
+		uw.next += (uint32(len(b)) + bs - 1) / bs
+	} else {
+		uw.next += meta.blocks()
+		if err := uw.writeBlocks(metaStart, meta.data); err != nil {
+			return err
+		}
+	}
+	if uw.opts.WriteOnce {
+		// The virtual partition maps the metadata blocks as laid out
+		vat := &VirtualAllocationTable{
+			LogicalVolumeIdentifier: uw.opts.VolumeIdentifier,
+			PreviousVATICBLocation:  VAT_ENTRY_UNUSED,
+			NumberOfFiles:           files,
+			NumberOfDirectories:     dirs,
+			MinimumUDFReadRevision:  uw.opts.Revision,
+			MinimumUDFWriteRevision: uw.opts.Revision,
+			MaximumUDFWriteRevision: uw.opts.Revision,
+		}
+		for block := uint32(0); block < meta.blocks(); block++ {
+			vat.Entries = append(vat.Entries, metaStart+block)
+		}
+		data, icb, err := uw.vatFile(uw.next, vat, nextUniqueID)
+		if err != nil {
+			return err
+		}
+		if err := uw.writeBlocks(uw.next, append(data, icb...)); err != nil {
+			return err
+		}
+		uw.next += uint32(len(data)+len(icb)) / bs
+		if uw.opts.FreeBlocks == 0 && uw.next < writeOnceCapacity/bs-writerPartitionStart {
+			// Later sessions are recorded in the rest of the media
+			uw.opts.FreeBlocks = writeOnceCapacity/bs - writerPartitionStart - uw.next
+		}
+		return uw.writeVolumeStructures(uw.next+uw.opts.FreeBlocks, 0, Extent{}, meta.address(fsdBlock), files, dirs, nextUniqueID)
+	}
+	bitmapBlock := uw.next
+	var partitionLength, bitmapBlocks uint32
+	for {
+		partitionLength = bitmapBlock + bitmapBlocks + uw.opts.FreeBlocks
+		needed := (24 + (partitionLength+7)/8 + bs - 1) / bs
+		if needed == bitmapBlocks {
+			break
+		}
+		bitmapBlocks = needed
+	}
+	sbd := &SpaceBitmapDescriptor{
+		Descriptor:   Descriptor{DescriptorVersion: uw.descriptorVersion(), TagLocation: bitmapBlock},
+		NumberOfBits: partitionLength,
+		Bitmap:       make([]byte, (partitionLength+7)/8),
+	}
+	for block := bitmapBlock + bitmapBlocks; block < partitionLength; block++ {
+		sbd.Bitmap[block/8] |= 1 << (block % 8)
+	}
+	b, _ = sbd.MarshalBinary()
+	if err := uw.writeBlocks(bitmapBlock, b); err != nil {
+		return err
+	}
+
+	return uw.writeVolumeStructures(partitionLength, metaBlocks, Extent{uint32(len(b)), bitmapBlock}, meta.address(fsdBlock), files, dirs, nextUniqueID)
+}
+
+// writeBlocks writes data at a block of the physical partition
+func (uw *Writer) writeBlocks(block uint32, b []byte) error {
+	return uw.writeSectors(writerPartitionStart+uint64(block), b)
+}
+
+func (uw *Writer) writeSectors(sector uint64, b []byte) error {
+	_, err := uw.w.WriteAt(b, int64(sector)*int64(uw.opts.BlockSize))
+	return err
+}
+
+// fileIdentifier returns the file identifier descriptor naming an entry;
+// its tag location is set once the directory is laid out
+func (uw *Writer) fileIdentifier(node *writerNode, name string, characteristics uint8) []byte {
+	fid := &FileIdentifierDescriptor{
+		Descriptor:          Descriptor{DescriptorVersion: uw.descriptorVersion()},
+		FileVersionNumber:   1,
+		FileCharacteristics: characteristics,
+		ICB:                 ExtentLong{uw.opts.BlockSize, node.location},
+		FileIdentifier:      name,
+	}
+	b, _ := fid.MarshalBinary()
+	// The implementation use of the ICB records the entry's UDF unique ID
+	wl_u32(b[20+12:], uint32(node.uniqueID))
+	return b
+}
+
+func (uw *Writer) terminatingDescriptor(location uint32) []byte {
+	b := make([]byte, 512)
+	wl_u16(b[0:], DESCRIPTOR_TERMINATING)
+	wl_u16(b[2:], uw.descriptorVersion())
+	wl_u16(b[10:], uint16(len(b)-16))
+	wl_u32(b[12:], location)
+	setDescriptorTag(b)
+	return b
+}
+
+// deviceAttributes returns the extended attribute space of a device's file
+// entry, holding its Device Specification attribute (ECMA-167 4/14.10.7)
+func (uw *Writer) deviceAttributes(location uint32, major uint32, minor uint32) []byte {
+	b := make([]byte, 24+24)
+	wl_u16(b[0:], DESCRIPTOR_EXTENDED_ATTRIBUTE_HEADER)
+	wl_u16(b[2:], uw.descriptorVersion())
+	wl_u16(b[10:], 8)
+	wl_u32(b[12:], location)
+	// No implementation or application use attributes follow
+	wl_u32(b[16:], uint32(len(b)))
+	wl_u32(b[20:], uint32(len(b)))
+	setDescriptorTag(b)
+	wl_u32(b[24:], EA_TYPE_DEVICE_SPECIFICATION)
+	b[28] = 1
+	wl_u32(b[32:], 24)
+	wl_u32(b[40:], major)
+	wl_u32(b[44:], minor)
+	return b
+}
+
+// newFileEntry returns the file entry type recorded for the revision
+func (uw *Writer) newFileEntry(location uint32, icbTag *ICBTag) (*ExtendedFileEntry, func() []byte) {
+	efe := &ExtendedFileEntry{}
+	efe.Descriptor = Descriptor{DescriptorVersion: uw.descriptorVersion(), TagLocation: location}
+	efe.ICBTag = icbTag
+	efe.ImplementationIdentifier = implementationIdentifier()
+	return efe, func() []byte {
+		var b []byte
+		if uw.opts.Revision >= UDF_REVISION_250 {
+			efe.ObjectSize = efe.InformationLength
+			b, _ = efe.MarshalBinary()
+		} else {
+			b, _ = efe.FileEntry.MarshalBinary()
+		}
+		return b
+	}
+}
+
+func (uw *Writer) fileEntry(node *writerNode) ([]byte, error) {
+	hdr := node.hdr
+	flags := uint16(0)
+	if hdr.Mode&os.ModeSetuid != 0 {
+		flags |= ICB_FLAG_SETUID
+	}
+	if hdr.Mode&os.ModeSetgid != 0 {
+		flags |= ICB_FLAG_SETGID
+	}
+	if hdr.Mode&os.ModeSticky != 0 {
+		flags |= ICB_FLAG_STICKY
+	}
+	icbTag := &ICBTag{
+		StrategyType:           ICB_STRATEGY_4,
+		MaximumNumberOfEntries: 1,
+		FileType:               udfFileType(hdr.Mode),
+		Flags:                  flags,
+		AllocationType:         LongDescriptors,
+	}
+	efe, marshal := uw.newFileEntry(node.location.LogicalBlockNumber, icbTag)
+
+	modTime := hdr.ModTime
+	if modTime.IsZero() {
+		modTime = uw.opts.RecordingTime
+	}
+	orDefault := func(t time.Time) time.Time {
+		if t.IsZero() {
+			return modTime
+		}
+		return t
+	}
+	efe.Uid = hdr.Uid
+	efe.Gid = hdr.Gid
+	efe.Permissions = udfPermissions(hdr.Mode)
+	efe.FileLinkCount = 1
+	if node.isDir() {
+		for _, child := range node.children {
+			if child.isDir() {
+				efe.FileLinkCount++
+			}
+		}
+	}
+	efe.ModificationTime = modTime
+	efe.AccessTime = orDefault(hdr.AccessTime)
+	efe.AttributeTime = orDefault(hdr.ChangeTime)
+	efe.CreationTime = modTime
+	efe.Checkpoint = 1
+	efe.UniqueId = node.uniqueID
+	if icbTag.FileType == FILE_TYPE_BLOCK_DEVICE || icbTag.FileType == FILE_TYPE_CHARACTER_DEVICE {
+		efe.ExtendedAttributes = uw.deviceAttributes(node.location.LogicalBlockNumber, hdr.Devmajor, hdr.Devminor)
+	}
+
+	if node.extents == nil {
+		icbTag.AllocationType = Embedded
+		efe.InformationLength = uint64(len(node.data))
+		efe.AllocationDescriptors = node.data
+	} else {
+		for _, extent := range node.extents {
+			efe.InformationLength += uint64(extent.Length)
+			efe.LogicalBlocksRecorded += uint64((extent.Length + uw.opts.BlockSize - 1) / uw.opts.BlockSize)
+			ad, _ := extent.MarshalBinary()
+			efe.AllocationDescriptors = append(efe.AllocationDescriptors, ad...)
+		}
+	}
+	b := marshal()
+	if len(b) > int(uw.opts.BlockSize) {
+		return nil, fmt.Errorf("udf: file entry of %s does not fit in a block", hdr.Name)
+	}
+	return b, nil
+}
+
+// metadataFileEntry returns the file entry of the metadata file, its mirror
+// or its bitmap, recorded in the physical partition
+func (uw *Writer) metadataFileEntry(location uint32, fileType uint8, start uint32, length uint64) ([]byte, error) {
+	icbTag := &ICBTag{
+		StrategyType:           ICB_STRATEGY_4,
+		MaximumNumberOfEntries: 1,
+		FileType:               fileType,
+		AllocationType:         ShortDescriptors,
+	}
+	efe, marshal := uw.newFileEntry(location, icbTag)
+	efe.FileLinkCount = 1
+	efe.ModificationTime = uw.opts.RecordingTime
+	efe.AccessTime = uw.opts.RecordingTime
+	efe.AttributeTime = uw.opts.RecordingTime
+	efe.CreationTime = uw.opts.RecordingTime
+	efe.Checkpoint = 1
+	for length > 0 {
+		extentLength := uint32(minUint64(length, uint64(uw.maxExtentLength())))
+		blocks := (extentLength + uw.opts.BlockSize - 1) / uw.opts.BlockSize
+		ad, _ := Extent{extentLength, start}.MarshalBinary()
+		efe.AllocationDescriptors = append(efe.AllocationDescriptors, ad...)
+		efe.InformationLength += uint64(extentLength)
+		efe.LogicalBlocksRecorded += uint64(blocks)
+		start += blocks
+		length -= uint64(extentLength)
+	}
+	b := marshal()
+	if len(b) > int(uw.opts.BlockSize) {
+		return nil, errors.New("udf: metadata file entry does not fit in a block")
+	}
+	return b, nil
+}
+
+// vatFile returns the blocks of a virtual allocation table recorded at the
+// given block of the physical partition, followed by the block of its VAT
+// ICB, which must be the last block recorded. The VAT ICB keeps the next
+// unique ID.
+func (uw *Writer) vatFile(location uint32, vat *VirtualAllocationTable, nextUniqueID uint64) (data []byte, icb []byte, err error) {
+	bs := int(uw.opts.BlockSize)
+	b, _ := vat.MarshalBinary()
+	blocks := (len(b) + bs - 1) / bs
+	data = make([]byte, blocks*bs)
+	copy(data, b)
+	fe, err := uw.metadataFileEntry(location+uint32(blocks), FILE_TYPE_VAT, location, uint64(len(b)))
+	if err != nil {
+		return nil, nil, err
+	}
+	// The unique ID ends the file entry fields before the lengths of the
+	// extended attributes and allocation descriptors
+	wl_u64(fe[uw.fileEntryHeaderLength()-16:], nextUniqueID)
+	setDescriptorTag(fe)
+	icb = make([]byte, bs)
+	copy(icb, fe)
+	return data, icb, nil
+}
+
+// writeVolumeStructures records the volume recognition sequence, the
+// volume descriptor sequences, the integrity sequence and the anchors
+func (uw *Writer) writeVolumeStructures(partitionLength uint32, metaBlocks uint32, bitmap Extent, fsdLocation LbAddr, files uint32, dirs uint32, nextUniqueID uint64) error {
+	bs := uint64(uw.opts.BlockSize)
+	rev250 := uw.opts.Revision >= UDF_REVISION_250
+	version := uw.descriptorVersion()
+
+	// Volume recognition sequence, from byte 32768 in 2048 byte records
+	recordSize := maxUint64(2048, bs)
+	nsr := "NSR03"
+	if uw.opts.Revision < UDF_REVISION_201 {
+		nsr = "NSR02"
+	}
+	for i, ident := range []string{"BEA01", nsr, "TEA01"} {
+		vsd := make([]byte, recordSize)
+		vsd[0] = 0
+		copy(vsd[1:6], ident)
+		vsd[6] = 1
+		if _, err := uw.w.WriteAt(vsd, 32768+int64(i)*int64(recordSize)); err != nil {
+			return err
+		}
+	}
+	mainVDS := maxUint64(32, (32768+3*recordSize+bs-1)/bs)
+	reserveVDS := mainVDS + 16
+	integrity := reserveVDS + 16
+	lastSector := writerPartitionStart + uint64(partitionLength)
+
+	pvd := &PrimaryVolumeDescriptor{
+		VolumeDescriptorSequenceNumber: 1,
+		VolumeIdentifier:               uw.opts.VolumeIdentifier,
+		VolumeSequenceNumber:           1,
+		MaximumVolumeSequenceNumber:    1,
+		InterchangeLevel:               2,
+		MaximumInterchangeLevel:        3,
+		CharacterSetList:               1,
+		MaximumCharacterSetList:        1,
+		// UDF 2.2.2.5: the first 16 characters are a unique hex number
+		VolumeSetIdentifier:      fmt.Sprintf("%016X%s", uw.opts.RecordingTime.UnixNano(), uw.opts.VolumeIdentifier),
+		ApplicationIdentifier:    newEntityID(IMPLEMENTATION_IDENTIFIER),
+		RecordingDateTime:        uw.opts.RecordingTime,
+		ImplementationIdentifier: implementationIdentifier(),
+		Flags:                    1,
+	}
+	iuvd := &ImplementationUseVolumeDescriptor{
+		VolumeDescriptorSequenceNumber: 2,
+		ImplementationIdentifier:       uw.udfIdentifier("*UDF LV Info"),
+		LogicalVolumeIdentifier:        uw.opts.VolumeIdentifier,
+		LVInfoImplementationIdentifier: implementationIdentifier(),
+	}
+	accessType := uint32(PARTITION_ACCESS_OVERWRITABLE)
+	if uw.opts.Revision < UDF_REVISION_201 {
+		accessType = PARTITION_ACCESS_REWRITABLE
+	}
+	anchors := []uint64{256, lastSector}
+	if uw.opts.WriteOnce {
+		// The last sector is the VAT ICB
+		accessType = PARTITION_ACCESS_WRITE_ONCE
+		anchors = anchors[:1]
+	}
+	phd := make([]byte, 128)
+	bitmap.encode(phd[8:])
+	pd := &PartitionDescriptor{
+		VolumeDescriptorSequenceNumber: 3,
+		PartitionFlags:                 1,
+		PartitionContents:              newEntityID("+" + nsr),
+		PartitionContentsUse:           phd,
+		AccessType:                     accessType,
+		PartitionStartingLocation:      writerPartitionStart,
+		PartitionLength:                partitionLength,
+		ImplementationIdentifier:       implementationIdentifier(),
+	}
+	lvd := &LogicalVolumeDescriptor{
+		VolumeDescriptorSequenceNumber: 4,
+		LogicalVolumeIdentifier:        uw.opts.VolumeIdentifier,
+		LogicalBlockSize:               uint32(bs),
+		DomainIdentifier:               uw.domainIdentifier(),
+		LogicalVolumeContentsUse:       ExtentLong{uint32(bs), fsdLocation},
+		ImplementationIdentifier:       implementationIdentifier(),
+		IntegritySequenceExtent:        Extent{uint32(2 * bs), uint32(integrity)},
+		PartitionMaps:                  []PartitionMap{{PartitionMapType: 1, VolumeSequenceNumber: 1}},
+	}
+	freeSpace := []uint32{uw.opts.FreeBlocks}
+	sizes := []uint32{partitionLength}
+	if rev250 {
+		metaMap := make([]byte, 64)
+		wl_u32(metaMap[40:], 0)
+		wl_u32(metaMap[44:], 1)
+		wl_u32(metaMap[48:], 2)
+		wl_u32(metaMap[52:], 32)
+		wl_u16(metaMap[56:], 1)
+		lvd.PartitionMaps = append(lvd.PartitionMaps, PartitionMap{
+			PartitionMapType:        2,
+			VolumeSequenceNumber:    1,
+			PartitionTypeIdentifier: uw.udfIdentifier("*UDF Metadata Partition"),
+			data:                    metaMap,
+		})
+		freeSpace = append(freeSpace, uw.opts.FreeMetadataBlocks)
+		sizes = append(sizes, metaBlocks)
+	}
+	if uw.opts.WriteOnce {
+		lvd.PartitionMaps = append(lvd.PartitionMaps, PartitionMap{
+			PartitionMapType:        2,
+			VolumeSequenceNumber:    1,
+			PartitionTypeIdentifier: uw.udfIdentifier("*UDF Virtual Partition"),
+		})
+		freeSpace = append(freeSpace, 0)
+		sizes = append(sizes, 0xFFFFFFFF)
+	}
+
+	for _, seq := range []uint64{mainVDS, reserveVDS} {
+		pvd.Descriptor = Descriptor{DescriptorVersion: version, TagLocation: uint32(seq)}
+		iuvd.Descriptor = Descriptor{DescriptorVersion: version, TagLocation: uint32(seq) + 1}
+		pd.Descriptor = Descriptor{DescriptorVersion: version, TagLocation: uint32(seq) + 2}
+		lvd.Descriptor = Descriptor{DescriptorVersion: version, TagLocation: uint32(seq) + 3}
+		usd := &UnallocatedSpaceDescriptor{
+			Descriptor:                     Descriptor{DescriptorVersion: version, TagLocation: uint32(seq) + 4},
+			VolumeDescriptorSequenceNumber: 5,
+		}
+		var descriptors [][]byte
+		for _, d := range []encoding.BinaryMarshaler{pvd, iuvd, pd, lvd, usd} {
+			b, _ := d.MarshalBinary()
+			descriptors = append(descriptors, b)
+		}
+		descriptors = append(descriptors, uw.terminatingDescriptor(uint32(seq)+5))
+		for i, b := range descriptors {
+			if err := uw.writeSectors(seq+uint64(i), b); err != nil {
+				return err
+			}
+		}
+	}
+
+	lvid := &LogicalVolumeIntegrityDescriptor{
+		Descriptor:               Descriptor{DescriptorVersion: version, TagLocation: uint32(integrity)},
+		RecordingDateTime:        uw.opts.RecordingTime,
+		IntegrityType:            INTEGRITY_TYPE_CLOSE,
+		UniqueID:                 nextUniqueID,
+		FreeSpaceTable:           freeSpace,
+		SizeTable:                sizes,
+		ImplementationIdentifier: implementationIdentifier(),
+		NumberOfFiles:            files,
+		NumberOfDirectories:      dirs,
+		MinimumUDFReadRevision:   uw.opts.Revision,
+		MinimumUDFWriteRevision:  uw.opts.Revision,
+		MaximumUDFWriteRevision:  uw.opts.Revision,
+	}
+	b, _ := lvid.MarshalBinary()
+	if err := uw.writeSectors(integrity, b); err != nil {
+		return err
+	}
+	if err := uw.writeSectors(integrity+1, uw.terminatingDescriptor(uint32(integrity+1))); err != nil {
+		return err
+	}
+
+	anchor := &AnchorVolumeDescriptorPointer{
+		MainVolumeDescriptorSeq:    Extent{uint32(16 * bs), uint32(mainVDS)},
+		ReserveVolumeDescriptorSeq: Extent{uint32(16 * bs), uint32(reserveVDS)},
+	}
+	for _, sector := range anchors {
+		anchor.Descriptor = Descriptor{DescriptorVersion: version, TagLocation: uint32(sector)}
+		b, _ := anchor.MarshalBinary()
+		// Anchors fill their sector, which makes the last one set the image size
+		if err := uw.writeSectors(sector, append(b, make([]byte, bs-uint64(len(b)))...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
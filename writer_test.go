@@ -0,0 +1,332 @@
+package udf
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memImage is an image recorded in memory
+type memImage struct {
+	b []byte
+}
+
+func (m *memImage) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.b).ReadAt(p, off)
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.b) {
+		m.b = append(m.b, make([]byte, end-len(m.b))...)
+	}
+	copy(m.b[off:], p)
+	return len(p), nil
+}
+
+func (m *memImage) Size() int64 {
+	return int64(len(m.b))
+}
+
+// sparseImage is an image keeping only the chunks with data, for files too
+// large to hold in memory
+type sparseImage struct {
+	chunks map[int64][]byte
+	size   int64
+}
+
+const sparseChunk = 65536
+
+func (s *sparseImage) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		if off+int64(n) >= s.size {
+			return n, io.EOF
+		}
+		pos := off + int64(n)
+		chunk := s.chunks[pos/sparseChunk]
+		end := minUint64(uint64(len(p)-n), uint64(sparseChunk-pos%sparseChunk))
+		end = minUint64(end, uint64(s.size-pos))
+		if chunk != nil {
+			copy(p[n:n+int(end)], chunk[pos%sparseChunk:])
+		} else {
+			for i := n; i < n+int(end); i++ {
+				p[i] = 0
+			}
+		}
+		n += int(end)
+	}
+	return n, nil
+}
+
+func (s *sparseImage) WriteAt(p []byte, off int64) (int, error) {
+	if s.chunks == nil {
+		s.chunks = make(map[int64][]byte)
+	}
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		length := int(minUint64(uint64(len(p)-n), uint64(sparseChunk-pos%sparseChunk)))
+		chunk := s.chunks[pos/sparseChunk]
+		if chunk == nil && !bytes.Equal(p[n:n+length], make([]byte, length)) {
+			chunk = make([]byte, sparseChunk)
+			s.chunks[pos/sparseChunk] = chunk
+		}
+		if chunk != nil {
+			copy(chunk[pos%sparseChunk:], p[n:n+length])
+		}
+		n += length
+	}
+	if end := off + int64(len(p)); end > s.size {
+		s.size = end
+	}
+	return len(p), nil
+}
+
+func (s *sparseImage) Size() int64 {
+	return s.size
+}
+
+var testTime = time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testData is the content of the large test file, spanning many blocks
+var testData = bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+// writeTestImage records a volume of a few files of every kind
+func writeTestImage(t *testing.T, opts WriterOptions) *memImage {
+	t.Helper()
+	img := &memImage{}
+	opts.VolumeIdentifier = "TESTVOL"
+	opts.RecordingTime = testTime
+	uw := NewWriter(img, &opts)
+	entries := []struct {
+		hdr  Header
+		data []byte
+	}{
+		{Header{Name: "dir/sub", Mode: os.ModeDir | 0700}, nil},
+		{Header{Name: "dir/small.txt", Mode: 0644, ModTime: testTime.Add(-time.Hour)}, []byte("hello")},
+		{Header{Name: "big.bin", Mode: os.ModeSetuid | 0755}, testData},
+		{Header{Name: "link", Mode: os.ModeSymlink | 0777, Linkname: "dir/small.txt"}, nil},
+		{Header{Name: "dev/tty", Mode: os.ModeDevice | os.ModeCharDevice | 0620, Devmajor: 4, Devminor: 64}, nil},
+		{Header{Name: "dev/sda", Mode: os.ModeDevice | 0660, Devmajor: 8, Devminor: 1}, nil},
+		{Header{Name: "empty", Mode: 0600}, nil},
+	}
+	for i := 0; i < 60; i++ {
+		// Enough entries for the directory to take several blocks
+		entries = append(entries, struct {
+			hdr  Header
+			data []byte
+		}{Header{Name: "many/a_file_with_a_long_name_" + string(rune('a'+i%26)) + strings.Repeat("x", i/26), Mode: 0644}, nil})
+	}
+	for _, entry := range entries {
+		entry.hdr.Size = int64(len(entry.data))
+		if err := uw.WriteHeader(&entry.hdr); err != nil {
+			t.Fatalf("%s: %v", entry.hdr.Name, err)
+		}
+		if entry.data == nil {
+			continue
+		}
+		if _, err := uw.Write(entry.data); err != nil {
+			t.Fatalf("%s: %v", entry.hdr.Name, err)
+		}
+	}
+	if err := uw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// findFile looks up a slash-separated path from the root directory
+func findFile(u *Udf, name string) (f File, ok bool) {
+	var fe FileEntryInterface
+	for _, component := range strings.Split(name, "/") {
+		ok = false
+		for _, entry := range u.ReadDir(fe) {
+			if entry.Name() == component {
+				f, ok = entry, true
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+		fe = f.FileEntry()
+	}
+	return
+}
+
+func readTestFile(t *testing.T, u *Udf, name string) string {
+	t.Helper()
+	f, ok := findFile(u, name)
+	if !ok {
+		t.Fatalf("%s is missing", name)
+	}
+	b, err := ioutil.ReadAll(f.NewReader())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return string(b)
+}
+
+// countEntries counts the files and directories below a directory, the
+// way the logical volume integrity descriptor does
+func countEntries(u *Udf, fe FileEntryInterface) (files uint32, dirs uint32) {
+	for _, f := range u.ReadDir(fe) {
+		if f.IsDir() {
+			dirs++
+			subFiles, subDirs := countEntries(u, f.FileEntry())
+			files += subFiles
+			dirs += subDirs
+		} else {
+			files++
+		}
+	}
+	return
+}
+
+// checkVolume opens an image and checks it is consistent: Fsck finds
+// nothing, and the integrity descriptor records the entries and free space
+// found on the volume
+func checkVolume(t *testing.T, img io.ReaderAt) *Udf {
+	t.Helper()
+	u, err := NewUdfFromReader(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range u.Fsck() {
+		t.Errorf("fsck: %s %s: %s", problem.Check, problem.Path, problem.Message)
+	}
+	if u.VirtualAllocationTable() != nil {
+		// Write-once volumes keep their counts in the VAT
+		return u
+	}
+	lvid := u.LogicalVolumeIntegrity()
+	if lvid == nil {
+		t.Fatal("no logical volume integrity descriptor")
+	}
+	files, dirs := countEntries(u, nil)
+	if lvid.NumberOfFiles != files || lvid.NumberOfDirectories != dirs+1 {
+		t.Errorf("integrity descriptor counts %d files and %d directories, found %d and %d", lvid.NumberOfFiles, lvid.NumberOfDirectories, files, dirs+1)
+	}
+	for _, space := range u.FreeSpace() {
+		if space.Source == SPACE_BITMAP && space.RecordedFreeBlocks != space.FreeBlocks {
+			t.Errorf("partition %d has %d free blocks, %d recorded", space.Partition, space.FreeBlocks, space.RecordedFreeBlocks)
+		}
+	}
+	return u
+}
+
+func TestWriterReadBack(t *testing.T) {
+	tests := []WriterOptions{
+		{Revision: UDF_REVISION_102},
+		{Revision: UDF_REVISION_201},
+		{Revision: UDF_REVISION_250},
+		{Revision: UDF_REVISION_102, BlockSize: 512, FreeBlocks: 10},
+		{Revision: UDF_REVISION_201, BlockSize: 4096, FreeBlocks: 10},
+		{Revision: UDF_REVISION_250, BlockSize: 512, FreeMetadataBlocks: 16},
+		{Revision: UDF_REVISION_250, FreeBlocks: 100, FreeMetadataBlocks: 16},
+		{Revision: UDF_REVISION_201, WriteOnce: true},
+		{Revision: UDF_REVISION_201, BlockSize: 4096, WriteOnce: true},
+	}
+	for _, opts := range tests {
+		img := writeTestImage(t, opts)
+		u := checkVolume(t, img)
+		if t.Failed() {
+			t.Fatalf("%+v", opts)
+		}
+		blockSize := opts.BlockSize
+		if blockSize == 0 {
+			blockSize = 2048
+		}
+		info := u.Info()
+		if info.UDFRevision != opts.Revision || info.VolumeIdentifier != "TESTVOL" || u.SECTOR_SIZE != uint64(blockSize) {
+			t.Errorf("%+v: recorded revision %s, label %q, block size %d", opts, UDFRevisionString(info.UDFRevision), info.VolumeIdentifier, u.SECTOR_SIZE)
+		}
+		if (u.VirtualAllocationTable() != nil) != opts.WriteOnce {
+			t.Errorf("%+v: virtual allocation table recorded: %v", opts, !opts.WriteOnce)
+		}
+
+		if s := readTestFile(t, u, "dir/small.txt"); s != "hello" {
+			t.Errorf("%+v: dir/small.txt reads %q", opts, s)
+		}
+		if s := readTestFile(t, u, "big.bin"); s != string(testData) {
+			t.Errorf("%+v: big.bin reads %d bytes", opts, len(s))
+		}
+		if s := readTestFile(t, u, "empty"); s != "" {
+			t.Errorf("%+v: empty reads %q", opts, s)
+		}
+		small, _ := findFile(u, "dir/small.txt")
+		if !small.ModTime().Equal(testTime.Add(-time.Hour)) {
+			t.Errorf("%+v: dir/small.txt modified %v", opts, small.ModTime())
+		}
+		if big, _ := findFile(u, "big.bin"); big.Mode() != os.ModeSetuid|0755 {
+			t.Errorf("%+v: big.bin has mode %v", opts, big.Mode())
+		}
+		if sub, _ := findFile(u, "dir/sub"); sub.Mode() != os.ModeDir|0700 {
+			t.Errorf("%+v: dir/sub has mode %v", opts, sub.Mode())
+		}
+		link, _ := findFile(u, "link")
+		if target, err := link.Readlink(); err != nil || target != "dir/small.txt" || link.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%+v: link points to %q (%v), mode %v", opts, target, err, link.Mode())
+		}
+		for name, want := range map[string][3]uint32{"dev/tty": {4, 64, 1}, "dev/sda": {8, 1, 0}} {
+			dev, _ := findFile(u, name)
+			major, minor, ok := dev.Device()
+			if !ok || major != want[0] || minor != want[1] || (dev.Mode()&os.ModeCharDevice != 0) != (want[2] == 1) {
+				t.Errorf("%+v: %s is device %d,%d (%v), mode %v", opts, name, major, minor, ok, dev.Mode())
+			}
+		}
+		if many, _ := findFile(u, "many"); len(many.ReadDir()) != 60 {
+			t.Errorf("%+v: many lists %d entries", opts, len(many.ReadDir()))
+		}
+	}
+}
+
+func TestWriterMultiExtent(t *testing.T) {
+	for _, revision := range []uint16{UDF_REVISION_201, UDF_REVISION_250} {
+		img := &sparseImage{}
+		uw := NewWriter(img, &WriterOptions{Revision: revision, RecordingTime: testTime})
+		// Two full extents and a partial one, marked around their ends
+		size := int64(2*uw.maxExtentLength()) + 100
+		marks := []int64{0, int64(uw.maxExtentLength()) - 1, int64(uw.maxExtentLength()), 2 * int64(uw.maxExtentLength()), size - 1}
+		if err := uw.WriteHeader(&Header{Name: "huge.bin", Mode: 0644, Size: size}); err != nil {
+			t.Fatal(err)
+		}
+		chunk := make([]byte, 1<<20)
+		for pos := int64(0); pos < size; {
+			n := int(minUint64(uint64(len(chunk)), uint64(size-pos)))
+			for i := range chunk[:n] {
+				chunk[i] = 0
+			}
+			for _, mark := range marks {
+				if mark >= pos && mark < pos+int64(n) {
+					chunk[mark-pos] = uint8(mark%251) + 1
+				}
+			}
+			if _, err := uw.Write(chunk[:n]); err != nil {
+				t.Fatal(err)
+			}
+			pos += int64(n)
+		}
+		if err := uw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		u := checkVolume(t, img)
+		f, ok := findFile(u, "huge.bin")
+		if !ok {
+			t.Fatal("huge.bin is missing")
+		}
+		if f.Size() != size || len(f.FileEntry().GetAllocationDescriptors()) != 3 {
+			t.Errorf("%s: %d bytes in %d extents", UDFRevisionString(revision), f.Size(), len(f.FileEntry().GetAllocationDescriptors()))
+		}
+		r := f.NewReader()
+		for _, mark := range marks {
+			b := make([]byte, 1)
+			if _, err := r.ReadAt(b, mark); err != nil || b[0] != uint8(mark%251)+1 {
+				t.Errorf("%s: byte %d reads %d (%v)", UDFRevisionString(revision), mark, b[0], err)
+			}
+		}
+	}
+}